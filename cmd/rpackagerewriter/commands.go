@@ -0,0 +1,356 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/archive"
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/rewriter"
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/store"
+)
+
+const (
+	bufferSize = 32 * 1024
+	// defaultGzipLevel is the default of the `-gzip-level` flag, and the level of commands
+	// without it.
+	defaultGzipLevel = 6
+)
+
+// result is the JSON object written for each package.
+type result struct {
+	// Input is the path the package was read from, or `-` for stdin.
+	Input string
+	*archive.RewriteResults
+	// Error describes why the package failed.
+	Error string `json:",omitempty"`
+	// Skipped and Changed report how the package compares with the journal of the rewrite.
+	Skipped bool `json:",omitempty"`
+	Changed bool `json:",omitempty"`
+}
+
+// rewriteFlags are the flags that configure how packages are rewritten.
+type rewriteFlags struct {
+	repository    string
+	digests       string
+	deterministic bool
+	gzipLevel     int
+	verbose       bool
+}
+
+func newFlagSet(e *env, name, args string, rf *rewriteFlags) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(e.stderr)
+	fs.Usage = func() {
+		_, _ = fmt.Fprintf(e.stderr, "Usage: rpackagerewriter %s [flags] %s\n\nFlags:\n", name, args)
+		fs.PrintDefaults()
+	}
+	fs.BoolVar(&rf.verbose, "v", false, "log diagnostics and metrics to stderr")
+	return fs
+}
+
+func (rf *rewriteFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&rf.repository, "repository", archive.DefaultRepository, "value of the DESCRIPTION `Repository` field")
+	fs.StringVar(&rf.digests, "digests", "", "comma-separated `list` of digests to compute in addition to sha256 (md5, sha1, sha512, blake2b-256, blake2b-512)")
+	fs.BoolVar(&rf.deterministic, "deterministic", false, "write tarballs that depend only on the package contents")
+	fs.IntVar(&rf.gzipLevel, "gzip-level", defaultGzipLevel, "gzip compression `level` (1-9) of rewritten tarballs")
+}
+
+// options returns the rewriter options for the flags.
+func (rf *rewriteFlags) options(e *env) rewriter.Options {
+	opts := rewriter.Options{RewriteOptions: archive.RewriteOptions{
+		Repository:    rf.repository,
+		Deterministic: rf.deterministic,
+	}}
+	if rf.gzipLevel != 0 {
+		opts.CompressionLevels = archive.CompressionLevels{archive.FormatGzip: rf.gzipLevel}
+	}
+	for _, d := range strings.Split(rf.digests, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			opts.Digests = append(opts.Digests, archive.Digest(d))
+		}
+	}
+	if rf.verbose {
+		opts.Logger = slog.New(slog.NewTextHandler(e.stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	}
+	return opts
+}
+
+// parse parses `args` and returns the packages to read.
+func parse(fs *flag.FlagSet, args []string) ([]string, error) {
+	if err := fs.Parse(args); err != nil {
+		return nil, errUsage
+	}
+	return expandInputs(fs.Args())
+}
+
+// resultWriter writes results as JSON lines and records whether any package failed.
+type resultWriter struct {
+	enc    *json.Encoder
+	failed bool
+}
+
+func newResultWriter(w io.Writer) *resultWriter {
+	return &resultWriter{enc: json.NewEncoder(w)}
+}
+
+// write writes the results of `input`. Results returned with an error are written along
+// with the error.
+func (rw *resultWriter) write(input string, results *archive.RewriteResults, err error) error {
+	return rw.writeResult(result{Input: input, RewriteResults: results}, err)
+}
+
+func (rw *resultWriter) writeResult(res result, err error) error {
+	if err != nil {
+		res.Error = err.Error()
+		rw.failed = true
+	}
+	if err = rw.enc.Encode(res); err != nil {
+		return fmt.Errorf("error writing results: %s", err)
+	}
+	return nil
+}
+
+// err returns errFailed when any package failed.
+func (rw *resultWriter) err() error {
+	if rw.failed {
+		return errFailed
+	}
+	return nil
+}
+
+// forEach calls `fn` for every input and writes its results as JSON lines to stdout.
+// It returns errFailed when any package failed.
+func forEach(e *env, inputs []string, fn func(input string, r io.Reader) (*archive.RewriteResults, error)) error {
+	out := newResultWriter(e.stdout)
+	for _, input := range inputs {
+		var results *archive.RewriteResults
+		r, closeInput, err := openInput(e, input)
+		if err == nil {
+			results, err = fn(input, r)
+			closeInput()
+		}
+		if err = out.write(input, results, err); err != nil {
+			return err
+		}
+	}
+	return out.err()
+}
+
+func runRewrite(e *env, args []string) error {
+	var rf rewriteFlags
+	fs := newFlagSet(e, "rewrite", "[path ...]", &rf)
+	rf.register(fs)
+	output := fs.String("output", ".", "`directory` for the rewritten packages")
+	readmeOutput := fs.String("readme-output", "", "`directory` for the extracted READMEs (default: the output directory)")
+	keepCompression := fs.Bool("keep-compression", false, "compress tarballs like the original package instead of with gzip")
+	regenerateMD5 := fs.Bool("regenerate-md5", false, "regenerate the MD5 file of every package")
+	workers := fs.Int("workers", 1, "number of packages rewritten at once; results are written as packages complete")
+	journalPath := fs.String("journal", "", "`file` recording the rewritten packages, so that an interrupted rewrite can be resumed")
+	memoryBudget := fs.Int64("memory-budget", 0, "`bytes` of memory estimated for the packages rewritten at once, or 0 for no limit")
+	inputs, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if *readmeOutput == "" {
+		*readmeOutput = *output
+	}
+	for _, dir := range []string{*output, *readmeOutput} {
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("error creating output directory: %s", err)
+		}
+	}
+
+	opts := rf.options(e)
+	opts.RegenerateMD5 = *regenerateMD5
+	if *keepCompression {
+		opts.Output = archive.OutputKeepInput
+	}
+	opts.Store = store.NewLocalStore(*output)
+	rw := rewriter.NewRPackageRewriter(*output, *readmeOutput, "", &packagePathGetter{}, bufferSize, defaultGzipLevel, opts)
+	out := newResultWriter(e.stdout)
+	var paths []string
+	for _, input := range inputs {
+		if input != stdinInput {
+			paths = append(paths, input)
+			continue
+		}
+		results, err := rewriteStdin(e, rw, *output)
+		if err = out.write(input, results, err); err != nil {
+			return err
+		}
+	}
+
+	batchOpts := rewriter.BatchOptions{Workers: *workers, MemoryBudget: *memoryBudget, Store: opts.Store}
+	if *journalPath != "" {
+		if batchOpts.Journal, err = rewriter.OpenJournal(*journalPath); err != nil {
+			return err
+		}
+		defer func(j *rewriter.Journal) {
+			_ = j.Close()
+		}(batchOpts.Journal)
+	}
+	for res := range rewriter.RewriteBatch(context.Background(), rw, paths, batchOpts) {
+		r := result{Input: res.Path, RewriteResults: res.Results, Skipped: res.Skipped, Changed: res.Changed}
+		if err = out.writeResult(r, res.Err); err != nil {
+			return err
+		}
+	}
+	return out.err()
+}
+
+// rewriteStdin rewrites the package read from stdin. Rewrite reads from a file so that ZIP
+// binaries are read in place, so stdin is copied to a temporary file in `dir` first.
+func rewriteStdin(e *env, rw rewriter.RPackageRewriter, dir string) (*archive.RewriteResults, error) {
+	f, err := os.CreateTemp(dir, "stdin")
+	if err != nil {
+		return nil, fmt.Errorf("error creating temp file for stdin: %s", err)
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}(f)
+	if _, err = io.Copy(f, e.stdin); err != nil {
+		return nil, fmt.Errorf("error reading stdin: %s", err)
+	}
+	return rw.Rewrite(f.Name())
+}
+
+func runReadme(e *env, args []string) error {
+	var rf rewriteFlags
+	fs := newFlagSet(e, "readme", "[path]", &rf)
+	inputs, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(inputs) != 1 {
+		return fmt.Errorf("expected a single package, found %d", len(inputs))
+	}
+
+	dir, err := os.MkdirTemp("", "readme")
+	if err != nil {
+		return fmt.Errorf("error creating temp directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	r, closeInput, err := openInput(e, inputs[0])
+	if err != nil {
+		return err
+	}
+	defer closeInput()
+	rw := rewriter.NewRPackageRewriter("", dir, dir, &packagePathGetter{}, bufferSize, defaultGzipLevel, rf.options(e))
+	results, err := rw.GetReadme(r)
+	if err != nil {
+		return err
+	}
+	if results.ExtractedReadmePath == "" {
+		return fmt.Errorf("no README found in %s", inputs[0])
+	}
+
+	f, err := os.Open(results.ExtractedReadmePath)
+	if err != nil {
+		return err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+	_, err = io.Copy(e.stdout, f)
+	return err
+}
+
+func runDescribe(e *env, args []string) error {
+	var rf rewriteFlags
+	fs := newFlagSet(e, "describe", "[path ...]", &rf)
+	rf.register(fs)
+	asJSON := fs.Bool("json", false, "write the results as JSON instead of the DESCRIPTION files")
+	inputs, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+
+	rw := rewriter.NewRPackageRewriter("", "", "", &packagePathGetter{}, bufferSize, defaultGzipLevel, rf.options(e))
+	describe := func(input string, r io.Reader) (*archive.RewriteResults, error) {
+		return rw.RewriteBinary(r, io.Discard)
+	}
+	if *asJSON {
+		return forEach(e, inputs, describe)
+	}
+
+	// Write the DESCRIPTION files as DCF records separated by empty lines
+	failed := false
+	written := 0
+	for _, input := range inputs {
+		r, closeInput, err := openInput(e, input)
+		var results *archive.RewriteResults
+		if err == nil {
+			results, err = describe(input, r)
+			closeInput()
+		}
+		if err != nil {
+			_, _ = fmt.Fprintf(e.stderr, "%s: %s\n", input, err)
+			failed = true
+			continue
+		}
+		desc := strings.TrimRight(string(results.DescriptionFields.Bytes()), "\r\n") + "\n"
+		if written > 0 {
+			desc = "\n" + desc
+		}
+		if _, err = io.WriteString(e.stdout, desc); err != nil {
+			return fmt.Errorf("error writing DESCRIPTION: %s", err)
+		}
+		written++
+	}
+	if failed {
+		return errFailed
+	}
+	return nil
+}
+
+func runChecksum(e *env, args []string) error {
+	var rf rewriteFlags
+	fs := newFlagSet(e, "checksum", "[path ...]", &rf)
+	rf.register(fs)
+	inputs, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+
+	rw := rewriter.NewRPackageRewriter("", "", "", &packagePathGetter{}, bufferSize, defaultGzipLevel, rf.options(e))
+	return forEach(e, inputs, func(input string, r io.Reader) (*archive.RewriteResults, error) {
+		return rw.RewriteBinary(r, io.Discard)
+	})
+}
+
+func runVerify(e *env, args []string) error {
+	var rf rewriteFlags
+	fs := newFlagSet(e, "verify", "[path ...]", &rf)
+	inputs, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+
+	opts := rf.options(e)
+	opts.VerifyMD5 = true
+	rw := rewriter.NewRPackageRewriter("", "", "", &packagePathGetter{}, bufferSize, defaultGzipLevel, opts)
+	return forEach(e, inputs, func(input string, r io.Reader) (*archive.RewriteResults, error) {
+		results, err := rw.RewriteBinary(r, io.Discard)
+		if err != nil {
+			return nil, err
+		}
+		if results.MD5 == nil {
+			return results, fmt.Errorf("package has no MD5 file")
+		}
+		if !results.MD5.OK() {
+			return results, fmt.Errorf("MD5 file does not match: %d mismatched, %d missing and %d extra files",
+				len(results.MD5.Mismatched), len(results.MD5.Missing), len(results.MD5.Extra))
+		}
+		return results, nil
+	})
+}
@@ -0,0 +1,224 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/archive"
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/metadata"
+)
+
+func TestCommandsSuite(t *testing.T) {
+	suite.Run(t, &CommandsSuite{})
+}
+
+type CommandsSuite struct {
+	suite.Suite
+}
+
+const testdata = "../../pkg/testdata"
+
+// parseResults decodes the JSON lines written by a command.
+func (s *CommandsSuite) parseResults(stdout string) []result {
+	var results []result
+	scanner := bufio.NewScanner(strings.NewReader(stdout))
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		var res result
+		s.Require().Nil(json.Unmarshal(scanner.Bytes(), &res), scanner.Text())
+		results = append(results, res)
+	}
+	s.Require().Nil(scanner.Err())
+	return results
+}
+
+func (s *CommandsSuite) TestRewrite() {
+	out := filepath.Join(s.T().TempDir(), "out")
+	status, stdout, stderr := runCommand(nil, "rewrite", "-output", out, "-digests", "md5",
+		"-repository", "CRAN", filepath.Join(testdata, "DT_0.4.tar.gz"), filepath.Join(testdata, "binaries/bindrcpp_0.2.2.zip"))
+	s.Require().Equal(0, status, stderr)
+
+	results := s.parseResults(stdout)
+	s.Require().Len(results, 2)
+	s.Require().Equal(filepath.Join(testdata, "DT_0.4.tar.gz"), results[0].Input)
+	s.Require().Equal(filepath.Join(out, "DT_0.4.tar.gz"), results[0].RewrittenPath)
+	s.Require().Equal(filepath.Join(out, "DT_0.4.readme.md"), results[0].ExtractedReadmePath)
+	s.Require().Equal(filepath.Join(out, "bindrcpp_0.2.2.zip"), results[1].RewrittenPath)
+	for _, res := range results {
+		s.Require().Empty(res.Error)
+		data, err := os.ReadFile(res.RewrittenPath)
+		s.Require().Nil(err)
+		s.Require().Equal(fmt.Sprintf("%x", md5.Sum(data)), res.RewrittenDigests[archive.DigestMD5])
+		repo, _ := res.DescriptionFields.Get("Repository")
+		s.Require().Equal("CRAN", repo)
+	}
+}
+
+func (s *CommandsSuite) TestRewriteGzipLevel() {
+	sizes := make(map[string]int64)
+	for _, level := range []string{"1", "9"} {
+		status, stdout, stderr := runCommand(nil, "rewrite", "-output", s.T().TempDir(), "-gzip-level", level,
+			filepath.Join(testdata, "DT_0.4.tar.gz"))
+		s.Require().Equal(0, status, stderr)
+		sizes[level] = s.parseResults(stdout)[0].RewrittenSize
+	}
+	s.Require().Less(sizes["9"], sizes["1"])
+
+	status, stdout, _ := runCommand(nil, "rewrite", "-output", s.T().TempDir(), "-gzip-level", "10",
+		filepath.Join(testdata, "DT_0.4.tar.gz"))
+	s.Require().Equal(1, status)
+	s.Require().Contains(s.parseResults(stdout)[0].Error, "invalid compression level")
+}
+
+func (s *CommandsSuite) TestRewriteWorkers() {
+	out := s.T().TempDir()
+	status, stdout, stderr := runCommand(nil, "rewrite", "-output", out, "-workers", "3", "-memory-budget", "4000000",
+		filepath.Join(testdata, "binaries"))
+	s.Require().Equal(0, status, stderr)
+
+	// Results are written as packages complete
+	results := s.parseResults(stdout)
+	inputs := make([]string, 0, len(results))
+	for _, res := range results {
+		s.Require().Empty(res.Error)
+		s.Require().FileExists(res.RewrittenPath)
+		inputs = append(inputs, res.Input)
+	}
+	expected, err := expandInputs([]string{filepath.Join(testdata, "binaries")})
+	s.Require().Nil(err)
+	s.Require().ElementsMatch(expected, inputs)
+}
+
+func (s *CommandsSuite) TestRewriteJournal() {
+	out := s.T().TempDir()
+	journal := filepath.Join(s.T().TempDir(), "journal.jsonl")
+	args := []string{"rewrite", "-output", out, "-journal", journal, filepath.Join(testdata, "DT_0.4.tar.gz")}
+	status, stdout, stderr := runCommand(nil, args...)
+	s.Require().Equal(0, status, stderr)
+	s.Require().False(s.parseResults(stdout)[0].Skipped)
+
+	// Packages in the journal are skipped
+	status, stdout, stderr = runCommand(nil, args...)
+	s.Require().Equal(0, status, stderr)
+	results := s.parseResults(stdout)
+	s.Require().True(results[0].Skipped)
+	s.Require().Equal(filepath.Join(out, "DT_0.4.tar.gz"), results[0].RewrittenPath)
+}
+
+func (s *CommandsSuite) TestRewriteStdin() {
+	out := s.T().TempDir()
+	f, err := os.Open(filepath.Join(testdata, "binaries/bindrcpp_0.2.2.zip"))
+	s.Require().Nil(err)
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+
+	status, stdout, stderr := runCommand(f, "rewrite", "-output", out)
+	s.Require().Equal(0, status, stderr)
+	results := s.parseResults(stdout)
+	s.Require().Len(results, 1)
+	s.Require().Equal(stdinInput, results[0].Input)
+	s.Require().Equal(filepath.Join(out, "bindrcpp_0.2.2.zip"), results[0].RewrittenPath)
+
+	// The spooled copy of stdin is removed
+	entries, err := os.ReadDir(out)
+	s.Require().Nil(err)
+	s.Require().Len(entries, 1)
+}
+
+func (s *CommandsSuite) TestReadme() {
+	f, err := os.Open(filepath.Join(testdata, "readmetest_0.2.0.tar.gz"))
+	s.Require().Nil(err)
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+	status, stdout, stderr := runCommand(f, "readme")
+	s.Require().Equal(0, status, stderr)
+	s.Require().Equal("Hi, I'm the correct readme!", stdout)
+
+	status, _, stderr = runCommand(nil, "readme", filepath.Join(testdata, "binaries/bindrcpp_0.2.2.zip"))
+	s.Require().Equal(1, status)
+	s.Require().Contains(stderr, "no README found in")
+
+	status, _, stderr = runCommand(nil, "readme", filepath.Join(testdata, "binaries"))
+	s.Require().Equal(1, status)
+	s.Require().Contains(stderr, "expected a single package, found 5")
+}
+
+func (s *CommandsSuite) TestDescribe() {
+	status, stdout, stderr := runCommand(nil, "describe", filepath.Join(testdata, "DT_0.4.tar.gz"), filepath.Join(testdata, "adhoc_1.1.tar.gz"))
+	s.Require().Equal(0, status, stderr)
+	records, err := metadata.ParseDCF([]byte(stdout))
+	s.Require().Nil(err)
+	s.Require().Len(records, 2)
+	name, _ := records[1].Get("Package")
+	s.Require().Equal("adhoc", name)
+	repo, _ := records[1].Get("Repository")
+	s.Require().Equal(archive.DefaultRepository, repo)
+
+	status, stdout, stderr = runCommand(nil, "describe", "-json", filepath.Join(testdata, "DT_0.4.tar.gz"))
+	s.Require().Equal(0, status, stderr)
+	results := s.parseResults(stdout)
+	s.Require().Len(results, 1)
+	version, _ := results[0].DescriptionFields.Get("Version")
+	s.Require().Equal("0.4", version)
+
+	// Failures are reported, and the other packages are still described
+	status, stdout, stderr = runCommand(nil, "describe", filepath.Join(testdata, "binaries"))
+	s.Require().Equal(1, status)
+	s.Require().Contains(stderr, "bindrcpp_0.2.2-no-desc.tar.gz: error rewriting stream: no DESCRIPTION file found in archive")
+	records, err = metadata.ParseDCF([]byte(stdout))
+	s.Require().Nil(err)
+	s.Require().Len(records, 4)
+}
+
+func (s *CommandsSuite) TestChecksum() {
+	path := filepath.Join(testdata, "DT_0.4.tar.gz")
+	data, err := os.ReadFile(path)
+	s.Require().Nil(err)
+
+	status, stdout, stderr := runCommand(nil, "checksum", "-digests", "md5, sha1", path)
+	s.Require().Equal(0, status, stderr)
+	results := s.parseResults(stdout)
+	s.Require().Len(results, 1)
+	s.Require().Equal(int64(len(data)), results[0].OriginalSize)
+	s.Require().Equal(fmt.Sprintf("%x", md5.Sum(data)), results[0].OriginalDigests[archive.DigestMD5])
+	s.Require().Len(results[0].RewrittenDigests, 2)
+
+	status, stdout, _ = runCommand(nil, "checksum", "-digests", "crc32", path)
+	s.Require().Equal(1, status)
+	results = s.parseResults(stdout)
+	s.Require().Nil(results[0].RewriteResults)
+	s.Require().Contains(results[0].Error, "unsupported digest algorithm 'crc32'")
+}
+
+func (s *CommandsSuite) TestVerify() {
+	status, stdout, stderr := runCommand(nil, "verify", filepath.Join(testdata, "DT_0.4.tar.gz"))
+	s.Require().Equal(0, status, stderr)
+	results := s.parseResults(stdout)
+	s.Require().True(results[0].MD5.OK())
+
+	status, stdout, _ = runCommand(nil, "verify", filepath.Join(testdata, "DT_0.4.tar.gz"), filepath.Join(testdata, "special/SecondMD5_2.2.2.tar.gz"))
+	s.Require().Equal(1, status)
+	results = s.parseResults(stdout)
+	s.Require().Len(results, 2)
+	s.Require().Empty(results[0].Error)
+	s.Require().Equal("MD5 file does not match: 1 mismatched, 0 missing and 1 extra files", results[1].Error)
+	s.Require().Equal([]string{"tests/testthat/fixtures/MD5"}, results[1].MD5.Mismatched)
+
+	// Packages without an MD5 file cannot be verified
+	status, stdout, _ = runCommand(nil, "verify", filepath.Join(testdata, "binaries/DT_0.23.tar.gz"))
+	s.Require().Equal(1, status)
+	results = s.parseResults(stdout)
+	s.Require().Equal("package has no MD5 file", results[0].Error)
+	s.Require().Nil(results[0].MD5)
+}
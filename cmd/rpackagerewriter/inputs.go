@@ -0,0 +1,89 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/archive"
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/rewriter"
+)
+
+// stdinInput is the path that reads a package from stdin.
+const stdinInput = "-"
+
+// expandInputs returns the packages to read for `paths`. Directories are replaced by the
+// package archives they contain, in lexical order, and no paths at all read from stdin.
+func expandInputs(paths []string) ([]string, error) {
+	if len(paths) == 0 {
+		return []string{stdinInput}, nil
+	}
+	var inputs []string
+	stdin := false
+	for _, path := range paths {
+		if path == stdinInput {
+			if stdin {
+				return nil, fmt.Errorf("stdin can only be read once")
+			}
+			stdin = true
+			inputs = append(inputs, path)
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			inputs = append(inputs, path)
+			continue
+		}
+		found, err := rewriter.WalkPackages(path)
+		if err != nil {
+			return nil, err
+		}
+		inputs = append(inputs, found...)
+	}
+	return inputs, nil
+}
+
+// openInput opens the package at `input`. The returned function closes it.
+func openInput(e *env, input string) (io.Reader, func(), error) {
+	if input == stdinInput {
+		return e.stdin, func() {}, nil
+	}
+	f, err := os.Open(input)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error: could not open %s: %s", input, err)
+	}
+	return f, func() { _ = f.Close() }, nil
+}
+
+// packagePathGetter names rewritten packages and READMEs `<Package>_<Version>`, like the
+// files of a CRAN-style repository. Packages without a name or version are named after
+// their original checksum.
+type packagePathGetter struct{}
+
+func (g *packagePathGetter) name(arch *archive.Results) string {
+	pkg, _ := arch.DescriptionFields.Get("Package")
+	ver, _ := arch.DescriptionFields.Get("Version")
+	switch {
+	case pkg != "" && ver != "":
+		return pkg + "_" + ver
+	case arch.OriginalChecksum != "":
+		return arch.OriginalChecksum
+	}
+	return "README"
+}
+
+func (g *packagePathGetter) GetFileKey(arch *archive.Results) string {
+	return g.name(arch) + arch.RewrittenFormat.Extension()
+}
+
+func (g *packagePathGetter) GetReadmeKey(arch *archive.Results) string {
+	ext := ".readme"
+	if arch.ReadmeMarkdown {
+		ext += ".md"
+	}
+	return g.name(arch) + ext
+}
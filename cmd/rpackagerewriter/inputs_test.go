@@ -0,0 +1,71 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/archive"
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/metadata"
+)
+
+func TestInputsSuite(t *testing.T) {
+	suite.Run(t, &InputsSuite{})
+}
+
+type InputsSuite struct {
+	suite.Suite
+}
+
+func (s *InputsSuite) TestExpandInputs() {
+	dir := s.T().TempDir()
+	for _, name := range []string{"b_1.0.tar.gz", "a_1.0.zip", "notes.txt", "sub/c_1.0.tar.xz"} {
+		s.Require().Nil(os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755))
+		s.Require().Nil(os.WriteFile(filepath.Join(dir, name), nil, 0644))
+	}
+
+	// Reads stdin by default
+	inputs, err := expandInputs(nil)
+	s.Require().Nil(err)
+	s.Require().Equal([]string{stdinInput}, inputs)
+
+	// Directories are searched for packages, and files are kept as is
+	inputs, err = expandInputs([]string{filepath.Join(dir, "notes.txt"), dir, "-"})
+	s.Require().Nil(err)
+	s.Require().Equal([]string{
+		filepath.Join(dir, "notes.txt"),
+		filepath.Join(dir, "a_1.0.zip"),
+		filepath.Join(dir, "b_1.0.tar.gz"),
+		filepath.Join(dir, "sub/c_1.0.tar.xz"),
+		stdinInput,
+	}, inputs)
+
+	_, err = expandInputs([]string{"-", "-"})
+	s.Require().EqualError(err, "stdin can only be read once")
+
+	_, err = expandInputs([]string{filepath.Join(dir, "missing")})
+	s.Require().True(os.IsNotExist(err))
+}
+
+func (s *InputsSuite) TestPackagePathGetter() {
+	g := &packagePathGetter{}
+	results := &archive.Results{
+		RewrittenFormat:   archive.FormatXz,
+		OriginalChecksum:  "abc",
+		DescriptionFields: metadata.Fields{{Name: "Package", Value: "DT"}, {Name: "Version", Value: "0.4"}},
+	}
+	s.Require().Equal("DT_0.4.tar.xz", g.GetFileKey(results))
+	s.Require().Equal("DT_0.4.readme", g.GetReadmeKey(results))
+
+	results.RewrittenFormat = archive.FormatZip
+	results.ReadmeMarkdown = true
+	s.Require().Equal("DT_0.4.zip", g.GetFileKey(results))
+	s.Require().Equal("DT_0.4.readme.md", g.GetReadmeKey(results))
+
+	// Packages without a name are named after their checksum
+	results.DescriptionFields = nil
+	s.Require().Equal("abc.zip", g.GetFileKey(results))
+}
@@ -0,0 +1,95 @@
+// Copyright (C) 2023 by Posit Software, PBC
+
+// Command rpackagerewriter rewrites and inspects R packages with the `rewriter` package.
+//
+// Usage:
+//
+//	rpackagerewriter <command> [flags] [path ...]
+//
+// Every command reads the packages at the given paths. Directories are searched for package
+// archives, and a path of `-` or no path at all reads a single package from stdin. Results
+// are written to stdout as one JSON object per package, with the fields of
+// `archive.RewriteResults` and the `Input` the package was read from. Packages that fail
+// have an `Error` instead, and make the command exit with status 1.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// command is a subcommand of the tool.
+type command struct {
+	name    string
+	summary string
+	run     func(env *env, args []string) error
+}
+
+var commands = []command{
+	{"rewrite", "rewrite packages into an output directory", runRewrite},
+	{"readme", "print the README of a package", runReadme},
+	{"describe", "print the DESCRIPTION of packages as DCF or JSON", runDescribe},
+	{"checksum", "compute the checksums of packages and their rewritten versions", runChecksum},
+	{"verify", "check the files of packages against their MD5 file, which must exist", runVerify},
+}
+
+// env holds the streams a command reads and writes.
+type env struct {
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// errUsage is returned by commands that were given invalid arguments. The flag package has
+// already reported the problem.
+var errUsage = errors.New("usage error")
+
+// errFailed is returned by commands when at least one package failed. The failure has
+// already been reported in the results.
+var errFailed = errors.New("one or more packages failed")
+
+func main() {
+	os.Exit(run(os.Args[1:], &env{stdin: os.Stdin, stdout: os.Stdout, stderr: os.Stderr}))
+}
+
+// run runs the command named by the first argument and returns the exit status: 0 on
+// success, 1 when a package failed and 2 for usage errors.
+func run(args []string, e *env) int {
+	if len(args) == 0 {
+		usage(e.stderr)
+		return 2
+	}
+	if args[0] == "help" || args[0] == "-h" || args[0] == "-help" || args[0] == "--help" {
+		usage(e.stdout)
+		return 0
+	}
+	for _, cmd := range commands {
+		if cmd.name != args[0] {
+			continue
+		}
+		switch err := cmd.run(e, args[1:]); err {
+		case nil:
+			return 0
+		case errUsage:
+			return 2
+		case errFailed:
+			return 1
+		default:
+			_, _ = fmt.Fprintf(e.stderr, "rpackagerewriter %s: %s\n", cmd.name, err)
+			return 1
+		}
+	}
+	_, _ = fmt.Fprintf(e.stderr, "rpackagerewriter: unknown command %q\n", args[0])
+	usage(e.stderr)
+	return 2
+}
+
+func usage(w io.Writer) {
+	_, _ = fmt.Fprintf(w, "Usage: rpackagerewriter <command> [flags] [path ...]\n\nCommands:\n")
+	for _, cmd := range commands {
+		_, _ = fmt.Fprintf(w, "  %-10s %s\n", cmd.name, cmd.summary)
+	}
+	_, _ = fmt.Fprintf(w, "\nRun `rpackagerewriter <command> -h` for the flags of a command.\n")
+}
@@ -0,0 +1,51 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+func TestMainSuite(t *testing.T) {
+	suite.Run(t, &MainSuite{})
+}
+
+type MainSuite struct {
+	suite.Suite
+}
+
+// runCommand runs the tool with `args` and `stdin`, and returns the exit status and output.
+func runCommand(stdin io.Reader, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	status := run(args, &env{stdin: stdin, stdout: &stdout, stderr: &stderr})
+	return status, stdout.String(), stderr.String()
+}
+
+func (s *MainSuite) TestUsage() {
+	status, _, stderr := runCommand(nil)
+	s.Require().Equal(2, status)
+	s.Require().Contains(stderr, "Usage: rpackagerewriter <command>")
+
+	status, stdout, _ := runCommand(nil, "help")
+	s.Require().Equal(0, status)
+	for _, cmd := range commands {
+		s.Require().Contains(stdout, cmd.name)
+	}
+
+	status, _, stderr = runCommand(nil, "unknown")
+	s.Require().Equal(2, status)
+	s.Require().Contains(stderr, `unknown command "unknown"`)
+
+	status, _, stderr = runCommand(nil, "verify", "-unknown")
+	s.Require().Equal(2, status)
+	s.Require().Contains(stderr, "Usage: rpackagerewriter verify")
+}
+
+func (s *MainSuite) TestErrors() {
+	status, _, stderr := runCommand(nil, "checksum", "does-not-exist.tar.gz")
+	s.Require().Equal(1, status)
+	s.Require().Contains(stderr, "rpackagerewriter checksum: stat does-not-exist.tar.gz")
+}
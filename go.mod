@@ -3,13 +3,17 @@ module github.com/rstudio/package-manager-rpackagerewriter
 go 1.26.1
 
 require (
+	github.com/klauspost/compress v1.18.0
 	github.com/stretchr/testify v1.11.1
+	github.com/ulikunitz/xz v0.5.15
+	golang.org/x/crypto v0.51.0
 	golang.org/x/net v0.54.0
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/sys v0.44.0 // indirect
 	golang.org/x/text v0.37.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,80 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package utils
+
+import (
+	"context"
+	"io"
+)
+
+// NewContextReader returns a reader for `r` whose reads fail with the context error once
+// `ctx` is done, including a read that is blocked in `r`. Each read of `r` runs in its own
+// goroutine, and a read that is abandoned when `ctx` is done finishes in the background
+// without touching the caller's buffer.
+func NewContextReader(ctx context.Context, r io.Reader) io.Reader {
+	if ctx.Done() == nil {
+		// The context can never be canceled
+		return r
+	}
+	return &contextReader{ctx: ctx, r: r}
+}
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+	// buf receives the data of each read of `r`, so that an abandoned read never writes
+	// to a buffer that was returned to the caller.
+	buf []byte
+}
+
+type readResult struct {
+	n   int
+	err error
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if cap(c.buf) < len(p) {
+		c.buf = make([]byte, len(p))
+	}
+	buf := c.buf[:len(p)]
+	done := make(chan readResult, 1)
+	go func() {
+		n, err := c.r.Read(buf)
+		done <- readResult{n: n, err: err}
+	}()
+	select {
+	case res := <-done:
+		copy(p, buf[:res.n])
+		return res.n, res.err
+	case <-c.ctx.Done():
+		// The abandoned read owns `buf` until it returns
+		c.buf = nil
+		return 0, c.ctx.Err()
+	}
+}
+
+// NewContextWriter returns a writer for `w` that fails with the context error once `ctx`
+// is done.
+func NewContextWriter(ctx context.Context, w io.Writer) io.Writer {
+	if ctx.Done() == nil {
+		return w
+	}
+	return &contextWriter{ctx: ctx, w: w}
+}
+
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (c *contextWriter) Write(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.w.Write(p)
+}
@@ -0,0 +1,72 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package utils
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+func TestContextSuite(t *testing.T) {
+	suite.Run(t, &ContextSuite{})
+}
+
+type ContextSuite struct {
+	suite.Suite
+}
+
+func (s *ContextSuite) TestContextReader() {
+	// Reads pass through
+	ctx, cancel := context.WithCancel(context.Background())
+	r := NewContextReader(ctx, strings.NewReader("whatever"))
+	b := make([]byte, 4)
+	_, err := io.ReadFull(r, b)
+	s.Require().Nil(err)
+	s.Require().Equal("what", string(b))
+
+	// and fail once the context is done
+	cancel()
+	_, err = r.Read(b)
+	s.Require().ErrorIs(err, context.Canceled)
+
+	// Reads that are blocked in the source return once the context is done
+	ctx, cancel = context.WithCancel(context.Background())
+	started := make(chan struct{})
+	blocked := NewContextReader(ctx, readerFunc(func(p []byte) (int, error) {
+		close(started)
+		select {}
+	}))
+	go func() {
+		<-started
+		cancel()
+	}()
+	_, err = blocked.Read(b)
+	s.Require().ErrorIs(err, context.Canceled)
+
+	// Background contexts are not wrapped
+	src := strings.NewReader("whatever")
+	s.Require().Equal(src, NewContextReader(context.Background(), src))
+}
+
+func (s *ContextSuite) TestContextWriter() {
+	ctx, cancel := context.WithCancel(context.Background())
+	var b bytes.Buffer
+	w := NewContextWriter(ctx, &b)
+	_, err := w.Write([]byte("one"))
+	s.Require().Nil(err)
+
+	cancel()
+	_, err = w.Write([]byte("two"))
+	s.Require().ErrorIs(err, context.Canceled)
+	s.Require().Equal("one", b.String())
+}
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
@@ -3,42 +3,41 @@ package utils
 
 import (
 	"crypto/sha256"
+	"hash"
 	"io"
 )
 
-// NewEOFTeeReader - io.TeeReader is almost what we want, but it doesn't tee EOFs, which is
-// important for us when calculating checksums. This is a copy of the
-// io.TeeReader source with the modification that EOFs are also propagated.
-func NewEOFTeeReader(r io.Reader, w *io.PipeWriter) io.Reader {
-	return &EofTeeReader{r, w}
+// HashingReader computes the SHA256 checksum and size of everything read from the
+// underlying reader, inline with the reads. Read the stream to the end, for example with
+// `io.Copy(io.Discard, h)`, before calling Sum so that bytes nobody else consumed are
+// included.
+type HashingReader struct {
+	r    io.Reader
+	hash hash.Hash
+	size int64
 }
 
-type EofTeeReader struct {
-	r io.Reader
-	w *io.PipeWriter
+// NewHashingReader returns a HashingReader that reads from `r`.
+func NewHashingReader(r io.Reader) *HashingReader {
+	return &HashingReader{r: r, hash: sha256.New()}
 }
 
-func (t *EofTeeReader) Read(p []byte) (n int, err error) {
-	n, err = t.r.Read(p)
+func (h *HashingReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
 	if n > 0 {
-		if n, err := t.w.Write(p[:n]); err != nil {
-			_ = t.w.CloseWithError(err)
-			return n, err
-		}
-	} else if err == io.EOF {
-		_ = t.w.CloseWithError(io.EOF)
+		// hash.Hash never returns an error
+		_, _ = h.hash.Write(p[:n])
+		h.size += int64(n)
 	}
-	return
+	return n, err
 }
 
-// ComputeSha256Stream computes the sha256 of a given stream
-func ComputeSha256Stream(stream io.Reader) (int64, []byte, error) {
-	hash := sha256.New()
-	var sz int64
-	var err error
-	if sz, err = io.Copy(hash, stream); err != nil {
-		return 0, nil, err
-	}
+// Sum returns the SHA256 checksum of the bytes read so far.
+func (h *HashingReader) Sum() []byte {
+	return h.hash.Sum(nil)
+}
 
-	return sz, hash.Sum(nil), nil
+// Size returns the number of bytes read so far.
+func (h *HashingReader) Size() int64 {
+	return h.size
 }
@@ -2,9 +2,12 @@
 package utils
 
 import (
+	"crypto/sha256"
+	"errors"
 	"io"
 	"strings"
 	"testing"
+	"testing/iotest"
 
 	"github.com/stretchr/testify/suite"
 )
@@ -17,28 +20,34 @@ type ReaderSuite struct {
 	suite.Suite
 }
 
-func (s *ReaderSuite) TestEOFTeeReader() {
-	r := strings.NewReader("whatever")
-	pipeR, pipeW := io.Pipe()
-	tee := NewEOFTeeReader(r, pipeW)
-
-	done := make(chan struct{})
-
-	checkStream := func(r io.Reader) {
-		b, err := io.ReadAll(r)
-		s.Require().Nil(err) // ReadAll doesn't return an err if == EOF
-		s.Require().Equal([]byte("whatever"), b)
-		done <- struct{}{}
-	}
-
-	// Read the two streams in parallel since they're not buffered.
-	go checkStream(tee)
-	go checkStream(pipeR)
-
-	<-done
-	<-done
+func (s *ReaderSuite) TestHashingReader() {
+	expected := sha256.Sum256([]byte("whatever"))
+
+	h := NewHashingReader(strings.NewReader("whatever"))
+	b := make([]byte, 4)
+	_, err := io.ReadFull(h, b)
+	s.Require().Nil(err)
+	s.Require().Equal("what", string(b))
+	s.Require().Equal(int64(4), h.Size())
+
+	// Draining includes the remaining bytes
+	n, err := io.Copy(io.Discard, h)
+	s.Require().Nil(err)
+	s.Require().Equal(int64(4), n)
+	s.Require().Equal(int64(8), h.Size())
+	s.Require().Equal(expected[:], h.Sum())
+
+	// Short reads are hashed in order
+	h = NewHashingReader(iotest.OneByteReader(strings.NewReader("whatever")))
+	_, err = io.Copy(io.Discard, h)
+	s.Require().Nil(err)
+	s.Require().Equal(expected[:], h.Sum())
+}
 
-	// The fact that both streams terminated their ReadAll() call means that
-	// they errored or EOF'd, and since we check against error, this means that
-	// we've successfully got two client streams to get an EOF out of a tee.
+func (s *ReaderSuite) TestHashingReaderError() {
+	failure := errors.New("failure")
+	h := NewHashingReader(io.MultiReader(strings.NewReader("what"), iotest.ErrReader(failure)))
+	_, err := io.Copy(io.Discard, h)
+	s.Require().ErrorIs(err, failure)
+	s.Require().Equal(int64(4), h.Size())
 }
@@ -0,0 +1,85 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ErrSpoolTooLarge is returned when a stream exceeds the maximum size allowed by NewSpool.
+var ErrSpoolTooLarge = errors.New("stream exceeds the maximum spool size")
+
+// Spool holds a copy of a stream so that it can be read with random access. Small
+// streams are kept in memory, while larger ones are written to a temporary file that
+// is removed by Close.
+type Spool struct {
+	mem  *bytes.Reader
+	file *os.File
+	size int64
+}
+
+// NewSpool copies `r` into a Spool. Up to `memLimit` bytes are held in memory; larger
+// streams are written to a temporary file in `tempDir` (or the default temp directory
+// when empty). When `maxSize` is greater than zero, streams larger than `maxSize` fail
+// with ErrSpoolTooLarge.
+func NewSpool(r io.Reader, memLimit, maxSize int64, tempDir string) (*Spool, error) {
+	if maxSize > 0 && memLimit > maxSize {
+		memLimit = maxSize
+	}
+
+	// Read one byte past the memory limit to find out if the stream fits.
+	buf := bytes.NewBuffer([]byte{})
+	n, err := io.Copy(buf, io.LimitReader(r, memLimit+1))
+	if err != nil {
+		return nil, err
+	}
+	if n <= memLimit {
+		return &Spool{mem: bytes.NewReader(buf.Bytes()), size: n}, nil
+	}
+
+	f, err := os.CreateTemp(tempDir, "spool")
+	if err != nil {
+		return nil, fmt.Errorf("error creating spool file: %s", err)
+	}
+	s := &Spool{file: f}
+	remaining := io.Reader(r)
+	if maxSize > 0 {
+		remaining = io.LimitReader(r, maxSize-n+1)
+	}
+	size, err := io.Copy(f, io.MultiReader(buf, remaining))
+	if err == nil && maxSize > 0 && size > maxSize {
+		err = ErrSpoolTooLarge
+	}
+	if err != nil {
+		_ = s.Close()
+		return nil, err
+	}
+	s.size = size
+	return s, nil
+}
+
+// ReadAt implements io.ReaderAt.
+func (s *Spool) ReadAt(p []byte, off int64) (int, error) {
+	if s.file != nil {
+		return s.file.ReadAt(p, off)
+	}
+	return s.mem.ReadAt(p, off)
+}
+
+// Size returns the number of bytes in the spool.
+func (s *Spool) Size() int64 {
+	return s.size
+}
+
+// Close releases the spool and removes its temporary file, if any.
+func (s *Spool) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	name := s.file.Name()
+	_ = s.file.Close()
+	return os.Remove(name)
+}
@@ -0,0 +1,71 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package utils
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+func TestSpoolSuite(t *testing.T) {
+	suite.Run(t, &SpoolSuite{})
+}
+
+type SpoolSuite struct {
+	suite.Suite
+}
+
+func (s *SpoolSuite) readAll(spool *Spool) string {
+	b, err := io.ReadAll(io.NewSectionReader(spool, 0, spool.Size()))
+	s.Require().Nil(err)
+	return string(b)
+}
+
+func (s *SpoolSuite) TestMemory() {
+	dir := s.T().TempDir()
+	spool, err := NewSpool(strings.NewReader("whatever"), 8, 0, dir)
+	s.Require().Nil(err)
+	s.Require().Nil(spool.file)
+	s.Require().Equal(int64(8), spool.Size())
+	s.Require().Equal("whatever", s.readAll(spool))
+	s.Require().Nil(spool.Close())
+
+	files, _ := os.ReadDir(dir)
+	s.Require().Len(files, 0)
+}
+
+func (s *SpoolSuite) TestFile() {
+	dir := s.T().TempDir()
+	spool, err := NewSpool(strings.NewReader("whatever"), 4, 0, dir)
+	s.Require().Nil(err)
+	s.Require().NotNil(spool.file)
+	s.Require().Equal(int64(8), spool.Size())
+	s.Require().Equal("whatever", s.readAll(spool))
+
+	files, _ := os.ReadDir(dir)
+	s.Require().Len(files, 1)
+	s.Require().Nil(spool.Close())
+	files, _ = os.ReadDir(dir)
+	s.Require().Len(files, 0)
+}
+
+func (s *SpoolSuite) TestMaxSize() {
+	dir := s.T().TempDir()
+	spool, err := NewSpool(strings.NewReader("whatever"), 4, 8, dir)
+	s.Require().Nil(err)
+	s.Require().Equal("whatever", s.readAll(spool))
+	s.Require().Nil(spool.Close())
+
+	// Too large for memory or the file
+	_, err = NewSpool(strings.NewReader("whatever"), 4, 7, dir)
+	s.Require().ErrorIs(err, ErrSpoolTooLarge)
+	_, err = NewSpool(strings.NewReader("whatever"), 16, 7, dir)
+	s.Require().ErrorIs(err, ErrSpoolTooLarge)
+
+	// Temporary files are removed on failure
+	files, _ := os.ReadDir(dir)
+	s.Require().Len(files, 0)
+}
@@ -5,26 +5,19 @@ import (
 	"archive/tar"
 	"bufio"
 	"bytes"
-	"compress/gzip"
+	"context"
 	"crypto/md5"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"io"
-	"path/filepath"
-	"regexp"
-	"strings"
 	"time"
 
-	"golang.org/x/net/html/charset"
-
 	"github.com/rstudio/package-manager-rpackagerewriter/internal/utils"
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/metadata"
 )
 
 const (
-	DescriptionRepository = "Repository: RSPM"
-	DescriptionEncoding   = "Encoding: %s"
-
 	// Additional notes about CRAN DESCRIPTION file and encodings available here:
 	// https://cran.r-project.org/doc/manuals/r-release/R-exts.html#The-DESCRIPTION-file
 	// https://cran.r-project.org/doc/manuals/r-release/R-exts.html#Encoding
@@ -33,11 +26,12 @@ const (
 	encodingUTF8          = "UTF-8"
 )
 
-// RPackageArchive supports rewriting .tar.gz source packages and binaries in a single data stream while
+// RPackageArchive supports rewriting source packages and binaries in a single data stream while
 // (a) calculating the source and destination SHA256 checksums, (b) calculating the source and
 // destination file sizes, (c) rewriting the `DESCRIPTION` file to include the correct `Repository`
 // field, and (d) rewriting the `MD5` file with any corrections required for the updated
-// DESCRIPTION.
+// DESCRIPTION. Tarballs may be gzip, bzip2, xz or zstd compressed, or uncompressed; see
+// `RewriteOptions.Output` for the compression of the rewritten tarball.
 //
 // IMPORTANT: If you make improvements to `RPackageArchive`, please also update `RPackageZipArchive` in
 // `archive_zip.go`. We decided to maintain the code separately since there are some
@@ -45,21 +39,46 @@ const (
 type RPackageArchive struct {
 	bufferSize int
 	gzipLevel  int
+	opts       RewriteOptions
 }
 
 type Results struct {
+	// Format and RewrittenFormat are the formats of the original and rewritten packages.
+	Format            Format
+	RewrittenFormat   Format
 	OriginalSize      int64
 	RewrittenSize     int64
 	OriginalChecksum  string
 	RewrittenChecksum string
-	Description       string
-	ReadmeMarkdown    bool
+	// OriginalDigests and RewrittenDigests hold the checksums for `RewriteOptions.Digests`.
+	OriginalDigests  Digests
+	RewrittenDigests Digests
+	Description      string
+	// DescriptionFields holds the parsed fields of `Description`, in file order.
+	DescriptionFields metadata.Fields
+	// Dependencies holds the links declared by the dependency fields of `Description`.
+	Dependencies   []metadata.Link
+	ReadmeMarkdown bool
+	// Extracted maps the name of each Extractor that found a candidate to the path of the
+	// extracted entry. The paths of List extractors are empty.
+	Extracted map[string]string
+	// MD5 holds the verification of the MD5 file when `RewriteOptions.VerifyMD5` is set and
+	// the package has an MD5 file.
+	MD5 *MD5Verification
+	// Metrics records the time spent in each phase of the rewrite and the entries read.
+	Metrics Metrics
 }
 
 type RewriteResults struct {
 	Results
-	RewrittenPath       string
+	RewrittenPath string
+	// RewrittenKey is the store key of the rewritten package, when it was stored.
+	RewrittenKey        string `json:",omitempty"`
 	ExtractedReadmePath string
+	// InputChecksum and InputSize are the SHA256 checksum and size of the package as it was
+	// read. Unlike `OriginalChecksum` and `OriginalSize`, they are never overridden.
+	InputChecksum string `json:",omitempty"`
+	InputSize     int64  `json:",omitempty"`
 }
 
 type LenWriter struct {
@@ -72,49 +91,73 @@ func (w *LenWriter) Write(p []byte) (nn int, err error) {
 	return
 }
 
-// Support having a leading path segment (as some R packages have)
-var readmeRE = regexp.MustCompile(`^(?i)([^/]+/)?README(\.(txt|md))?$`)
-
 func (a *RPackageArchive) RewriteBinary(r io.Reader, w io.Writer) (results *Results, err error) {
-	return a.rewrite(r, w, nil)
+	return a.rewrite(context.Background(), r, w, nil)
+}
+
+// RewriteBinaryContext is like `RewriteBinary`, but stops with the context error when `ctx`
+// is done, even while a read from `r` is blocked.
+func (a *RPackageArchive) RewriteBinaryContext(ctx context.Context, r io.Reader, w io.Writer) (results *Results, err error) {
+	return a.rewrite(ctx, r, w, nil)
 }
 
 func (a *RPackageArchive) RewriteWithReadme(r io.Reader, w, wReadme io.Writer) (results *Results, err error) {
-	return a.rewrite(r, w, wReadme)
+	return a.rewrite(context.Background(), r, w, readmeExtractors(wReadme))
+}
+
+// RewriteWithReadmeContext is like `RewriteWithReadme`, but stops with the context error
+// when `ctx` is done.
+func (a *RPackageArchive) RewriteWithReadmeContext(ctx context.Context, r io.Reader, w, wReadme io.Writer) (results *Results, err error) {
+	return a.rewrite(ctx, r, w, readmeExtractors(wReadme))
 }
 
-func (a *RPackageArchive) rewrite(r io.Reader, w, wReadme io.Writer) (results *Results, err error) {
+// RewriteWithExtractors rewrites the package read from `r` like `RewriteWithReadme`, and
+// writes the files found by `extractors` to their writers.
+func (a *RPackageArchive) RewriteWithExtractors(r io.Reader, w io.Writer, extractors []*Extractor) (results *Results, err error) {
+	return a.rewrite(context.Background(), r, w, extractors)
+}
 
-	// Gzip and tar to the destination
+// RewriteWithExtractorsContext is like `RewriteWithExtractors`, but stops with the context
+// error when `ctx` is done.
+func (a *RPackageArchive) RewriteWithExtractorsContext(ctx context.Context, r io.Reader, w io.Writer, extractors []*Extractor) (results *Results, err error) {
+	return a.rewrite(ctx, r, w, extractors)
+}
+
+func (a *RPackageArchive) rewrite(ctx context.Context, r io.Reader, w io.Writer, extractors []*Extractor) (results *Results, err error) {
+	start := time.Now()
+	metrics := newMetrics()
+	defer func() {
+		// Report cancellation rather than the error it caused
+		if err != nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+	}()
+	w = utils.NewContextWriter(ctx, w)
+
+	// `originalDigests` and `rewrittenDigests` calculate the checksums for
+	// `RewriteOptions.Digests`
+	originalDigests, err := newDigester(a.opts.Digests)
+	if err != nil {
+		return
+	}
+	rewrittenDigests, err := newDigester(a.opts.Digests)
+	if err != nil {
+		return
+	}
+
+	// Compress and tar to the destination
 	//
 	// `hw` calculates the SHA256 checksum for the rewritten package
 	hw := sha256.New()
 	// `lw` calculates the output size
 	lw := &LenWriter{}
-	// `hwlw` writes to both the SHA hash and the LenWriter simultaneously
-	hwlw := io.MultiWriter(hw, lw)
+	// `hwlw` writes to the SHA hash, the other digests and the LenWriter simultaneously
+	hwlw := io.MultiWriter(hw, rewrittenDigests, lw)
 	// `mw` writes to both `hwlw` and `w` simultaneously.
 	mw := io.MultiWriter(hwlw, w)
 	// write buffer that respects `Server.PackageRewriteBufferSize`; the buffer
 	// writes to the `mw` multiwriter.
 	buffer := bufio.NewWriterSize(mw, a.bufferSize)
-	// `gzw` compresses data before sending it to the buffered writer. The compression
-	// level is set by `Server.PackageRewriteCompressionLevel`
-	gzw, err := gzip.NewWriterLevel(buffer, a.gzipLevel)
-	if err != nil {
-		return
-	}
-	tw := tar.NewWriter(gzw)
-	defer func() {
-		_ = tw.Close()
-		_ = gzw.Close()
-		_ = buffer.Flush()
-		// These must be set after the buffers are flushed
-		if results != nil {
-			results.RewrittenChecksum = fmt.Sprintf("%x", hw.Sum(nil))
-			results.RewrittenSize = lw.len
-		}
-	}()
 
 	// Iterate over the files and:
 	// - rewrite the Repository field in the DESCRIPTION file
@@ -137,46 +180,75 @@ func (a *RPackageArchive) rewrite(r io.Reader, w, wReadme io.Writer) (results *R
 	}
 	md5s := make([]md5Info, 0)
 
-	// For logging
-	writeTime := int64(0)
-
-	// Holds the contents of the best-matching README file
-	readmeBuffer := bytes.NewBuffer([]byte{})
-
-	// Tee the reads so we can calculate the original checksum while
-	// rewriting the archive.
-	rFileStream, wFileStream := io.Pipe()
-	defer func(rFileStream *io.PipeReader) {
-		_ = rFileStream.Close()
-	}(rFileStream)
-	defer func(wFileStream *io.PipeWriter) {
-		_ = wFileStream.Close()
-	}(wFileStream)
-	rHashStream := utils.NewEOFTeeReader(r, wFileStream)
-	type checkResult struct {
-		checksum string
-		err      error
-		size     int64
+	// Holds the contents of the preferred file of each extractor, such as the README
+	extractions, err := newExtractions(extractors)
+	if err != nil {
+		return
 	}
-	chanCheckResult := make(chan checkResult)
-	go func() {
-		// Calculate checksum
-		origSize, sum, errSha := utils.ComputeSha256Stream(rHashStream)
-		if errSha != nil {
-			chanCheckResult <- checkResult{"", errSha, 0}
-		}
-		chanCheckResult <- checkResult{hex.EncodeToString(sum), nil, origSize}
-	}()
 
-	// Create the gzip and tar readers
-	gr, err := gzip.NewReader(rFileStream)
+	// Computes the checksums of every file when the MD5 file is verified or regenerated
+	manifest := newMD5Manifest(a.opts.VerifyMD5 || a.opts.RegenerateMD5)
+
+	// When `ctx` can be canceled, reads from `r` fail as soon as it is done, even while a
+	// read is blocked. This is the only place that streams are wrapped.
+	r = utils.NewContextReader(ctx, r)
+
+	// `hr` calculates the original checksum and size while the archive is read.
+	hr := utils.NewHashingReader(io.TeeReader(&timedReader{r: r, d: &metrics.Read}, originalDigests))
+
+	// Create the decompressing and tar readers. The validator enforces
+	// `RewriteOptions.Validation` on the uncompressed stream and every header.
+	v := newValidator(a.opts.Validation)
+	compressed := &countingReader{r: hr}
+	dr, format, err := decompress(compressed)
 	if err != nil {
 		return
 	}
-	defer func(gr *gzip.Reader) {
-		_ = gr.Close()
-	}(gr)
-	tr := tar.NewReader(gr)
+	defer func(dr io.ReadCloser) {
+		_ = dr.Close()
+	}(dr)
+	tr := tar.NewReader(v.reader(&timedReader{r: dr, d: &metrics.Decompress}, compressed))
+
+	// `cw` compresses data before sending it to the buffered writer. The output format is
+	// set by `RewriteOptions.Output`, and the gzip compression level by
+	// `Server.PackageRewriteCompressionLevel`
+	outputFormat := a.opts.outputFormat(format)
+	cw, err := a.opts.compress(buffer, outputFormat, a.gzipLevel)
+	if err != nil {
+		return
+	}
+	// `tw` writes the tar stream, normalizing and sorting the entries when
+	// `RewriteOptions.Deterministic` and `SortEntries` are set.
+	tw, err := a.opts.newTarWriter(tar.NewWriter(&timedWriter{w: cw, d: &metrics.Compress}))
+	if err != nil {
+		_ = cw.Close()
+		return
+	}
+	defer func() {
+		// Sorted entries are only written when the tar writer is closed
+		if err != nil {
+			discardTarWriter(tw)
+		} else if errClose := tw.Close(); errClose != nil {
+			err = fmt.Errorf("error writing tar archive: %s", errClose)
+			results = nil
+		}
+		closeStart := time.Now()
+		_ = cw.Close()
+		_ = buffer.Flush()
+		metrics.Compress += time.Since(closeStart)
+		// These must be set after the buffers are flushed
+		if results != nil {
+			results.RewrittenChecksum = fmt.Sprintf("%x", hw.Sum(nil))
+			results.RewrittenSize = lw.len
+			results.RewrittenDigests = rewrittenDigests.sums()
+			metrics.Total = time.Since(start)
+			results.Metrics = metrics
+			a.opts.logger().Debug("rewrote package",
+				"format", results.Format,
+				"size", results.OriginalSize,
+				"metrics", metrics.logValue())
+		}
+	}()
 
 	// descPathLen is used to ensure that we are parsing the correct
 	// DESCRIPTION file in the tar archive. Since there could be multiple,
@@ -185,11 +257,6 @@ func (a *RPackageArchive) rewrite(r io.Reader, w, wReadme io.Writer) (results *R
 	// Both of which could be brittle.
 	descPathLen := 0
 	descPath := ""
-	// We do the same thing for README files, and we also record whether
-	// we found a text or markdown README file.
-	readmePathLen := 0
-	readmeName := ""
-	readmeMarkdown := false
 	// Finally, we record the shortest-path MD5 file.
 	md5PathLen := 0
 	md5Path := ""
@@ -206,6 +273,14 @@ func (a *RPackageArchive) rewrite(r io.Reader, w, wReadme io.Writer) (results *R
 			return
 		}
 
+		// Skip entries that are stripped by validation
+		var keep bool
+		if keep, err = v.checkHeader(header); err != nil {
+			return
+		} else if !keep {
+			continue
+		}
+
 		name := header.FileInfo().Name()
 
 		// Buffer all the DESCRIPTION files we find. They will all be written
@@ -220,9 +295,9 @@ func (a *RPackageArchive) rewrite(r io.Reader, w, wReadme io.Writer) (results *R
 				header: &(*header),
 			}
 
-			_, err = io.Copy(descInfo.buffer, tr)
+			_, err = io.Copy(manifest.tee(header.Name, descInfo.buffer), tr)
 			if err != nil {
-				err = fmt.Errorf("error copying description: %s", err)
+				err = fmt.Errorf("error copying description: %w", err)
 				return
 			}
 
@@ -233,39 +308,7 @@ func (a *RPackageArchive) rewrite(r io.Reader, w, wReadme io.Writer) (results *R
 
 			// Append to the list of buffered DESCRIPTION files
 			descriptions = append(descriptions, descInfo)
-
-		} else if wReadme != nil && readmeRE.MatchString(header.Name) {
-			// Only buffer the README file if
-			// (a) we have not found a file that matches the regex yet,
-			// (b) if we find one with a shorter path than one we found earlier, or
-			// (c) if the path length is the same but a PreferredReadme name is found.
-			// This way we do not care about tar file ordering.
-			_ = tw.WriteHeader(header)
-			newReadmePathLen := len(filepath.Dir(name))
-			if readmePathLen == 0 || (newReadmePathLen < readmePathLen) || (readmePathLen == newReadmePathLen && PreferredReadme(readmeName, name)) {
-				readmeName = name
-				readmeMarkdown = strings.ToLower(readmeName) == "readme.md"
-				readmePathLen = newReadmePathLen
-
-				// Reset the buffer in case we had a longer-path match first.
-				readmeBuffer.Reset()
-
-				// Write to both the readme buffer and the tar writer. This ensures that the
-				// readmeBuffer always contains the best-matching README that we've found so
-				// far.
-				readmeMultiWriter := io.MultiWriter(readmeBuffer, tw)
-				if _, err = io.Copy(readmeMultiWriter, tr); err != nil {
-					err = fmt.Errorf("error writing to readme multiwriter: %s", err)
-					return
-				}
-			} else {
-				// If this isn't a new best-matching README, simply write it out to
-				// the TAR writer.
-				if _, err = io.Copy(tw, tr); err != nil {
-					err = fmt.Errorf("error writing other readme: %s", err)
-					return
-				}
-			}
+			metrics.addEntry(EntryDescription, header.Size)
 
 		} else if name == "MD5" && (md5PathLen == 0 || len(header.Name) < md5PathLen) {
 			// Only buffer the MD5 file if we have not found a file with
@@ -279,28 +322,41 @@ func (a *RPackageArchive) rewrite(r io.Reader, w, wReadme io.Writer) (results *R
 				header: &(*header),
 			}
 
-			_, err = io.Copy(info.buffer, tr)
+			_, err = io.Copy(manifest.tee(header.Name, info.buffer), tr)
 			if err != nil {
 				return
 			}
 
 			// Append to the list of buffered MD5 files.
 			md5s = append(md5s, info)
+			metrics.addEntry(EntryMD5, header.Size)
 
 		} else {
 			// We'll hit this block writing any data to the tarball where
 			// we don't have a special handler above.
-			start := time.Now()
+			copyStart := time.Now()
+			class := entryClass(header.Typeflag)
 
 			// Here, write the header and content as is.
 			if err = tw.WriteHeader(header); err != nil {
 				return
 			}
-			if _, err = io.Copy(tw, tr); err != nil {
+			var entryW io.Writer = tw
+			if header.Typeflag == tar.TypeReg {
+				// Write to the buffers of the extractors that prefer this file so far, such
+				// as the README. This way we do not care about tar file ordering.
+				writers, readme := extractionWriters(extractions, header.Name)
+				if readme {
+					class = EntryReadme
+				}
+				entryW = manifest.tee(header.Name, io.MultiWriter(append(writers, tw)...))
+			}
+			metrics.addEntry(class, header.Size)
+			if _, err = io.Copy(entryW, tr); err != nil {
 				return
 			}
 
-			writeTime += time.Since(start).Milliseconds()
+			metrics.Copy += time.Since(copyStart)
 		}
 	}
 
@@ -308,7 +364,7 @@ func (a *RPackageArchive) rewrite(r io.Reader, w, wReadme io.Writer) (results *R
 	var (
 		descMd5         string
 		descriptionText string
-		toUTF           bool
+		descFields      metadata.Fields
 	)
 
 	for _, descInfo := range descriptions {
@@ -318,68 +374,16 @@ func (a *RPackageArchive) rewrite(r io.Reader, w, wReadme io.Writer) (results *R
 		// a string for easy access later, then write the new DESCRIPTION contents
 		// to the TAR writer.
 		if header.Name == descPath {
-			descReadBuffer := bytes.NewBuffer([]byte{})
-			useEncoding := defaultEncodingLatin1
-
 			// Rewrite the DESCRIPTION file.
-			scanner := bufio.NewScanner(descInfo.buffer)
-			repoFieldFound := false
-			encodingFieldFound := false
-
-			for scanner.Scan() {
-				line := scanner.Bytes()
-				if bytes.HasPrefix(line, []byte("Repository: ")) {
-					repoFieldFound = true
-					line = []byte(DescriptionRepository)
-				} else if bytes.HasPrefix(line, []byte("Encoding: ")) {
-					encodingFieldFound = true
-					lineLower := strings.ToLower(string(line))
-
-					// Set the `useEncoding` and DESCRIPTION encoding line correctly
-					switch {
-					case strings.Contains(lineLower, defaultEncodingLatin1):
-						useEncoding = defaultEncodingLatin1
-					case strings.Contains(lineLower, encodingLatin2):
-						useEncoding = encodingLatin2
-					default:
-						toUTF = true
-						useEncoding = encodingUTF8
-					}
-
-					line = []byte(fmt.Sprintf(DescriptionEncoding, useEncoding))
-				}
-
-				descReadBuffer.Write(line)
-				descReadBuffer.Write([]byte("\n"))
-			}
-
-			// In rare cases the Repository field is not set.
-			if !repoFieldFound {
-				descReadBuffer.Write([]byte(DescriptionRepository + "\n"))
-			}
-			// Add an Encoding field if none was found
-			if !encodingFieldFound {
-				toUTF = true
-				descReadBuffer.Write([]byte(fmt.Sprintf(DescriptionEncoding, encodingUTF8) + "\n"))
-			}
-
-			// Get a reader that understand the DESCRIPTION encoding
-			var reader io.Reader
-			reader = descReadBuffer
-
-			if toUTF {
-				reader, err = charset.NewReaderLabel(useEncoding, descReadBuffer)
-				if err != nil {
-					return
-				}
-			}
-
-			// Copy data using UTF-8.
-			descInfo.buffer.Reset()
-			_, err = io.Copy(descInfo.buffer, reader)
+			var rewritten []byte
+			rewriteStart := time.Now()
+			rewritten, descFields, err = a.opts.rewriteDescription(descInfo.buffer.Bytes())
+			metrics.DescriptionRewrite += time.Since(rewriteStart)
 			if err != nil {
 				return
 			}
+			descInfo.buffer.Reset()
+			descInfo.buffer.Write(rewritten)
 
 			// Update the header's size value
 			header.Size = int64(descInfo.buffer.Len())
@@ -403,40 +407,25 @@ func (a *RPackageArchive) rewrite(r io.Reader, w, wReadme io.Writer) (results *R
 		}
 	}
 
-	// Write the readme file out to the writer. This extracts the README for
+	// Write the extracted files out to their writers. This extracts the README for
 	// faster access later.
-	if wReadme != nil && readmeBuffer.Len() > 0 {
-		if _, err = io.Copy(wReadme, readmeBuffer); err != nil {
-			return
-		}
+	extracted, markdown, err := writeExtractions(extractions)
+	if err != nil {
+		return
 	}
 
 	// MD5 handling
 	// Rewrite the MD5 file.
+	var verification *MD5Verification
 	for _, info := range md5s {
 		header := info.header
 
 		// If this is the authoritative MD5 file, we must rewrite it.
 		if header.Name == md5Path {
-			md5Buffer := bytes.NewBuffer([]byte{})
-			scanner := bufio.NewScanner(info.buffer)
-			for scanner.Scan() {
-				line := scanner.Bytes()
-				if bytes.HasSuffix(line, []byte(" *DESCRIPTION")) {
-					if descMd5 == "" {
-						fmt.Printf("Error: No DESCRIPTION checksum was generated.")
-					} else {
-						line = []byte(descMd5 + " *DESCRIPTION")
-					}
-				}
-				md5Buffer.Write(line)
-				md5Buffer.Write([]byte("\n"))
-			}
+			var rewritten []byte
+			rewritten, verification = a.opts.rewriteMD5(manifest, md5Path, descPath, descMd5, info.buffer.Bytes())
 			info.buffer.Reset()
-			_, err = io.Copy(info.buffer, md5Buffer)
-			if err != nil {
-				return
-			}
+			info.buffer.Write(rewritten)
 			header.Size = int64(info.buffer.Len())
 		}
 		if err = tw.WriteHeader(header); err != nil {
@@ -450,14 +439,10 @@ func (a *RPackageArchive) rewrite(r io.Reader, w, wReadme io.Writer) (results *R
 		}
 	}
 
-	// At this point we're done with `rFileStream`, since `rHashStream` waits to read the same buffer at the same time,
-	// we need to copy the remaining bytes to /dev/null to ensure `rHashStream` reaches the end of the stream.
-	_, _ = io.Copy(io.Discard, rFileStream)
-
-	// Wait for the original checksum calculation to complete
-	originalChecksum := <-chanCheckResult
-	if originalChecksum.err != nil {
-		err = originalChecksum.err
+	// The tar reader stops at the end-of-archive marker, so read any remaining bytes,
+	// such as padding, to include them in the original checksum and size.
+	if _, err = io.Copy(io.Discard, hr); err != nil {
+		err = fmt.Errorf("error reading original archive: %w", err)
 		return
 	}
 
@@ -465,29 +450,66 @@ func (a *RPackageArchive) rewrite(r io.Reader, w, wReadme io.Writer) (results *R
 	// top of this function that mutates the returned results further by
 	// setting the RewrittenChecksum and RewrittenSize properties.
 	results = &Results{
-		OriginalSize:     originalChecksum.size,
-		OriginalChecksum: originalChecksum.checksum,
-		Description:      descriptionText,
-		ReadmeMarkdown:   readmeMarkdown,
+		Format:            format,
+		RewrittenFormat:   outputFormat,
+		OriginalSize:      hr.Size(),
+		OriginalChecksum:  hex.EncodeToString(hr.Sum()),
+		OriginalDigests:   originalDigests.sums(),
+		Description:       descriptionText,
+		DescriptionFields: descFields,
+		Dependencies:      metadata.ParseDependencies(descFields),
+		ReadmeMarkdown:    markdown,
+		Extracted:         extracted,
+		MD5:               verification,
 	}
 
 	return
 }
 
 func (a *RPackageArchive) GetReadme(stream io.Reader, wReadme io.Writer) (bool, error) {
+	return a.GetReadmeContext(context.Background(), stream, wReadme)
+}
 
-	readmeBuffer := bytes.NewBuffer([]byte{})
-
-	// Create the gzip and tar readers
-	gr, err := gzip.NewReader(stream)
+// GetReadmeContext is like `GetReadme`, but stops with the context error when `ctx` is done,
+// even while a read from `stream` is blocked.
+func (a *RPackageArchive) GetReadmeContext(ctx context.Context, stream io.Reader, wReadme io.Writer) (markdown bool, err error) {
+	extracted, err := a.ExtractContext(ctx, stream, []*Extractor{ReadmeExtractor(wReadme)})
 	if err != nil {
 		return false, err
 	}
-	tr := tar.NewReader(gr)
+	return readmeMarkdown(extracted[ExtractReadme]), nil
+}
 
-	readmePathLen := 0
-	readmeName := ""
-	var readmeMarkdown bool
+// Extract writes the files found by `extractors` in the package read from `stream` to their
+// writers, without rewriting it. It returns the paths of the extracted entries like
+// `Results.Extracted`.
+func (a *RPackageArchive) Extract(stream io.Reader, extractors []*Extractor) (map[string]string, error) {
+	return a.ExtractContext(context.Background(), stream, extractors)
+}
+
+// ExtractContext is like `Extract`, but stops with the context error when `ctx` is done,
+// even while a read from `stream` is blocked.
+func (a *RPackageArchive) ExtractContext(ctx context.Context, stream io.Reader, extractors []*Extractor) (extracted map[string]string, err error) {
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+	}()
+	extractions, err := newExtractions(extractors)
+	if err != nil {
+		return nil, err
+	}
+	stream = utils.NewContextReader(ctx, stream)
+
+	// Create the decompressing and tar readers
+	dr, _, err := decompress(stream)
+	if err != nil {
+		return nil, err
+	}
+	defer func(dr io.ReadCloser) {
+		_ = dr.Close()
+	}(dr)
+	tr := tar.NewReader(dr)
 
 	for {
 		var header *tar.Header
@@ -496,65 +518,30 @@ func (a *RPackageArchive) GetReadme(stream io.Reader, wReadme io.Writer) (bool,
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			return false, err
+			return nil, err
+		}
+		if name := header.FileInfo().Name(); header.Typeflag != tar.TypeReg || name == "DESCRIPTION" || name == "MD5" {
+			continue
 		}
 
-		name := header.FileInfo().Name()
-
-		if readmeRE.MatchString(header.Name) {
-
-			// Only read the README file if
-			// (a) we have not found a file that matches the regex yet,
-			// (b) if we find one with a shorter path than one we found earlier, or
-			// (c) if the path length is the same but a PreferredReadme name is found.
-			// This way we do not care about tar file ordering.
-			newReadmePathLen := len(filepath.Dir(name))
-			if readmePathLen == 0 || (newReadmePathLen < readmePathLen) || (readmePathLen == newReadmePathLen && PreferredReadme(readmeName, name)) {
-				readmeName = name
-				readmeMarkdown = strings.ToLower(readmeName) == "readme.md"
-				readmePathLen = newReadmePathLen
-
-				// Reset the buffer in case we had a longer-path match first.
-				readmeBuffer.Reset()
-
-				if _, err = io.Copy(readmeBuffer, tr); err != nil {
-					return false, err
-				}
+		// Only read the files that are the best match so far. This way we do not care
+		// about tar file ordering.
+		if writers, _ := extractionWriters(extractions, header.Name); len(writers) > 0 {
+			if _, err = io.Copy(io.MultiWriter(writers...), tr); err != nil {
+				return nil, err
 			}
 		}
 	}
 
-	// Write the readme, if any, to the writer
-	if _, err = io.Copy(wReadme, readmeBuffer); err != nil {
-		return false, err
-	}
-
-	return readmeMarkdown, nil
-}
-
-// A map that enumerates the preference of README names, with
-// a lower int value representing a "more preferred" file name
-var readmeMap = map[string]int{
-	"readme.md":  0,
-	"readme.txt": 1,
-	"readme":     2,
-}
-
-func PreferredReadme(oldName, newName string) bool {
-	a, ok := readmeMap[strings.ToLower(oldName)]
-	if !ok {
-		return false
-	}
-	b, ok := readmeMap[strings.ToLower(newName)]
-	if !ok {
-		return false
-	}
-	return b < a
+	// Write the extracted files, if any, to their writers
+	extracted, _, err = writeExtractions(extractions)
+	return extracted, err
 }
 
-func NewRPackageArchive(bufferSize, gzipLevel int) *RPackageArchive {
+func NewRPackageArchive(bufferSize, gzipLevel int, opts RewriteOptions) *RPackageArchive {
 	return &RPackageArchive{
 		bufferSize: bufferSize,
 		gzipLevel:  gzipLevel,
+		opts:       opts,
 	}
 }
@@ -5,18 +5,25 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/stretchr/testify/suite"
 
 	"github.com/rstudio/package-manager-rpackagerewriter/internal/test"
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/metadata"
 )
 
 func TestArchiveSuite(t *testing.T) {
@@ -28,15 +35,20 @@ type ArchiveSuite struct {
 }
 
 func (s *ArchiveSuite) TestNewArchive() {
-	a := NewRPackageArchive(256, 6)
+	a := NewRPackageArchive(256, 6, RewriteOptions{})
 	s.Require().Equal(&RPackageArchive{
 		bufferSize: 256,
 		gzipLevel:  6,
 	}, a)
+
+	a = NewRPackageArchive(256, 6, RewriteOptions{Repository: "CRAN"})
+	s.Require().Equal("CRAN", a.opts.repository())
+	a = NewRPackageArchive(256, 6, RewriteOptions{})
+	s.Require().Equal(DefaultRepository, a.opts.repository())
 }
 
 func (s *ArchiveSuite) TestDescriptionRewrite() {
-	a := NewRPackageArchive(256, 6)
+	a := NewRPackageArchive(256, 6, RewriteOptions{})
 	f, err := os.Open("../testdata/DT_0.4.tar.gz")
 	s.Require().Nil(err)
 
@@ -77,8 +89,30 @@ func (s *ArchiveSuite) TestDescriptionRewrite() {
 	s.Require().Equal(results2.OriginalChecksum, results2.RewrittenChecksum)
 }
 
+func (s *ArchiveSuite) TestDescriptionRewriteRepository() {
+	a := NewRPackageArchive(256, 6, RewriteOptions{Repository: "Internal"})
+	f, err := os.Open("../testdata/adhoc_1.1.tar.gz")
+	s.Require().Nil(err)
+
+	var b bytes.Buffer
+	var bReadme bytes.Buffer
+	results, err := a.RewriteWithReadme(f, &b, &bReadme)
+	s.Require().Nil(err)
+
+	// The existing Repository field is replaced in place
+	s.Require().Contains(results.Description, "\nRepository: Internal\n")
+	s.Require().NotContains(results.Description, "RSPM")
+
+	// The rewritten archive contains the same DESCRIPTION
+	descFile, err := StreamFileFromTarGz(&b, "DESCRIPTION")
+	s.Require().Nil(err)
+	var d bytes.Buffer
+	_, _ = d.ReadFrom(descFile)
+	s.Require().Equal(results.Description, d.String())
+}
+
 func (s *ArchiveSuite) TestDescriptionRewriteBinaryInvalid() {
-	a := NewRPackageArchive(256, 6)
+	a := NewRPackageArchive(256, 6, RewriteOptions{})
 
 	tmp, err := os.CreateTemp("", "")
 	s.Require().Nil(err)
@@ -93,11 +127,56 @@ func (s *ArchiveSuite) TestDescriptionRewriteBinaryInvalid() {
 
 	var b bytes.Buffer
 	_, err = a.RewriteBinary(tmp, &b)
-	s.Require().ErrorContains(err, "gzip: invalid header")
+	var formatErr *UnrecognizedFormatError
+	s.Require().True(errors.As(err, &formatErr))
+}
+
+func (s *ArchiveSuite) TestDescriptionRewriteBinaryUnsupported() {
+	a := NewRPackageArchive(256, 6, RewriteOptions{})
+
+	f, err := os.Open("../testdata/binaries/bindrcpp_0.2.2.zip")
+	s.Require().Nil(err)
+
+	// ZIP binaries must be rewritten by RPackageZipArchive
+	var b bytes.Buffer
+	_, err = a.RewriteBinary(f, &b)
+	s.Require().ErrorContains(err, "unsupported archive format zip")
+	var formatErr *UnsupportedFormatError
+	s.Require().True(errors.As(err, &formatErr))
+	s.Require().Equal(FormatZip, formatErr.Format)
+}
+
+func (s *ArchiveSuite) TestDescriptionRewritePlainTar() {
+	data, err := plainTar("../testdata/readmetest_0.2.0.tar.gz")
+	s.Require().Nil(err)
+
+	a := NewRPackageArchive(256, 6, RewriteOptions{})
+	var b bytes.Buffer
+	var bReadme bytes.Buffer
+	results, err := a.RewriteWithReadme(bytes.NewReader(data), &b, &bReadme)
+	s.Require().Nil(err)
+	s.Require().Equal(int64(len(data)), results.OriginalSize)
+	s.Require().Equal(fmt.Sprintf("%x", sha256.Sum256(data)), results.OriginalChecksum)
+	s.Require().Contains(results.Description, "\nRepository: RSPM\n")
+	s.Require().Equal("Hi, I'm the correct readme!", bReadme.String())
+
+	// The rewritten archive is always gzipped
+	descFile, err := StreamFileFromTarGz(&b, "DESCRIPTION")
+	s.Require().Nil(err)
+	var d bytes.Buffer
+	_, _ = d.ReadFrom(descFile)
+	s.Require().Equal(results.Description, d.String())
+
+	// Only the README is read from a plain tarball
+	bReadme.Reset()
+	markdown, err := (&RPackageArchive{}).GetReadme(bytes.NewReader(data), &bReadme)
+	s.Require().Nil(err)
+	s.Require().True(markdown)
+	s.Require().Equal("Hi, I'm the correct readme!", bReadme.String())
 }
 
 func (s *ArchiveSuite) TestDescriptionRewriteBinary() {
-	a := NewRPackageArchive(256, 6)
+	a := NewRPackageArchive(256, 6, RewriteOptions{})
 	f, err := os.Open("../testdata/binaries/bindrcpp_0.2.2.tar.gz")
 	s.Require().Nil(err)
 
@@ -132,7 +211,7 @@ func (s *ArchiveSuite) TestDescriptionRewriteBinary() {
 }
 
 func (s *ArchiveSuite) TestDescriptionRewriteBinary2() {
-	a := NewRPackageArchive(256, 6)
+	a := NewRPackageArchive(256, 6, RewriteOptions{})
 	f, err := os.Open("../testdata/binaries/DT_0.23.tar.gz")
 	s.Require().Nil(err)
 
@@ -171,7 +250,7 @@ func (s *ArchiveSuite) TestDescriptionRewriteBinary2() {
 // * The DESCRIPTION is needs to retain the `Encoding: latin1`
 // * The DESCRIPTION is written using the `latin1` encoding instead of the default `UTF-8`
 func (s *ArchiveSuite) TestDescriptionRewriteLatin1() {
-	a := NewRPackageArchive(256, 6)
+	a := NewRPackageArchive(256, 6, RewriteOptions{})
 	f, err := os.Open("../testdata/special/Latin1SpecialChars_1.1.1.tar.gz")
 	s.Require().Nil(err)
 
@@ -222,7 +301,7 @@ func (s *ArchiveSuite) TestDescriptionRewriteSecondMD5() {
 	// encounter the file `tests/testthat/fixtures/MD5` first; we then
 	// test to ensure that only the second MD5 file (at the package root)
 	// is rewritten even though the other one was encountered first.
-	a := NewRPackageArchive(256, 6)
+	a := NewRPackageArchive(256, 6, RewriteOptions{})
 	f, err := os.Open("../testdata/special/SecondMD5_2.2.2.tar.gz")
 	s.Require().Nil(err)
 
@@ -274,7 +353,7 @@ func (s *ArchiveSuite) TestDescriptionRewriteSecondMD5() {
 }
 
 func (s *ArchiveSuite) TestReadmeResolution1() {
-	a := NewRPackageArchive(256, 6)
+	a := NewRPackageArchive(256, 6, RewriteOptions{})
 	f, err := os.Open("../testdata/readmetest_0.2.0.tar.gz")
 	s.Require().Nil(err)
 
@@ -289,7 +368,7 @@ func (s *ArchiveSuite) TestReadmeResolution1() {
 }
 
 func (s *ArchiveSuite) TestReadmeResolutionNone() {
-	a := NewRPackageArchive(256, 6)
+	a := NewRPackageArchive(256, 6, RewriteOptions{})
 	f, err := os.Open("../testdata/hasdependencies_0.2.0.tar.gz")
 	s.Require().Nil(err)
 
@@ -304,6 +383,22 @@ func (s *ArchiveSuite) TestReadmeResolutionNone() {
 	s.Require().Equal(0, bReadme.Len())
 }
 
+func (s *ArchiveSuite) TestDependencies() {
+	a := NewRPackageArchive(256, 6, RewriteOptions{})
+	f, err := os.Open("../testdata/hasdependencies_0.2.0.tar.gz")
+	s.Require().Nil(err)
+
+	var b bytes.Buffer
+	results, err := a.RewriteBinary(f, &b)
+	s.Require().Nil(err)
+	s.Require().Equal([]metadata.Link{
+		{Name: "R", Raw: "R (>= 2.15.0)", Operator: metadata.VersionGTE, Version: "2.15.0", Type: metadata.LinkDepends},
+		{Name: "donttouchme", Raw: "donttouchme (<= 0.2.0)", Operator: metadata.VersionLTE, Version: "0.2.0", Type: metadata.LinkDepends},
+		{Name: "updateme", Raw: "updateme", Type: metadata.LinkImports},
+		{Name: "archiveme", Raw: "archiveme (== 0.0.2)", Operator: metadata.VersionEquals, Version: "0.0.2", Type: metadata.LinkSuggests},
+	}, results.Dependencies)
+}
+
 func (s *ArchiveSuite) TestReadmeOnlyResolution() {
 	f, err := os.Open("../testdata/readmetest_0.2.0.tar.gz")
 	a := &RPackageArchive{}
@@ -334,7 +429,7 @@ func (s *ArchiveSuite) TestReadmeOnlyResolutionNone() {
 }
 
 func (s *ArchiveSuite) TestDescriptionFFEncoding() {
-	a := NewRPackageArchive(256, 6)
+	a := NewRPackageArchive(256, 6, RewriteOptions{})
 	f, err := os.Open("../testdata/ff_2.2-14.tar.gz")
 	s.Require().Nil(err)
 
@@ -368,7 +463,7 @@ func (s *ArchiveSuite) TestDescriptionChecksums() {
 
 	var b bytes.Buffer
 	var bReadme bytes.Buffer
-	a := NewRPackageArchive(256, 6)
+	a := NewRPackageArchive(256, 6, RewriteOptions{})
 	f, err := os.Open("../testdata/DT_0.4.tar.gz")
 	s.Require().Nil(err)
 	results, err := a.RewriteWithReadme(f, &b, &bReadme)
@@ -418,7 +513,7 @@ func (s *ArchiveSuite) TestReadmePref() {
 }
 
 func (s *ArchiveSuite) TestBadChecksum() {
-	a := NewRPackageArchive(256, 6)
+	a := NewRPackageArchive(256, 6, RewriteOptions{})
 	f, err := os.Open("../testdata/MortCast_2.6-1.tar.gz")
 	s.Require().Nil(err)
 
@@ -443,6 +538,135 @@ func (s *ArchiveSuite) TestBadChecksum() {
 
 }
 
+func (s *ArchiveSuite) TestRewriteContext() {
+	data, err := os.ReadFile("../testdata/DT_0.4.tar.gz")
+	s.Require().Nil(err)
+
+	// The upstream reader stops sending after the first bytes of the package
+	release := make(chan struct{})
+	stalled := io.MultiReader(bytes.NewReader(data[:4096]), readerFunc(func(p []byte) (int, error) {
+		<-release
+		return 0, io.ErrUnexpectedEOF
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	var b bytes.Buffer
+	a := NewRPackageArchive(256, 6, RewriteOptions{})
+	start := time.Now()
+	results, err := a.RewriteBinaryContext(ctx, stalled, &b)
+	s.Require().ErrorIs(err, context.DeadlineExceeded)
+	s.Require().Nil(results)
+	s.Require().Less(time.Since(start), 5*time.Second)
+
+	// The abandoned read exits once the upstream returns
+	close(release)
+	s.requireNoGoroutines()
+
+	// Rewrites that are not canceled succeed
+	b.Reset()
+	_, err = a.RewriteBinaryContext(context.Background(), bytes.NewReader(data), &b)
+	s.Require().Nil(err)
+}
+
+// requireNoGoroutines fails unless every goroutine started by the module has exited.
+func (s *ArchiveSuite) requireNoGoroutines(msgAndArgs ...interface{}) {
+	s.Require().Eventually(func() bool {
+		buf := make([]byte, 1024*1024)
+		return !strings.Contains(string(buf[:runtime.Stack(buf, true)]), "created by github.com/rstudio/package-manager-rpackagerewriter/")
+	}, 5*time.Second, 10*time.Millisecond, msgAndArgs...)
+}
+
+func (s *ArchiveSuite) TestRewriteErrorsLeaveNoGoroutines() {
+	failure := errors.New("failure")
+	// plain returns an uncompressed tarball, so that it can be cut at known offsets.
+	plain := func(entries ...tarEntry) []byte {
+		var b bytes.Buffer
+		tw := tar.NewWriter(&b)
+		for _, entry := range entries {
+			s.Require().Nil(tw.WriteHeader(entry.header))
+			_, err := tw.Write(entry.data)
+			s.Require().Nil(err)
+		}
+		s.Require().Nil(tw.Close())
+		return b.Bytes()
+	}
+	file := func(name string, size int) tarEntry {
+		return tarEntry{
+			header: &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(size)},
+			data:   bytes.Repeat([]byte("x"), size),
+		}
+	}
+	// failAfter fails reading `data` after `n` bytes.
+	failAfter := func(data []byte, n int) io.Reader {
+		return io.MultiReader(bytes.NewReader(data[:n]), iotest.ErrReader(failure))
+	}
+	random := make([]byte, 1024*1024)
+	_, _ = rand.Read(random)
+	valid := plain(
+		tarEntry{header: &tar.Header{Name: "test/DESCRIPTION", Typeflag: tar.TypeReg, Mode: 0644, Size: 27}, data: []byte("Package: test\nVersion: 1.0\n")},
+		tarEntry{header: &tar.Header{Name: "test/R/random", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(random))}, data: random},
+	)
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, tc := range []struct {
+		name string
+		r    io.Reader
+		w    io.Writer
+		opts RewriteOptions
+		ctx  context.Context
+	}{
+		{name: "unrecognized format", r: strings.NewReader("not an archive")},
+		{name: "compressor", r: bytes.NewReader(valid), opts: RewriteOptions{CompressionLevels: CompressionLevels{FormatGzip: 42}}},
+		{name: "tar writer", r: bytes.NewReader(valid), opts: RewriteOptions{SortEntries: true, TempDir: "/nonexistent"}},
+		{name: "tar header", r: failAfter(plain(file("test/a", 10), file("test/b", 10)), 1024+100)},
+		{name: "validation", r: bytes.NewReader(plain(file("../evil", 10))), opts: RewriteOptions{Validation: &ValidationOptions{}}},
+		{name: "DESCRIPTION", r: failAfter(plain(file("test/DESCRIPTION", 2000)), 1000)},
+		{name: "README", r: failAfter(plain(file("test/README.md", 2000)), 1000)},
+		{name: "MD5", r: failAfter(plain(file("test/MD5", 2000)), 1000)},
+		{name: "entry", r: failAfter(plain(file("test/R/file.R", 2000)), 1000)},
+		{name: "DESCRIPTION rewrite", r: bytes.NewReader(valid), opts: RewriteOptions{Transformers: []DescriptionTransformer{
+			DescriptionTransformerFunc(func(fields []DescriptionField) ([]DescriptionField, error) {
+				return nil, failure
+			}),
+		}}},
+		{name: "output", r: bytes.NewReader(valid), w: writerFunc(func(p []byte) (int, error) { return 0, failure })},
+		{name: "sorted output", r: bytes.NewReader(valid), w: writerFunc(func(p []byte) (int, error) { return 0, failure }), opts: RewriteOptions{SortEntries: true, TempDir: s.T().TempDir()}},
+		{name: "trailing data", r: io.MultiReader(bytes.NewReader(valid), iotest.ErrReader(failure))},
+		{name: "canceled", r: bytes.NewReader(valid), ctx: canceled},
+	} {
+		w, ctx := tc.w, tc.ctx
+		if w == nil {
+			w = io.Discard
+		}
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		a := NewRPackageArchive(256, 6, tc.opts)
+		results, err := a.RewriteWithReadmeContext(ctx, tc.r, w, io.Discard)
+		s.Require().Error(err, tc.name)
+		s.Require().Nil(results, tc.name)
+		s.requireNoGoroutines(tc.name)
+	}
+
+	// The valid package rewrites
+	_, err := NewRPackageArchive(256, 6, RewriteOptions{}).RewriteBinary(bytes.NewReader(valid), io.Discard)
+	s.Require().Nil(err)
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
+
 var EntryNotFoundInTarBall = errors.New("requested entry was not found in the tarball")
 
 // Exposes a reader for a particular file within a gzipped tar ball. The function will
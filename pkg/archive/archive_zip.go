@@ -5,58 +5,160 @@ import (
 	"archive/zip"
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/md5"
 	"crypto/sha256"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
-	"strings"
 	"time"
 
-	"golang.org/x/net/html/charset"
+	"github.com/rstudio/package-manager-rpackagerewriter/internal/utils"
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/metadata"
 )
 
 // RPackageZipArchive is very similar to RPackageArchive (see `archive.go`). However, ZIP reading requires random
-// access (io.ReaderAt), so we had to create a separate util. Instead of passing a stream as `r`,
-// instead save the ZIP archive to a temporary file and then pass an `*os.File` as `r`. The file
-// will be scanned twice: once to calculate the original checksum and size, and once to rewrite
-// to the destination.
+// access (io.ReaderAt), so we had to create a separate util. Pass the archive to `RewriteBinaryAt` as an
+// `io.ReaderAt` along with its size; it will be scanned twice: once to calculate the original checksum
+// and size, and once to rewrite to the destination. `RewriteBinary` accepts any `io.Reader` and spools
+// streams that do not support random access to memory or a temporary file first.
 //
 // IMPORTANT: If you make improvements to `RPackageZipArchive`, please also update `RPackageArchive` in
 // `archive.go`.
 type RPackageZipArchive struct {
 	bufferSize int
+	opts       RewriteOptions
 }
 
-func (a *RPackageZipArchive) RewriteBinary(r *os.File, w io.Writer) (results *Results, err error) {
+// RewriteBinary rewrites a ZIP binary read from `r`. Readers that support random access,
+// such as `*os.File` or `*bytes.Reader`, are read in place. Any other stream is first
+// spooled as configured by `RewriteOptions.SpoolMemoryLimit`, `SpoolMaxSize` and `TempDir`.
+func (a *RPackageZipArchive) RewriteBinary(r io.Reader, w io.Writer) (results *Results, err error) {
+	return a.RewriteBinaryContext(context.Background(), r, w)
+}
+
+// RewriteBinaryContext is like `RewriteBinary`, but stops with the context error when `ctx`
+// is done, including while a stream is spooled.
+func (a *RPackageZipArchive) RewriteBinaryContext(ctx context.Context, r io.Reader, w io.Writer) (results *Results, err error) {
+	err = a.withReaderAt(ctx, r, func(ra io.ReaderAt, size int64) error {
+		results, err = a.rewrite(ctx, ra, size, w, nil)
+		return err
+	})
+	return
+}
+
+// RewriteBinaryAt rewrites a ZIP binary of `size` bytes that is read from `r`.
+func (a *RPackageZipArchive) RewriteBinaryAt(r io.ReaderAt, size int64, w io.Writer) (results *Results, err error) {
+	return a.rewrite(context.Background(), r, size, w, nil)
+}
+
+// RewriteWithReadme rewrites a ZIP binary read from `r` like `RewriteBinary`, and also
+// writes the best-matching README file to `wReadme`.
+func (a *RPackageZipArchive) RewriteWithReadme(r io.Reader, w, wReadme io.Writer) (results *Results, err error) {
+	return a.RewriteWithReadmeContext(context.Background(), r, w, wReadme)
+}
+
+// RewriteWithReadmeContext is like `RewriteWithReadme`, but stops with the context error
+// when `ctx` is done.
+func (a *RPackageZipArchive) RewriteWithReadmeContext(ctx context.Context, r io.Reader, w, wReadme io.Writer) (results *Results, err error) {
+	err = a.withReaderAt(ctx, r, func(ra io.ReaderAt, size int64) error {
+		results, err = a.rewrite(ctx, ra, size, w, readmeExtractors(wReadme))
+		return err
+	})
+	return
+}
+
+// RewriteWithReadmeAt rewrites a ZIP binary of `size` bytes that is read from `r`, and also
+// writes the best-matching README file to `wReadme`.
+func (a *RPackageZipArchive) RewriteWithReadmeAt(r io.ReaderAt, size int64, w, wReadme io.Writer) (results *Results, err error) {
+	return a.rewrite(context.Background(), r, size, w, readmeExtractors(wReadme))
+}
+
+// RewriteWithExtractors rewrites a ZIP binary read from `r` like `RewriteBinary`, and also
+// writes the files found by `extractors` to their writers.
+func (a *RPackageZipArchive) RewriteWithExtractors(r io.Reader, w io.Writer, extractors []*Extractor) (results *Results, err error) {
+	return a.RewriteWithExtractorsContext(context.Background(), r, w, extractors)
+}
+
+// RewriteWithExtractorsContext is like `RewriteWithExtractors`, but stops with the context
+// error when `ctx` is done.
+func (a *RPackageZipArchive) RewriteWithExtractorsContext(ctx context.Context, r io.Reader, w io.Writer, extractors []*Extractor) (results *Results, err error) {
+	err = a.withReaderAt(ctx, r, func(ra io.ReaderAt, size int64) error {
+		results, err = a.rewrite(ctx, ra, size, w, extractors)
+		return err
+	})
+	return
+}
+
+// RewriteWithExtractorsAt rewrites a ZIP binary of `size` bytes that is read from `r`, and
+// also writes the files found by `extractors` to their writers.
+func (a *RPackageZipArchive) RewriteWithExtractorsAt(r io.ReaderAt, size int64, w io.Writer, extractors []*Extractor) (results *Results, err error) {
+	return a.rewrite(context.Background(), r, size, w, extractors)
+}
+
+// withReaderAt calls `fn` with random access to `r`, spooling `r` first when required. The
+// spooling stops when `ctx` is done.
+func (a *RPackageZipArchive) withReaderAt(ctx context.Context, r io.Reader, fn func(ra io.ReaderAt, size int64) error) error {
+	ra, size, ok, err := readerAtSize(r)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return fn(ra, size)
+	}
+
+	spool, err := utils.NewSpool(utils.NewContextReader(ctx, r), a.opts.spoolMemoryLimit(), a.opts.SpoolMaxSize, a.opts.TempDir)
+	if err != nil {
+		return fmt.Errorf("error spooling stream in RPackageZipArchive: %w", err)
+	}
+	defer func(spool *utils.Spool) {
+		_ = spool.Close()
+	}(spool)
+	return fn(spool, spool.Size())
+}
+
+func (a *RPackageZipArchive) rewrite(ctx context.Context, r io.ReaderAt, size int64, w io.Writer, extractors []*Extractor) (results *Results, err error) {
+	start := time.Now()
+	metrics := newMetrics()
+	defer func() {
+		// Report cancellation rather than the error it caused
+		if err != nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+	}()
+	w = utils.NewContextWriter(ctx, w)
+
+	// `originalDigests` and `rewrittenDigests` calculate the checksums for
+	// `RewriteOptions.Digests`
+	originalDigests, err := newDigester(a.opts.Digests)
+	if err != nil {
+		return
+	}
+	rewrittenDigests, err := newDigester(a.opts.Digests)
+	if err != nil {
+		return
+	}
 
 	// Calculate original checksum and size
 	var szOrig int64
 	var shaOrig string
 	hr := sha256.New()
-	szOrig, err = io.Copy(hr, r)
+	szOrig, err = io.Copy(io.MultiWriter(hr, originalDigests), &timedReader{r: io.NewSectionReader(r, 0, size), d: &metrics.Read})
 	if err != nil {
 		err = fmt.Errorf("error copying when calculating SHA in RPackageZipArchive.RewriteBinary: %s", err)
 		return
 	}
 	shaOrig = fmt.Sprintf("%x", hr.Sum(nil))
 
-	// Seek back to the beginning of the file
-	_, err = r.Seek(0, 0)
-	if err != nil {
-		err = fmt.Errorf("error seeking to beginning of file in RPackageZipArchive.RewriteBinary: %s", err)
-		return
-	}
-
 	// Zip to the destination
 	//
 	// `hw` calculates the SHA256 checksum for the rewritten package
 	hw := sha256.New()
 	// `lw` calculates the output size
 	lw := &LenWriter{}
-	// `hwlw` writes to both the SHA hash and the LenWriter simultaneously
-	hwlw := io.MultiWriter(hw, lw)
+	// `hwlw` writes to the SHA hash, the other digests and the LenWriter simultaneously
+	hwlw := io.MultiWriter(hw, rewrittenDigests, lw)
 	mw := io.MultiWriter(hwlw, w)
 	// write buffer that respects `Server.PackageRewriteBufferSize`; the buffer
 	// writes to the `mw` multiwriter.
@@ -64,17 +166,27 @@ func (a *RPackageZipArchive) RewriteBinary(r *os.File, w io.Writer) (results *Re
 	// `zipw` compresses data before sending it to the buffered writer.
 	zipw := zip.NewWriter(buffer)
 	defer func() {
+		closeStart := time.Now()
 		_ = zipw.Close()
 		_ = buffer.Flush()
+		metrics.Compress += time.Since(closeStart)
 		// These must be set after the buffers are flushed
 		if results != nil {
 			results.RewrittenChecksum = fmt.Sprintf("%x", hw.Sum(nil))
 			results.RewrittenSize = lw.len
+			results.RewrittenDigests = rewrittenDigests.sums()
+			metrics.Total = time.Since(start)
+			results.Metrics = metrics
+			a.opts.logger().Debug("rewrote package",
+				"format", results.Format,
+				"size", results.OriginalSize,
+				"metrics", metrics.logValue())
 		}
 	}()
 
 	// Iterate over the files and:
 	// - rewrite the Repository field in the DESCRIPTION file
+	// - read the best matching README file
 	// - update the MD5 file.
 	// Since we cannot guarantee the order of the ZIP files, we need to
 	// capture the two sections and write them at the end.
@@ -93,18 +205,25 @@ func (a *RPackageZipArchive) RewriteBinary(r *os.File, w io.Writer) (results *Re
 	}
 	md5s := make([]md5Info, 0)
 
-	// For logging
-	writeTime := int64(0)
+	// Holds the contents of the preferred file of each extractor, such as the README
+	extractions, err := newExtractions(extractors)
+	if err != nil {
+		return
+	}
+
+	// Computes the checksums of every file when the MD5 file is verified or regenerated
+	manifest := newMD5Manifest(a.opts.VerifyMD5 || a.opts.RegenerateMD5)
 
 	// Create the Zip reader
-	stat, err := r.Stat()
+	zr, err := zip.NewReader(r, size)
 	if err != nil {
-		err = fmt.Errorf("error getting file Stat() in RPackageZipArchive.RewriteBinary: %s", err)
+		err = fmt.Errorf("error opening ZIP reader in RPackageZipArchive.RewriteBinary: %s", err)
 		return
 	}
-	zr, err := zip.NewReader(r, stat.Size())
+
+	// Validate the archive before writing anything, and find the entries to strip
+	strip, err := newValidator(a.opts.Validation).checkZip(zr, size)
 	if err != nil {
-		err = fmt.Errorf("error opening ZIP reader in RPackageZipArchive.RewriteBinary: %s", err)
 		return
 	}
 
@@ -121,9 +240,15 @@ func (a *RPackageZipArchive) RewriteBinary(r *os.File, w io.Writer) (results *Re
 
 	for _, f := range zr.File {
 		header := &f.FileHeader
+		if err = ctx.Err(); err != nil {
+			return
+		}
 
-		// Ignore directories
-		if header.FileInfo().IsDir() {
+		// Ignore directories and entries stripped by validation
+		if strip[header.Name] {
+			continue
+		} else if header.FileInfo().IsDir() {
+			metrics.addEntry(EntryDirectory, 0)
 			continue
 		}
 
@@ -149,7 +274,7 @@ func (a *RPackageZipArchive) RewriteBinary(r *os.File, w io.Writer) (results *Re
 				err = fmt.Errorf("error opening ZIP archive file '%s' in RPackageZipArchive.RewriteBinary: %s", header.Name, err)
 				return
 			}
-			_, err = io.Copy(descInfo.buffer, zf)
+			_, err = io.Copy(manifest.tee(header.Name, descInfo.buffer), &timedReader{r: zf, d: &metrics.Decompress})
 			if err != nil {
 				err = fmt.Errorf("error copying DESCRIPTION data for ZIP archive file '%s' in RPackageZipArchive.RewriteBinary: %s", header.Name, err)
 				return
@@ -157,6 +282,7 @@ func (a *RPackageZipArchive) RewriteBinary(r *os.File, w io.Writer) (results *Re
 
 			// Append to the list of buffered DESCRIPTION files
 			descriptions = append(descriptions, descInfo)
+			metrics.addEntry(EntryDescription, int64(header.UncompressedSize64))
 
 		} else if name == "MD5" && (md5PathLen == 0 || len(header.Name) < md5PathLen) {
 			// Only buffer the MD5 file if we have not found a file with
@@ -177,7 +303,7 @@ func (a *RPackageZipArchive) RewriteBinary(r *os.File, w io.Writer) (results *Re
 				return
 			}
 
-			_, err = io.Copy(info.buffer, zf)
+			_, err = io.Copy(manifest.tee(header.Name, info.buffer), &timedReader{r: zf, d: &metrics.Decompress})
 			if err != nil {
 				err = fmt.Errorf("error copying MD5 file data for ZIP archive file '%s' in RPackageZipArchive.RewriteBinary: %s", header.Name, err)
 				return
@@ -185,11 +311,25 @@ func (a *RPackageZipArchive) RewriteBinary(r *os.File, w io.Writer) (results *Re
 
 			// Append to the list of buffered MD5 files.
 			md5s = append(md5s, info)
+			metrics.addEntry(EntryMD5, int64(header.UncompressedSize64))
 
 		} else {
 			// We'll hit this block writing any data to the ZIP file where
 			// we don't have a special handler above.
-			start := time.Now()
+			copyStart := time.Now()
+			class := EntryFile
+			var writers []io.Writer
+			if header.Mode()&fs.ModeSymlink != 0 {
+				class = EntryLink
+			} else {
+				// Also write to the buffers of the extractors that prefer this file so far,
+				// such as the README. This way we do not care about ZIP file ordering.
+				var readme bool
+				if writers, readme = extractionWriters(extractions, header.Name); readme {
+					class = EntryReadme
+				}
+			}
+			metrics.addEntry(class, int64(header.UncompressedSize64))
 
 			// Here, write the header and content as is.
 			var zf fs.File
@@ -200,18 +340,23 @@ func (a *RPackageZipArchive) RewriteBinary(r *os.File, w io.Writer) (results *Re
 			}
 
 			var variousW io.Writer
-			variousW, err = zipw.CreateHeader(header)
+			variousW, err = a.createHeader(zipw, header, &metrics)
 			if err != nil {
 				err = fmt.Errorf("error creating ZIP header for file '%s' in RPackageZipArchive.RewriteBinary: %s", header.Name, err)
 				return
 			}
 
-			if _, err = io.Copy(variousW, zf); err != nil {
+			variousW = io.MultiWriter(append(writers, variousW)...)
+			if header.Mode().IsRegular() {
+				// The contents of symlinks are their targets, which are not checksummed
+				variousW = manifest.tee(header.Name, variousW)
+			}
+			if _, err = io.Copy(variousW, &timedReader{r: zf, d: &metrics.Decompress}); err != nil {
 				err = fmt.Errorf("error copying data for file '%s' in RPackageZipArchive.RewriteBinary: %s", header.Name, err)
 				return
 			}
 
-			writeTime += time.Since(start).Milliseconds()
+			metrics.Copy += time.Since(copyStart)
 		}
 	}
 
@@ -219,7 +364,7 @@ func (a *RPackageZipArchive) RewriteBinary(r *os.File, w io.Writer) (results *Re
 	var (
 		descMd5         string
 		descriptionText string
-		toUTF           bool
+		descFields      metadata.Fields
 	)
 
 	for _, descInfo := range descriptions {
@@ -229,70 +374,17 @@ func (a *RPackageZipArchive) RewriteBinary(r *os.File, w io.Writer) (results *Re
 		// a string for easy access later, then write the new DESCRIPTION contents
 		// to the ZIP writer.
 		if header.Name == descPath {
-			descReadBuffer := bytes.NewBuffer([]byte{})
-			useEncoding := defaultEncodingLatin1
-
 			// Rewrite the DESCRIPTION file.
-			scanner := bufio.NewScanner(descInfo.buffer)
-			repoFieldFound := false
-			encodingFieldFound := false
-
-			for scanner.Scan() {
-				line := scanner.Bytes()
-				if bytes.HasPrefix(line, []byte("Repository: ")) {
-					repoFieldFound = true
-					line = []byte(DescriptionRepository)
-				} else if bytes.HasPrefix(line, []byte("Encoding: ")) {
-					encodingFieldFound = true
-					lineLower := strings.ToLower(string(line))
-
-					// Set the `useEncoding` and DESCRIPTION encoding line correctly
-					switch {
-					case strings.Contains(lineLower, defaultEncodingLatin1):
-						useEncoding = defaultEncodingLatin1
-					case strings.Contains(lineLower, encodingLatin2):
-						useEncoding = encodingLatin2
-					default:
-						toUTF = true
-						useEncoding = encodingUTF8
-					}
-
-					line = []byte(fmt.Sprintf(DescriptionEncoding, useEncoding))
-				}
-
-				descReadBuffer.Write(line)
-				descReadBuffer.Write([]byte("\n"))
-			}
-
-			// In rare cases the Repository field is not set.
-			if !repoFieldFound {
-				descReadBuffer.Write([]byte(DescriptionRepository + "\n"))
-			}
-			// Add an Encoding field if none was found
-			if !encodingFieldFound {
-				toUTF = true
-				descReadBuffer.Write([]byte(fmt.Sprintf(DescriptionEncoding, encodingUTF8) + "\n"))
-			}
-
-			// Get a reader that understands the DESCRIPTION encoding
-			var reader io.Reader
-			reader = descReadBuffer
-
-			if toUTF {
-				reader, err = charset.NewReaderLabel(useEncoding, descReadBuffer)
-				if err != nil {
-					err = fmt.Errorf("error getting reader for encoding '%s' in RPackageZipArchive.RewriteBinary: %s", useEncoding, err)
-					return
-				}
-			}
-
-			// Copy data using UTF-8.
-			descInfo.buffer.Reset()
-			_, err = io.Copy(descInfo.buffer, reader)
+			var rewritten []byte
+			rewriteStart := time.Now()
+			rewritten, descFields, err = a.opts.rewriteDescription(descInfo.buffer.Bytes())
+			metrics.DescriptionRewrite += time.Since(rewriteStart)
 			if err != nil {
-				err = fmt.Errorf("error copying DESCRIPTION data to buffer in RPackageZipArchive.RewriteBinary: %s", err)
+				err = fmt.Errorf("error rewriting DESCRIPTION data in RPackageZipArchive.RewriteBinary: %s", err)
 				return
 			}
+			descInfo.buffer.Reset()
+			descInfo.buffer.Write(rewritten)
 
 			// Update the header's size value
 			header.UncompressedSize64 = uint64(descInfo.buffer.Len())
@@ -306,7 +398,7 @@ func (a *RPackageZipArchive) RewriteBinary(r *os.File, w io.Writer) (results *Re
 
 		// Write the DESCRIPTION
 		var descW io.Writer
-		descW, err = zipw.CreateHeader(header)
+		descW, err = a.createHeader(zipw, header, &metrics)
 		if err != nil {
 			err = fmt.Errorf("error creating ZIP header for DESCRIPTION file '%s' in RPackageZipArchive.RewriteBinary: %s", header.Name, err)
 			return
@@ -320,37 +412,30 @@ func (a *RPackageZipArchive) RewriteBinary(r *os.File, w io.Writer) (results *Re
 		}
 	}
 
+	// Write the extracted files out to their writers. This extracts the README for
+	// faster access later.
+	extracted, markdown, err := writeExtractions(extractions)
+	if err != nil {
+		err = fmt.Errorf("error writing extracted data in RPackageZipArchive.RewriteBinary: %s", err)
+		return
+	}
+
 	// MD5 handling
 	// Rewrite the MD5 file.
+	var verification *MD5Verification
 	for _, info := range md5s {
 		header := info.header
 
 		// If this is the authoritative MD5 file, we must rewrite it.
 		if header.Name == md5Path {
-			md5Buffer := bytes.NewBuffer([]byte{})
-			scanner := bufio.NewScanner(info.buffer)
-			for scanner.Scan() {
-				line := scanner.Bytes()
-				if bytes.HasSuffix(line, []byte(" *DESCRIPTION")) {
-					if descMd5 == "" {
-						fmt.Printf("Error: No DESCRIPTION checksum was generated.")
-					} else {
-						line = []byte(descMd5 + " *DESCRIPTION")
-					}
-				}
-				md5Buffer.Write(line)
-				md5Buffer.Write([]byte("\n"))
-			}
+			var rewritten []byte
+			rewritten, verification = a.opts.rewriteMD5(manifest, md5Path, descPath, descMd5, info.buffer.Bytes())
 			info.buffer.Reset()
-			_, err = io.Copy(info.buffer, md5Buffer)
-			if err != nil {
-				err = fmt.Errorf("error copying MD5 data to buffer in RPackageZipArchive.RewriteBinary: %s", err)
-				return
-			}
+			info.buffer.Write(rewritten)
 			header.UncompressedSize64 = uint64(info.buffer.Len())
 		}
 		var md5W io.Writer
-		md5W, err = zipw.CreateHeader(header)
+		md5W, err = a.createHeader(zipw, header, &metrics)
 		if err != nil {
 			err = fmt.Errorf("error creating ZIP header for MD5 file '%s' in RPackageZipArchive.RewriteBinary: %s", header.Name, err)
 			return
@@ -368,16 +453,140 @@ func (a *RPackageZipArchive) RewriteBinary(r *os.File, w io.Writer) (results *Re
 	// top of this function that mutates the returned results further by
 	// setting the RewrittenChecksum and RewrittenSize properties.
 	results = &Results{
-		OriginalSize:     szOrig,
-		OriginalChecksum: shaOrig,
-		Description:      descriptionText,
+		Format:            FormatZip,
+		RewrittenFormat:   FormatZip,
+		OriginalSize:      szOrig,
+		OriginalChecksum:  shaOrig,
+		OriginalDigests:   originalDigests.sums(),
+		Description:       descriptionText,
+		DescriptionFields: descFields,
+		Dependencies:      metadata.ParseDependencies(descFields),
+		ReadmeMarkdown:    markdown,
+		Extracted:         extracted,
+		MD5:               verification,
+	}
+
+	return
+}
+
+// createHeader adds the file `header` to `zipw`, and times the writes to the returned writer
+// as compression.
+func (a *RPackageZipArchive) createHeader(zipw *zip.Writer, header *zip.FileHeader, metrics *Metrics) (io.Writer, error) {
+	fw, err := zipw.CreateHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	return &timedWriter{w: fw, d: &metrics.Compress}, nil
+}
+
+// GetReadme writes the best-matching README file in the ZIP archive read from `r` to
+// `wReadme`, and returns true if it is a markdown file. Streams without random access are
+// spooled like `RewriteBinary`.
+func (a *RPackageZipArchive) GetReadme(r io.Reader, wReadme io.Writer) (markdown bool, err error) {
+	return a.GetReadmeContext(context.Background(), r, wReadme)
+}
+
+// GetReadmeContext is like `GetReadme`, but stops with the context error when `ctx` is done.
+func (a *RPackageZipArchive) GetReadmeContext(ctx context.Context, r io.Reader, wReadme io.Writer) (markdown bool, err error) {
+	err = a.withReaderAt(ctx, r, func(ra io.ReaderAt, size int64) error {
+		markdown, err = a.GetReadmeAt(ra, size, wReadme)
+		return err
+	})
+	return
+}
+
+// GetReadmeAt writes the best-matching README file in the ZIP archive of `size` bytes read
+// from `r` to `wReadme`, and returns true if it is a markdown file.
+func (a *RPackageZipArchive) GetReadmeAt(r io.ReaderAt, size int64, wReadme io.Writer) (bool, error) {
+	extracted, err := a.ExtractAt(r, size, []*Extractor{ReadmeExtractor(wReadme)})
+	if err != nil {
+		return false, err
 	}
+	return readmeMarkdown(extracted[ExtractReadme]), nil
+}
+
+// Extract writes the files found by `extractors` in the ZIP archive read from `r` to their
+// writers, without rewriting it, and returns the paths of the extracted entries like
+// `Results.Extracted`. Streams without random access are spooled like `RewriteBinary`.
+func (a *RPackageZipArchive) Extract(r io.Reader, extractors []*Extractor) (map[string]string, error) {
+	return a.ExtractContext(context.Background(), r, extractors)
+}
 
+// ExtractContext is like `Extract`, but stops with the context error when `ctx` is done.
+func (a *RPackageZipArchive) ExtractContext(ctx context.Context, r io.Reader, extractors []*Extractor) (extracted map[string]string, err error) {
+	err = a.withReaderAt(ctx, r, func(ra io.ReaderAt, size int64) error {
+		extracted, err = a.ExtractAt(ra, size, extractors)
+		return err
+	})
 	return
 }
 
-func NewRPackageZipArchive(bufferSize int) *RPackageZipArchive {
+// ExtractAt is like `Extract` for a ZIP archive of `size` bytes read from `r`.
+func (a *RPackageZipArchive) ExtractAt(r io.ReaderAt, size int64, extractors []*Extractor) (map[string]string, error) {
+	extractions, err := newExtractions(extractors)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("error opening ZIP reader in RPackageZipArchive.Extract: %s", err)
+	}
+
+	// Find the preferred files first, so that only they are read. This way we do not care
+	// about ZIP file ordering.
+	for _, f := range zr.File {
+		header := &f.FileHeader
+		name := header.FileInfo().Name()
+		if !header.Mode().IsRegular() || name == "DESCRIPTION" || name == "MD5" {
+			continue
+		}
+		extractionWriters(extractions, header.Name)
+	}
+	for _, e := range extractions {
+		if e.List || !e.found {
+			continue
+		}
+		zf, err := zr.Open(e.path)
+		if err != nil {
+			return nil, fmt.Errorf("error opening ZIP archive file '%s' in RPackageZipArchive.Extract: %s", e.path, err)
+		}
+		_, err = io.Copy(&e.buffer, zf)
+		_ = zf.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading ZIP archive file '%s' in RPackageZipArchive.Extract: %s", e.path, err)
+		}
+	}
+
+	// Write the extracted files, if any, to their writers
+	extracted, _, err := writeExtractions(extractions)
+	return extracted, err
+}
+
+// readerAtSize returns `r` as an io.ReaderAt along with its size when `r` supports
+// random access. Files other than regular files, such as pipes, are not supported.
+func readerAtSize(r io.Reader) (io.ReaderAt, int64, bool, error) {
+	switch v := r.(type) {
+	case *os.File:
+		stat, err := v.Stat()
+		if err != nil {
+			return nil, 0, false, fmt.Errorf("error getting file Stat() in RPackageZipArchive.RewriteBinary: %s", err)
+		}
+		if !stat.Mode().IsRegular() {
+			return nil, 0, false, nil
+		}
+		return v, stat.Size(), true, nil
+	case interface {
+		io.ReaderAt
+		Size() int64
+	}:
+		return v, v.Size(), true, nil
+	}
+	return nil, 0, false, nil
+}
+
+func NewRPackageZipArchive(bufferSize int, opts RewriteOptions) *RPackageZipArchive {
 	return &RPackageZipArchive{
 		bufferSize: bufferSize,
+		opts:       opts,
 	}
 }
@@ -8,12 +8,15 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/suite"
 
 	"github.com/rstudio/package-manager-rpackagerewriter/internal/test"
+	"github.com/rstudio/package-manager-rpackagerewriter/internal/utils"
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/metadata"
 )
 
 func TestArchiveZipSuite(t *testing.T) {
@@ -25,14 +28,14 @@ type ArchiveZipSuite struct {
 }
 
 func (s *ArchiveZipSuite) TestNewArchive() {
-	a := NewRPackageZipArchive(256)
+	a := NewRPackageZipArchive(256, RewriteOptions{})
 	s.Require().Equal(&RPackageZipArchive{
 		bufferSize: 256,
 	}, a)
 }
 
 func (s *ArchiveZipSuite) TestDescriptionRewriteBinaryInvalid() {
-	a := NewRPackageZipArchive(256)
+	a := NewRPackageZipArchive(256, RewriteOptions{})
 
 	tmp, err := os.CreateTemp("", "")
 	s.Require().Nil(err)
@@ -51,7 +54,7 @@ func (s *ArchiveZipSuite) TestDescriptionRewriteBinaryInvalid() {
 }
 
 func (s *ArchiveZipSuite) TestDescriptionRewriteBinary() {
-	a := NewRPackageZipArchive(256)
+	a := NewRPackageZipArchive(256, RewriteOptions{})
 	f, err := os.Open("../testdata/binaries/bindrcpp_0.2.2.zip")
 	s.Require().Nil(err)
 
@@ -125,7 +128,7 @@ func (s *ArchiveZipSuite) TestDescriptionRewriteBinary() {
 // * The DESCRIPTION is needs to retain the `Encoding: latin1`
 // * The DESCRIPTION is written using the `latin1` encoding instead of the default `UTF-8`
 func (s *ArchiveZipSuite) TestDescriptionRewriteLatin1() {
-	a := NewRPackageZipArchive(256)
+	a := NewRPackageZipArchive(256, RewriteOptions{})
 	f, err := os.Open("../testdata/special/Latin1SpecialChars_1.1.1.zip")
 	s.Require().Nil(err)
 
@@ -183,7 +186,7 @@ func (s *ArchiveZipSuite) TestDescriptionRewriteLatin1() {
 }
 
 func (s *ArchiveZipSuite) TestDescriptionFFEncoding() {
-	a := NewRPackageZipArchive(256)
+	a := NewRPackageZipArchive(256, RewriteOptions{})
 	f, err := os.Open("../testdata/ff_2.2-14.zip")
 	s.Require().Nil(err)
 
@@ -203,3 +206,164 @@ func (s *ArchiveZipSuite) TestDescriptionFFEncoding() {
 	s.Require().Equal(true, strings.Contains(results.Description, "latin1"))
 	test.TestifyGolden(results.Description, &s.Suite)
 }
+
+func (s *ArchiveZipSuite) TestDescriptionRewriteRepository() {
+	a := NewRPackageZipArchive(256, RewriteOptions{Repository: "Internal"})
+	f, err := os.Open("../testdata/binaries/bindrcpp_0.2.2.zip")
+	s.Require().Nil(err)
+
+	var b bytes.Buffer
+	results, err := a.RewriteBinary(f, &b)
+	s.Require().Nil(err)
+
+	// The Repository field is appended since the binary does not include one
+	s.Require().True(strings.HasSuffix(results.Description, "\nRepository: Internal\n"))
+	s.Require().NotContains(results.Description, "RSPM")
+}
+
+func (s *ArchiveZipSuite) TestDependencies() {
+	a := NewRPackageZipArchive(256, RewriteOptions{})
+	f, err := os.Open("../testdata/binaries/bindrcpp_0.2.2.zip")
+	s.Require().Nil(err)
+
+	var b bytes.Buffer
+	results, err := a.RewriteBinary(f, &b)
+	s.Require().Nil(err)
+	s.Require().Equal([]metadata.Link{
+		{Name: "bindr", Raw: "bindr (>= 0.1.1)", Operator: metadata.VersionGTE, Version: "0.1.1", Type: metadata.LinkImports},
+		{Name: "Rcpp", Raw: "Rcpp (>= 0.12.16)", Operator: metadata.VersionGTE, Version: "0.12.16", Type: metadata.LinkImports},
+		{Name: "testthat", Raw: "testthat", Type: metadata.LinkSuggests},
+		{Name: "plogr", Raw: "plogr", Type: metadata.LinkLinkingTo},
+		{Name: "Rcpp", Raw: "Rcpp", Type: metadata.LinkLinkingTo},
+	}, results.Dependencies)
+}
+
+func (s *ArchiveZipSuite) TestDescriptionRewriteBinaryStream() {
+	data, err := os.ReadFile("../testdata/binaries/bindrcpp_0.2.2.zip")
+	s.Require().Nil(err)
+
+	// Rewrite from an io.ReaderAt
+	a := NewRPackageZipArchive(256, RewriteOptions{})
+	var expected bytes.Buffer
+	expectedResults, err := a.RewriteBinaryAt(bytes.NewReader(data), int64(len(data)), &expected)
+	s.Require().Nil(err)
+	s.Require().Equal("dc4387dcd7a5ba5f778f2139121bc81dea5a44a0c2adb19a0c09dbff17e1247a", expectedResults.OriginalChecksum)
+	s.Require().Equal(int64(len(data)), expectedResults.OriginalSize)
+
+	// Rewrite from streams that do not support random access, spooled both in memory
+	// and to a temporary file.
+	for _, limit := range []int64{0, 1024} {
+		dir := s.T().TempDir()
+		a = NewRPackageZipArchive(256, RewriteOptions{SpoolMemoryLimit: limit, TempDir: dir})
+		var b bytes.Buffer
+		results, err := a.RewriteBinary(io.MultiReader(bytes.NewReader(data)), &b)
+		s.Require().Nil(err)
+		// Timings differ between rewrites
+		s.Require().Equal(expectedResults.Metrics.Entries, results.Metrics.Entries)
+		results.Metrics = expectedResults.Metrics
+		s.Require().Equal(expectedResults, results)
+		s.Require().Equal(expected.Bytes(), b.Bytes())
+
+		// The spool file is removed
+		files, _ := os.ReadDir(dir)
+		s.Require().Len(files, 0)
+	}
+}
+
+func (s *ArchiveZipSuite) TestDescriptionRewriteBinaryStreamTooLarge() {
+	data, err := os.ReadFile("../testdata/binaries/bindrcpp_0.2.2.zip")
+	s.Require().Nil(err)
+
+	a := NewRPackageZipArchive(256, RewriteOptions{SpoolMemoryLimit: 1024, SpoolMaxSize: 4096, TempDir: s.T().TempDir()})
+	var b bytes.Buffer
+	_, err = a.RewriteBinary(io.MultiReader(bytes.NewReader(data)), &b)
+	s.Require().ErrorIs(err, utils.ErrSpoolTooLarge)
+}
+
+func (s *ArchiveZipSuite) TestReadmeResolution() {
+	a := NewRPackageZipArchive(256, RewriteOptions{})
+	f, err := os.Open("../testdata/binaries/readmetest_0.2.0.zip")
+	s.Require().Nil(err)
+
+	var b bytes.Buffer
+	var bReadme bytes.Buffer
+	results, err := a.RewriteWithReadme(f, &b, &bReadme)
+	s.Require().Nil(err)
+
+	// Make sure we parsed the correct README file.
+	s.Require().Equal(true, results.ReadmeMarkdown)
+	s.Require().Equal("Hi, I'm the correct readme!", bReadme.String())
+
+	// Every README file is still copied to the rewritten archive
+	zr, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	s.Require().Nil(err)
+	names := make([]string, 0)
+	for _, zf := range zr.File {
+		if strings.HasPrefix(strings.ToLower(path.Base(zf.Name)), "readme") {
+			names = append(names, zf.Name)
+		}
+	}
+	s.Require().Equal([]string{
+		"readmetest/README",
+		"readmetest/README.md",
+		"readmetest/README.txt",
+		"readmetest/R/readme",
+		"readmetest/man/README.md",
+	}, names)
+}
+
+func (s *ArchiveZipSuite) TestReadmeResolutionStream() {
+	data, err := os.ReadFile("../testdata/binaries/readmetest_0.2.0.zip")
+	s.Require().Nil(err)
+
+	a := NewRPackageZipArchive(256, RewriteOptions{SpoolMemoryLimit: 1024, TempDir: s.T().TempDir()})
+	var b bytes.Buffer
+	var bReadme bytes.Buffer
+	results, err := a.RewriteWithReadme(io.MultiReader(bytes.NewReader(data)), &b, &bReadme)
+	s.Require().Nil(err)
+	s.Require().Equal(true, results.ReadmeMarkdown)
+	s.Require().Equal("Hi, I'm the correct readme!", bReadme.String())
+}
+
+func (s *ArchiveZipSuite) TestReadmeResolutionNone() {
+	a := NewRPackageZipArchive(256, RewriteOptions{})
+	f, err := os.Open("../testdata/binaries/bindrcpp_0.2.2.zip")
+	s.Require().Nil(err)
+
+	var b bytes.Buffer
+	var bReadme bytes.Buffer
+	results, err := a.RewriteWithReadme(f, &b, &bReadme)
+	s.Require().Nil(err)
+
+	// Make sure we didn't find a README
+	s.Require().Equal(false, results.ReadmeMarkdown)
+	s.Require().Equal(0, bReadme.Len())
+}
+
+func (s *ArchiveZipSuite) TestReadmeOnlyResolution() {
+	f, err := os.Open("../testdata/binaries/readmetest_0.2.0.zip")
+	a := NewRPackageZipArchive(256, RewriteOptions{})
+	s.Require().Nil(err)
+
+	var bReadme bytes.Buffer
+	result, err := a.GetReadme(f, &bReadme)
+	s.Require().Nil(err)
+
+	// Make sure we parsed the correct README file.
+	s.Require().Equal(true, result)
+	s.Require().Equal("Hi, I'm the correct readme!", bReadme.String())
+}
+
+func (s *ArchiveZipSuite) TestReadmeOnlyResolutionNone() {
+	f, err := os.Open("../testdata/binaries/bindrcpp_0.2.2.zip")
+	a := NewRPackageZipArchive(256, RewriteOptions{})
+	s.Require().Nil(err)
+
+	var bReadme bytes.Buffer
+	result, err := a.GetReadme(f, &bReadme)
+	s.Require().Nil(err)
+
+	// Make sure we didn't find a README
+	s.Require().Equal(false, result)
+	s.Require().Equal(0, bReadme.Len())
+}
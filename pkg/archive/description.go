@@ -0,0 +1,155 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package archive
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/net/html/charset"
+
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/metadata"
+)
+
+const (
+	fieldRepository = "Repository"
+	fieldEncoding   = "Encoding"
+)
+
+// DescriptionField is a single field of the DESCRIPTION file.
+type DescriptionField = metadata.Field
+
+// DescriptionTransformer mutates the fields of the authoritative DESCRIPTION file while a
+// package is rewritten. Transformers run in order after the `Repository` and `Encoding`
+// fields have been updated, and the returned fields are written back in the order given.
+// Values are written verbatim, so they must use the encoding declared by the DESCRIPTION.
+type DescriptionTransformer interface {
+	Transform(fields []DescriptionField) ([]DescriptionField, error)
+}
+
+// DescriptionTransformerFunc adapts a function to the DescriptionTransformer interface.
+type DescriptionTransformerFunc func(fields []DescriptionField) ([]DescriptionField, error)
+
+func (f DescriptionTransformerFunc) Transform(fields []DescriptionField) ([]DescriptionField, error) {
+	return f(fields)
+}
+
+// SetField replaces the value of every field called `name`, or appends the field if
+// it is not present.
+func SetField(name, value string) DescriptionTransformer {
+	return DescriptionTransformerFunc(func(fields []DescriptionField) ([]DescriptionField, error) {
+		found := false
+		for i := range fields {
+			if fields[i].Name == name {
+				fields[i].Value = value
+				found = true
+			}
+		}
+		if !found {
+			fields = append(fields, DescriptionField{Name: name, Value: value})
+		}
+		return fields, nil
+	})
+}
+
+// AddField appends the field `name` only if it is not already present.
+func AddField(name, value string) DescriptionTransformer {
+	return DescriptionTransformerFunc(func(fields []DescriptionField) ([]DescriptionField, error) {
+		for _, f := range fields {
+			if f.Name == name {
+				return fields, nil
+			}
+		}
+		return append(fields, DescriptionField{Name: name, Value: value}), nil
+	})
+}
+
+// DeleteField removes every field called `name`, including its continuation lines.
+func DeleteField(name string) DescriptionTransformer {
+	return DescriptionTransformerFunc(func(fields []DescriptionField) ([]DescriptionField, error) {
+		kept := make([]DescriptionField, 0, len(fields))
+		for _, f := range fields {
+			if f.Name != name {
+				kept = append(kept, f)
+			}
+		}
+		return kept, nil
+	})
+}
+
+// rewriteDescription rewrites the authoritative DESCRIPTION. It sets the `Repository`
+// field, normalizes the `Encoding` field, applies the configured transformers, and
+// finally converts the text to UTF-8 unless the DESCRIPTION declares a latin encoding.
+// The rewritten text is returned along with its parsed fields.
+func (o RewriteOptions) rewriteDescription(desc []byte) ([]byte, metadata.Fields, error) {
+	// Line endings are always normalized to "\n"
+	desc = bytes.ReplaceAll(desc, []byte("\r\n"), []byte("\n"))
+	if len(desc) > 0 && !bytes.HasSuffix(desc, []byte("\n")) {
+		desc = append(desc, '\n')
+	}
+	parsed, err := metadata.ParseFields(desc)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing DESCRIPTION: %s", err)
+	}
+
+	fields, err := SetField(fieldRepository, o.repository()).Transform(parsed)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Set the `useEncoding` and DESCRIPTION encoding field correctly. A DESCRIPTION
+	// without an `Encoding` field is read as latin1 and converted to UTF-8.
+	useEncoding := defaultEncodingLatin1
+	toUTF := false
+	encodingFieldFound := false
+	for i := range fields {
+		if fields[i].Name != fieldEncoding {
+			continue
+		}
+		encodingFieldFound = true
+		valueLower := strings.ToLower(fields[i].Value)
+		switch {
+		case strings.Contains(valueLower, defaultEncodingLatin1):
+			useEncoding = defaultEncodingLatin1
+		case strings.Contains(valueLower, encodingLatin2):
+			useEncoding = encodingLatin2
+		default:
+			toUTF = true
+			useEncoding = encodingUTF8
+		}
+		// Always write the normalized field
+		fields[i] = DescriptionField{Name: fieldEncoding, Value: useEncoding}
+	}
+	// Add an Encoding field if none was found
+	if !encodingFieldFound {
+		toUTF = true
+		fields = append(fields, DescriptionField{Name: fieldEncoding, Value: encodingUTF8})
+	}
+
+	for _, t := range o.Transformers {
+		if fields, err = t.Transform(fields); err != nil {
+			return nil, nil, fmt.Errorf("error transforming DESCRIPTION: %s", err)
+		}
+	}
+
+	// Get a reader that understands the DESCRIPTION encoding
+	var reader io.Reader = bytes.NewReader(metadata.Fields(fields).Bytes())
+	if toUTF {
+		reader, err = charset.NewReaderLabel(useEncoding, reader)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error getting reader for encoding '%s': %s", useEncoding, err)
+		}
+	}
+
+	// Copy data using UTF-8.
+	rewritten, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	parsed, err = metadata.ParseFields(rewritten)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing rewritten DESCRIPTION: %s", err)
+	}
+	return rewritten, parsed, nil
+}
@@ -0,0 +1,181 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package archive
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/metadata"
+)
+
+func TestDescriptionSuite(t *testing.T) {
+	suite.Run(t, &DescriptionSuite{})
+}
+
+type DescriptionSuite struct {
+	suite.Suite
+}
+
+const testDescription = "Package: test\n" +
+	"Title:  Extra  spacing\n" +
+	"Remotes: org/one,\n" +
+	"    org/two\n" +
+	"Depends: R (>= 3.0)\n" +
+	"Encoding: UTF-8\n"
+
+func (s *DescriptionSuite) TestFieldOperations() {
+	fields, err := metadata.ParseFields([]byte(testDescription))
+	s.Require().Nil(err)
+
+	fields, err = SetField("Title", "New").Transform(fields)
+	s.Require().Nil(err)
+	fields, err = SetField("Packaged", "today").Transform(fields)
+	s.Require().Nil(err)
+	fields, err = AddField("Package", "ignored").Transform(fields)
+	s.Require().Nil(err)
+	fields, err = AddField("RemoteSha", "abc123").Transform(fields)
+	s.Require().Nil(err)
+	fields, err = DeleteField("Remotes").Transform(fields)
+	s.Require().Nil(err)
+
+	s.Require().Equal("Package: test\n"+
+		"Title: New\n"+
+		"Depends: R (>= 3.0)\n"+
+		"Encoding: UTF-8\n"+
+		"Packaged: today\n"+
+		"RemoteSha: abc123\n", string(metadata.Fields(fields).Bytes()))
+}
+
+func (s *DescriptionSuite) TestRewriteDescription() {
+	opts := RewriteOptions{
+		Repository: "Internal",
+		Transformers: []DescriptionTransformer{
+			DeleteField("Remotes"),
+			SetField("Date/Publication", "2023-01-01"),
+		},
+	}
+	out, fields, err := opts.rewriteDescription([]byte("Package: test\r\nRemotes: org/one,\n    org/two\nEncoding: utf8"))
+	s.Require().Nil(err)
+	s.Require().Equal("Package: test\n"+
+		"Encoding: UTF-8\n"+
+		"Repository: Internal\n"+
+		"Date/Publication: 2023-01-01\n", string(out))
+	s.Require().Len(fields, 4)
+	repo, ok := fields.Get("Repository")
+	s.Require().True(ok)
+	s.Require().Equal("Internal", repo)
+}
+
+func (s *DescriptionSuite) TestRewriteDescriptionFoldedRepository() {
+	// A continuation line that looks like a field must not be treated as one
+	desc := "Package: test\nDescription: Mirrors packages from\n    Repository: CRAN.\nRepository: CRAN\n"
+	out, fields, err := RewriteOptions{}.rewriteDescription([]byte(desc))
+	s.Require().Nil(err)
+	s.Require().Equal("Package: test\n"+
+		"Description: Mirrors packages from\n    Repository: CRAN.\n"+
+		"Repository: RSPM\n"+
+		"Encoding: UTF-8\n", string(out))
+	value, _ := fields.Get("Description")
+	s.Require().Equal("Mirrors packages from\n    Repository: CRAN.", value)
+}
+
+func (s *DescriptionSuite) TestRewriteDescriptionInvalid() {
+	// Lines that are not valid DCF are kept as they are
+	out, fields, err := RewriteOptions{}.rewriteDescription([]byte("\nPackage: test\nno colon here\nVersion: 1.0\n"))
+	s.Require().Nil(err)
+	s.Require().Equal("\nPackage: test\nno colon here\nVersion: 1.0\nRepository: RSPM\nEncoding: UTF-8\n", string(out))
+	version, _ := fields.Get("Version")
+	s.Require().Equal("1.0", version)
+}
+
+// Packages whose DESCRIPTION starts with a blank line are rewritten like any other.
+func (s *DescriptionSuite) TestRewriteDescriptionLeadingBlankLine() {
+	data, err := os.ReadFile("../testdata/readmetest_0.2.0.tar.gz")
+	s.Require().Nil(err)
+	entries, err := readTarEntries(data)
+	s.Require().Nil(err)
+	for i := range entries {
+		if entries[i].header.Name == "readmetest/DESCRIPTION" {
+			entries[i].data = append([]byte("\n"), entries[i].data...)
+			entries[i].header.Size = int64(len(entries[i].data))
+		}
+	}
+	data, err = writeTarGz(entries)
+	s.Require().Nil(err)
+
+	var b bytes.Buffer
+	results, err := NewRPackageArchive(256, 6, RewriteOptions{}).RewriteBinary(bytes.NewReader(data), &b)
+	s.Require().Nil(err)
+	s.Require().True(strings.HasPrefix(results.Description, "\nPackage: readmetest\n"))
+	s.Require().Contains(results.Description, "\nRepository: RSPM\n")
+	name, _ := results.DescriptionFields.Get("Package")
+	s.Require().Equal("readmetest", name)
+	desc, err := readTarFile(b.Bytes(), "readmetest/DESCRIPTION")
+	s.Require().Nil(err)
+	s.Require().Equal(results.Description, desc)
+}
+
+func (s *DescriptionSuite) TestRewriteDescriptionTransformerError() {
+	opts := RewriteOptions{
+		Transformers: []DescriptionTransformer{
+			DescriptionTransformerFunc(func(fields []DescriptionField) ([]DescriptionField, error) {
+				return nil, errors.New("transformer failed")
+			}),
+		},
+	}
+	_, _, err := opts.rewriteDescription([]byte("Package: test\n"))
+	s.Require().ErrorContains(err, "error transforming DESCRIPTION: transformer failed")
+}
+
+func (s *DescriptionSuite) TestRewriteArchiveWithTransformers() {
+	opts := RewriteOptions{
+		Transformers: []DescriptionTransformer{
+			DeleteField("Packaged"),
+			AddField("RemoteSha", "abc123"),
+		},
+	}
+	a := NewRPackageArchive(256, 6, opts)
+	f, err := os.Open("../testdata/DT_0.4.tar.gz")
+	s.Require().Nil(err)
+
+	var b bytes.Buffer
+	var bReadme bytes.Buffer
+	results, err := a.RewriteWithReadme(f, &b, &bReadme)
+	s.Require().Nil(err)
+	s.Require().NotContains(results.Description, "Packaged:")
+	s.Require().True(strings.HasSuffix(results.Description, "\nRemoteSha: abc123\n"))
+	sha, ok := results.DescriptionFields.Get("RemoteSha")
+	s.Require().True(ok)
+	s.Require().Equal("abc123", sha)
+
+	// The MD5 file must reflect the transformed DESCRIPTION
+	md5File, err := StreamFileFromTarGz(&b, "MD5")
+	s.Require().Nil(err)
+	var m bytes.Buffer
+	_, _ = m.ReadFrom(md5File)
+	descMd5 := fmt.Sprintf("%x", md5.Sum([]byte(results.Description)))
+	s.Require().Contains(m.String(), descMd5+" *DESCRIPTION\n")
+}
+
+func (s *DescriptionSuite) TestRewriteZipWithTransformers() {
+	opts := RewriteOptions{
+		Transformers: []DescriptionTransformer{
+			SetField("Packaged", "2023-01-01 00:00:00 UTC; rspm"),
+		},
+	}
+	a := NewRPackageZipArchive(256, opts)
+	f, err := os.Open("../testdata/binaries/bindrcpp_0.2.2.zip")
+	s.Require().Nil(err)
+
+	var b bytes.Buffer
+	results, err := a.RewriteBinary(f, &b)
+	s.Require().Nil(err)
+	s.Require().Contains(results.Description, "\nPackaged: 2023-01-01 00:00:00 UTC; rspm\n")
+}
@@ -0,0 +1,156 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package archive
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// SourceDateEpochEnv is the environment variable that sets the modification time of
+// entries in deterministic mode. See https://reproducible-builds.org/specs/source-date-epoch/
+const SourceDateEpochEnv = "SOURCE_DATE_EPOCH"
+
+// tarWriter is the part of `*tar.Writer` used to write rewritten tarballs, so that
+// deterministic mode can wrap the writer.
+type tarWriter interface {
+	io.WriteCloser
+	WriteHeader(hdr *tar.Header) error
+}
+
+// modTime returns the modification time for entries in deterministic mode: the configured
+// `ModTime`, else `SOURCE_DATE_EPOCH` when set, else the Unix epoch.
+func (o RewriteOptions) modTime() (time.Time, error) {
+	if !o.ModTime.IsZero() {
+		return o.ModTime, nil
+	}
+	epoch := os.Getenv(SourceDateEpochEnv)
+	if epoch == "" {
+		return time.Unix(0, 0), nil
+	}
+	seconds, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s value '%s': %s", SourceDateEpochEnv, epoch, err)
+	}
+	return time.Unix(seconds, 0), nil
+}
+
+// newTarWriter wraps `tw` as configured by the deterministic mode options.
+func (o RewriteOptions) newTarWriter(tw *tar.Writer) (tarWriter, error) {
+	var w tarWriter = tw
+	if o.SortEntries {
+		f, err := os.CreateTemp(o.TempDir, "entries")
+		if err != nil {
+			return nil, fmt.Errorf("error creating temp file for sorted entries: %s", err)
+		}
+		w = &sortingWriter{tw: tw, file: f}
+	}
+	if o.Deterministic {
+		modTime, err := o.modTime()
+		if err != nil {
+			_ = w.Close()
+			return nil, err
+		}
+		w = &normalizingWriter{tarWriter: w, modTime: modTime}
+	}
+	return w, nil
+}
+
+// normalizingWriter clears the ownership and access times of each entry, and sets its
+// modification time to `modTime`.
+type normalizingWriter struct {
+	tarWriter
+	modTime time.Time
+}
+
+// paxNormalizedKeys are the PAX records that are replaced by normalized header fields.
+var paxNormalizedKeys = []string{"atime", "ctime", "mtime", "uid", "gid", "uname", "gname"}
+
+func (w *normalizingWriter) WriteHeader(hdr *tar.Header) error {
+	h := *hdr
+	h.Uid = 0
+	h.Gid = 0
+	h.Uname = ""
+	h.Gname = ""
+	h.ModTime = w.modTime
+	h.AccessTime = time.Time{}
+	h.ChangeTime = time.Time{}
+	if len(h.PAXRecords) > 0 {
+		records := make(map[string]string, len(h.PAXRecords))
+		for k, v := range h.PAXRecords {
+			records[k] = v
+		}
+		for _, k := range paxNormalizedKeys {
+			delete(records, k)
+		}
+		h.PAXRecords = records
+	}
+	return w.tarWriter.WriteHeader(&h)
+}
+
+// sortingWriter collects every entry in a temporary file and writes the entries to `tw`
+// in name order when it is closed.
+type sortingWriter struct {
+	tw      *tar.Writer
+	file    *os.File
+	size    int64
+	entries []sortedEntry
+}
+
+type sortedEntry struct {
+	header *tar.Header
+	offset int64
+}
+
+func (w *sortingWriter) WriteHeader(hdr *tar.Header) error {
+	h := *hdr
+	w.entries = append(w.entries, sortedEntry{header: &h, offset: w.size})
+	return nil
+}
+
+func (w *sortingWriter) Write(b []byte) (int, error) {
+	n, err := w.file.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+// Close writes the sorted entries and closes the underlying tar writer.
+func (w *sortingWriter) Close() error {
+	defer w.discard()
+
+	sort.SliceStable(w.entries, func(i, j int) bool {
+		return w.entries[i].header.Name < w.entries[j].header.Name
+	})
+	for _, entry := range w.entries {
+		if err := w.tw.WriteHeader(entry.header); err != nil {
+			return err
+		}
+		if _, err := io.Copy(w.tw, io.NewSectionReader(w.file, entry.offset, entry.header.Size)); err != nil {
+			return err
+		}
+	}
+	return w.tw.Close()
+}
+
+// discard removes the temporary file of collected entries without writing them.
+func (w *sortingWriter) discard() {
+	_ = w.file.Close()
+	_ = os.Remove(w.file.Name())
+}
+
+// discardTarWriter releases `w` after a rewrite failed. Entries collected by a
+// sortingWriter are discarded rather than written to a package that is thrown away.
+func discardTarWriter(w tarWriter) {
+	if nw, ok := w.(*normalizingWriter); ok {
+		w = nw.tarWriter
+	}
+	if sw, ok := w.(*sortingWriter); ok {
+		sw.discard()
+		return
+	}
+	_ = w.Close()
+}
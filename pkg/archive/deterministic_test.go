@@ -0,0 +1,231 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+func TestDeterministicSuite(t *testing.T) {
+	suite.Run(t, &DeterministicSuite{})
+}
+
+type DeterministicSuite struct {
+	suite.Suite
+}
+
+type tarEntry struct {
+	header *tar.Header
+	data   []byte
+}
+
+// readTarEntries returns the entries of the compressed tarball `data`.
+func readTarEntries(data []byte) ([]tarEntry, error) {
+	dr, _, err := decompress(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer func(dr io.ReadCloser) {
+		_ = dr.Close()
+	}(dr)
+	entries := make([]tarEntry, 0)
+	tr := tar.NewReader(dr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, err
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, tarEntry{header: header, data: b})
+	}
+}
+
+// writeTarGz writes `entries` to a gzipped tarball.
+func writeTarGz(entries []tarEntry) ([]byte, error) {
+	var b bytes.Buffer
+	gw := gzip.NewWriter(&b)
+	gw.ModTime = time.Now()
+	tw := tar.NewWriter(gw)
+	for _, entry := range entries {
+		if err := tw.WriteHeader(entry.header); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(entry.data); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// variants returns two tarballs with the contents of readmetest, with different entry
+// order, ownership and timestamps.
+func (s *DeterministicSuite) variants() ([]byte, []byte) {
+	data, err := os.ReadFile("../testdata/readmetest_0.2.0.tar.gz")
+	s.Require().Nil(err)
+	entries, err := readTarEntries(data)
+	s.Require().Nil(err)
+
+	reordered := make([]tarEntry, 0, len(entries))
+	for i := len(entries) - 1; i >= 0; i-- {
+		h := *entries[i].header
+		h.Uid = 1000
+		h.Gid = 1000
+		h.Uname = "builder"
+		h.Gname = "staff"
+		h.ModTime = time.Date(2023, 4, 5, 6, 7, 8, 0, time.UTC)
+		reordered = append(reordered, tarEntry{header: &h, data: entries[i].data})
+	}
+	variant, err := writeTarGz(reordered)
+	s.Require().Nil(err)
+	return data, variant
+}
+
+func (s *DeterministicSuite) TestDeterministic() {
+	original, variant := s.variants()
+
+	rewrite := func(opts RewriteOptions, data []byte) ([]byte, *Results) {
+		var b bytes.Buffer
+		results, err := NewRPackageArchive(256, 6, opts).RewriteBinary(bytes.NewReader(data), &b)
+		s.Require().Nil(err)
+		return b.Bytes(), results
+	}
+
+	// By default, the output depends on the input order and headers
+	a, _ := rewrite(RewriteOptions{}, original)
+	b, _ := rewrite(RewriteOptions{}, variant)
+	s.Require().NotEqual(a, b)
+
+	// Normalizing the headers is not enough when the order differs
+	opts := RewriteOptions{Deterministic: true}
+	a, _ = rewrite(opts, original)
+	b, _ = rewrite(opts, variant)
+	s.Require().NotEqual(a, b)
+
+	// Sorted, normalized output is byte-identical
+	dir := s.T().TempDir()
+	opts = RewriteOptions{Deterministic: true, SortEntries: true, TempDir: dir}
+	a, aResults := rewrite(opts, original)
+	b, bResults := rewrite(opts, variant)
+	s.Require().Equal(a, b)
+	s.Require().Equal(aResults.RewrittenChecksum, bResults.RewrittenChecksum)
+	s.Require().NotEqual(aResults.OriginalChecksum, bResults.OriginalChecksum)
+	s.Require().Equal(aResults.Description, bResults.Description)
+
+	// The entries temp file is removed
+	files, _ := os.ReadDir(dir)
+	s.Require().Len(files, 0)
+
+	// The gzip header is fixed
+	gr, err := gzip.NewReader(bytes.NewReader(a))
+	s.Require().Nil(err)
+	s.Require().Equal(gzip.Header{OS: 255}, gr.Header)
+
+	// Entries are normalized and sorted
+	entries, err := readTarEntries(a)
+	s.Require().Nil(err)
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		s.Require().Equal(0, entry.header.Uid)
+		s.Require().Equal(0, entry.header.Gid)
+		s.Require().Equal("", entry.header.Uname)
+		s.Require().Equal("", entry.header.Gname)
+		s.Require().Equal(int64(0), entry.header.ModTime.Unix())
+		names = append(names, entry.header.Name)
+	}
+	s.Require().True(sort.StringsAreSorted(names))
+	s.Require().Contains(names, "readmetest/DESCRIPTION")
+}
+
+func (s *DeterministicSuite) TestModTime() {
+	data, err := os.ReadFile("../testdata/readmetest_0.2.0.tar.gz")
+	s.Require().Nil(err)
+
+	modTime := func(opts RewriteOptions) time.Time {
+		var b bytes.Buffer
+		_, err := NewRPackageArchive(256, 6, opts).RewriteBinary(bytes.NewReader(data), &b)
+		s.Require().Nil(err)
+		entries, err := readTarEntries(b.Bytes())
+		s.Require().Nil(err)
+		return entries[0].header.ModTime
+	}
+
+	s.T().Setenv(SourceDateEpochEnv, "1700000000")
+	s.Require().Equal(int64(1700000000), modTime(RewriteOptions{Deterministic: true}).Unix())
+
+	// An explicit ModTime takes precedence
+	explicit := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.Require().Equal(explicit.Unix(), modTime(RewriteOptions{Deterministic: true, ModTime: explicit}).Unix())
+
+	s.T().Setenv(SourceDateEpochEnv, "yesterday")
+	var b bytes.Buffer
+	_, err = NewRPackageArchive(256, 6, RewriteOptions{Deterministic: true}).RewriteBinary(bytes.NewReader(data), &b)
+	s.Require().ErrorContains(err, "invalid SOURCE_DATE_EPOCH value 'yesterday'")
+}
+
+func (s *DeterministicSuite) TestSortEntriesOnly() {
+	_, variant := s.variants()
+
+	var b bytes.Buffer
+	opts := RewriteOptions{SortEntries: true, TempDir: s.T().TempDir()}
+	_, err := NewRPackageArchive(256, 6, opts).RewriteBinary(bytes.NewReader(variant), &b)
+	s.Require().Nil(err)
+
+	// Entries are sorted but keep their headers
+	entries, err := readTarEntries(b.Bytes())
+	s.Require().Nil(err)
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		s.Require().Equal(1000, entry.header.Uid)
+		names = append(names, entry.header.Name)
+	}
+	s.Require().True(sort.StringsAreSorted(names))
+}
+
+func (s *DeterministicSuite) TestSortEntriesError() {
+	dir := s.T().TempDir()
+	var out bytes.Buffer
+	tw, err := RewriteOptions{Deterministic: true, SortEntries: true, TempDir: dir}.newTarWriter(tar.NewWriter(&out))
+	s.Require().Nil(err)
+	s.Require().Nil(tw.WriteHeader(&tar.Header{Name: "test/DESCRIPTION", Typeflag: tar.TypeReg, Size: 1}))
+	_, err = tw.Write([]byte("x"))
+	s.Require().Nil(err)
+
+	// The collected entries are not written after a failed rewrite
+	discardTarWriter(tw)
+	s.Require().Zero(out.Len())
+	files, err := os.ReadDir(dir)
+	s.Require().Nil(err)
+	s.Require().Empty(files)
+
+	// Nor is the temporary file left behind by a rewrite that fails
+	data, err := writeTarGz([]tarEntry{
+		{header: &tar.Header{Name: "test/DESCRIPTION", Typeflag: tar.TypeReg, Mode: 0644, Size: 1}, data: []byte("x")},
+		{header: &tar.Header{Name: "../evil", Typeflag: tar.TypeReg, Mode: 0644}},
+	})
+	s.Require().Nil(err)
+	opts := RewriteOptions{SortEntries: true, TempDir: dir, Validation: &ValidationOptions{}}
+	_, err = NewRPackageArchive(256, 6, opts).RewriteBinary(bytes.NewReader(data), &out)
+	s.Require().NotNil(err)
+	files, err = os.ReadDir(dir)
+	s.Require().Nil(err)
+	s.Require().Empty(files)
+}
@@ -0,0 +1,101 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package archive
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"io"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// Digest names a checksum algorithm that can be computed for original and rewritten
+// packages. See `RewriteOptions.Digests`.
+type Digest string
+
+const (
+	// DigestMD5 is the checksum of the `MD5sum` field of CRAN PACKAGES files.
+	DigestMD5        Digest = "md5"
+	DigestSHA1       Digest = "sha1"
+	DigestSHA256     Digest = "sha256"
+	DigestSHA512     Digest = "sha512"
+	DigestBLAKE2b256 Digest = "blake2b-256"
+	DigestBLAKE2b512 Digest = "blake2b-512"
+)
+
+// UnsupportedDigestError is returned when `RewriteOptions.Digests` names an unknown algorithm.
+type UnsupportedDigestError struct {
+	Digest Digest
+}
+
+func (e *UnsupportedDigestError) Error() string {
+	return fmt.Sprintf("unsupported digest algorithm '%s'", e.Digest)
+}
+
+// Digests maps each algorithm to the hex-encoded checksum of a package.
+type Digests map[Digest]string
+
+func newHash(d Digest) (hash.Hash, error) {
+	switch d {
+	case DigestMD5:
+		return md5.New(), nil
+	case DigestSHA1:
+		return sha1.New(), nil
+	case DigestSHA256:
+		return sha256.New(), nil
+	case DigestSHA512:
+		return sha512.New(), nil
+	case DigestBLAKE2b256:
+		return blake2b.New256(nil)
+	case DigestBLAKE2b512:
+		return blake2b.New512(nil)
+	}
+	return nil, &UnsupportedDigestError{Digest: d}
+}
+
+// digester computes the configured digests of everything written to it.
+type digester struct {
+	hashes map[Digest]hash.Hash
+	w      io.Writer
+}
+
+// newDigester returns a digester for `digests`, which may be empty.
+func newDigester(digests []Digest) (*digester, error) {
+	d := &digester{hashes: make(map[Digest]hash.Hash), w: io.Discard}
+	writers := make([]io.Writer, 0, len(digests))
+	for _, digest := range digests {
+		if _, ok := d.hashes[digest]; ok {
+			continue
+		}
+		h, err := newHash(digest)
+		if err != nil {
+			return nil, err
+		}
+		d.hashes[digest] = h
+		writers = append(writers, h)
+	}
+	if len(writers) > 0 {
+		d.w = io.MultiWriter(writers...)
+	}
+	return d, nil
+}
+
+func (d *digester) Write(p []byte) (int, error) {
+	return d.w.Write(p)
+}
+
+// sums returns the digests, or nil when none are configured.
+func (d *digester) sums() Digests {
+	if len(d.hashes) == 0 {
+		return nil
+	}
+	sums := make(Digests, len(d.hashes))
+	for digest, h := range d.hashes {
+		sums[digest] = fmt.Sprintf("%x", h.Sum(nil))
+	}
+	return sums
+}
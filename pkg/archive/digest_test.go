@@ -0,0 +1,100 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package archive
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/blake2b"
+)
+
+func TestDigestSuite(t *testing.T) {
+	suite.Run(t, &DigestSuite{})
+}
+
+type DigestSuite struct {
+	suite.Suite
+}
+
+var allDigests = []Digest{DigestMD5, DigestSHA1, DigestSHA256, DigestSHA512, DigestBLAKE2b256, DigestBLAKE2b512}
+
+// expectedDigests computes every digest of `data` independently of the rewrite.
+func expectedDigests(data []byte) Digests {
+	return Digests{
+		DigestMD5:        fmt.Sprintf("%x", md5.Sum(data)),
+		DigestSHA1:       fmt.Sprintf("%x", sha1.Sum(data)),
+		DigestSHA256:     fmt.Sprintf("%x", sha256.Sum256(data)),
+		DigestSHA512:     fmt.Sprintf("%x", sha512.Sum512(data)),
+		DigestBLAKE2b256: fmt.Sprintf("%x", blake2b.Sum256(data)),
+		DigestBLAKE2b512: fmt.Sprintf("%x", blake2b.Sum512(data)),
+	}
+}
+
+func (s *DigestSuite) TestDigests() {
+	for _, path := range []string{
+		"../testdata/DT_0.4.tar.gz",
+		"../testdata/binaries/bindrcpp_0.2.2.zip",
+	} {
+		data, err := os.ReadFile(path)
+		s.Require().Nil(err)
+
+		// The digests are computed from streams too
+		var b bytes.Buffer
+		var results *Results
+		r := io.MultiReader(bytes.NewReader(data))
+		if format, _ := detectFormat(data); format == FormatZip {
+			results, err = NewRPackageZipArchive(256, RewriteOptions{Digests: allDigests}).RewriteBinary(r, &b)
+		} else {
+			results, err = NewRPackageArchive(256, 6, RewriteOptions{Digests: allDigests}).RewriteBinary(r, &b)
+		}
+		s.Require().Nil(err, path)
+
+		s.Require().Equal(expectedDigests(data), results.OriginalDigests, path)
+		s.Require().Equal(expectedDigests(b.Bytes()), results.RewrittenDigests, path)
+		s.Require().Equal(results.OriginalChecksum, results.OriginalDigests[DigestSHA256])
+		s.Require().Equal(results.RewrittenChecksum, results.RewrittenDigests[DigestSHA256])
+	}
+}
+
+func (s *DigestSuite) TestDigestsSelection() {
+	data, err := os.ReadFile("../testdata/DT_0.4.tar.gz")
+	s.Require().Nil(err)
+
+	// No digests by default
+	var b bytes.Buffer
+	results, err := NewRPackageArchive(256, 6, RewriteOptions{}).RewriteBinary(bytes.NewReader(data), &b)
+	s.Require().Nil(err)
+	s.Require().Nil(results.OriginalDigests)
+	s.Require().Nil(results.RewrittenDigests)
+
+	// Only the configured digests are returned, once
+	b.Reset()
+	opts := RewriteOptions{Digests: []Digest{DigestMD5, DigestMD5}}
+	results, err = NewRPackageArchive(256, 6, opts).RewriteBinary(bytes.NewReader(data), &b)
+	s.Require().Nil(err)
+	s.Require().Equal(Digests{DigestMD5: expectedDigests(data)[DigestMD5]}, results.OriginalDigests)
+	s.Require().Len(results.RewrittenDigests, 1)
+}
+
+func (s *DigestSuite) TestUnsupportedDigest() {
+	data, err := os.ReadFile("../testdata/binaries/bindrcpp_0.2.2.zip")
+	s.Require().Nil(err)
+	opts := RewriteOptions{Digests: []Digest{DigestSHA256, "crc32"}}
+
+	var digestErr *UnsupportedDigestError
+	_, err = NewRPackageZipArchive(256, opts).RewriteBinary(bytes.NewReader(data), io.Discard)
+	s.Require().True(errors.As(err, &digestErr))
+	s.Require().EqualError(err, "unsupported digest algorithm 'crc32'")
+
+	_, err = NewRPackageArchive(256, 6, opts).RewriteBinary(bytes.NewReader(data), io.Discard)
+	s.Require().True(errors.As(err, &digestErr))
+}
@@ -0,0 +1,256 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package archive
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// The names of the extractors returned by the extractor constructors.
+const (
+	ExtractReadme        = "README"
+	ExtractNews          = "NEWS"
+	ExtractLicense       = "LICENSE"
+	ExtractCitation      = "CITATION"
+	ExtractVignetteIndex = "vignette.rds"
+	ExtractDocs          = "doc"
+)
+
+// Extractor pulls a file out of a package while it is read, like the README. Of the
+// regular files whose path matches `Pattern`, the preferred one is written to `Writer`
+// once the whole package was read, so that the order of the archive does not matter.
+// DESCRIPTION and MD5 files are never extracted.
+type Extractor struct {
+	// Name identifies the extractor in `Results.Extracted`.
+	Name string
+	// Pattern matches the paths of the candidate entries, such as `DT/NEWS.md`.
+	Pattern *regexp.Regexp
+	// Preferred reports whether the candidate `newPath` is preferred over `oldPath`, the
+	// best candidate so far. Defaults to preferring the candidate closest to the root of
+	// the archive, and then the first one found.
+	Preferred func(oldPath, newPath string) bool
+	// List writes the paths of every candidate, one per line, instead of the contents of
+	// the preferred candidate.
+	List bool
+	// Writer receives the extracted file.
+	Writer io.Writer
+}
+
+// ReadmeExtractor extracts the README, preferring `README.md`, then `README.txt` and
+// `README`. `Results.ReadmeMarkdown` reports whether it is a markdown file.
+func ReadmeExtractor(w io.Writer) *Extractor {
+	return &Extractor{
+		Name:    ExtractReadme,
+		Pattern: readmeRE,
+		Preferred: func(oldPath, newPath string) bool {
+			return PreferredReadme(path.Base(oldPath), path.Base(newPath))
+		},
+		Writer: w,
+	}
+}
+
+// NewsExtractor extracts the NEWS file, preferring `NEWS.md`, then `NEWS`,
+// `inst/NEWS.Rd`, `NEWS.Rd` and `inst/NEWS`. Binaries install `inst/NEWS.Rd` as `NEWS.Rd`.
+func NewsExtractor(w io.Writer) *Extractor {
+	return &Extractor{
+		Name:      ExtractNews,
+		Pattern:   regexp.MustCompile(`^[^/]+/(NEWS(\.md|\.Rd)?|inst/NEWS(\.Rd)?)$`),
+		Preferred: PreferOrder("NEWS.md", "NEWS", "inst/NEWS.Rd", "NEWS.Rd", "inst/NEWS"),
+		Writer:    w,
+	}
+}
+
+// LicenseExtractor extracts the LICENSE file, preferring `LICENSE`, then `LICENSE.md`,
+// `LICENCE` and `inst/LICENSE`.
+func LicenseExtractor(w io.Writer) *Extractor {
+	return &Extractor{
+		Name:      ExtractLicense,
+		Pattern:   regexp.MustCompile(`^[^/]+/(inst/)?LICEN[CS]E(\.md)?$`),
+		Preferred: PreferOrder("LICENSE", "LICENSE.md", "LICENCE", "inst/LICENSE"),
+		Writer:    w,
+	}
+}
+
+// CitationExtractor extracts the CITATION file of source packages from `inst/CITATION`, and
+// of binary packages from `CITATION`.
+func CitationExtractor(w io.Writer) *Extractor {
+	return &Extractor{
+		Name:      ExtractCitation,
+		Pattern:   regexp.MustCompile(`^[^/]+/(inst/)?CITATION$`),
+		Preferred: PreferOrder("inst/CITATION", "CITATION"),
+		Writer:    w,
+	}
+}
+
+// VignetteIndexExtractor extracts the vignette index of source packages from
+// `build/vignette.rds`, and of binary packages from `Meta/vignette.rds`.
+func VignetteIndexExtractor(w io.Writer) *Extractor {
+	return &Extractor{
+		Name:      ExtractVignetteIndex,
+		Pattern:   regexp.MustCompile(`^[^/]+/(build|Meta)/vignette\.rds$`),
+		Preferred: PreferOrder("build/vignette.rds", "Meta/vignette.rds"),
+		Writer:    w,
+	}
+}
+
+// DocListExtractor lists the files in the `inst/doc` directory of source packages, and in
+// the `doc` directory of binary packages.
+func DocListExtractor(w io.Writer) *Extractor {
+	return &Extractor{
+		Name:    ExtractDocs,
+		Pattern: regexp.MustCompile(`^[^/]+/(inst/)?doc/.+$`),
+		List:    true,
+		Writer:  w,
+	}
+}
+
+// readmeExtractors returns the extractors for `RewriteWithReadme`, which only extracts the
+// README when `wReadme` is not nil.
+func readmeExtractors(wReadme io.Writer) []*Extractor {
+	if wReadme == nil {
+		return nil
+	}
+	return []*Extractor{ReadmeExtractor(wReadme)}
+}
+
+// readmeMarkdown returns true if the README at `name` is a markdown file.
+func readmeMarkdown(name string) bool {
+	return strings.ToLower(path.Base(name)) == "readme.md"
+}
+
+// PreferOrder returns a `Extractor.Preferred` function that prefers candidates in the order
+// of `paths`, which are relative to the package directory. Other candidates come last.
+func PreferOrder(paths ...string) func(oldPath, newPath string) bool {
+	rank := func(p string) int {
+		// Drop the package directory
+		if i := strings.Index(p, "/"); i >= 0 {
+			p = p[i+1:]
+		}
+		for i, preferred := range paths {
+			if p == preferred {
+				return i
+			}
+		}
+		return len(paths)
+	}
+	return func(oldPath, newPath string) bool {
+		a, b := rank(oldPath), rank(newPath)
+		if a != b {
+			return b < a
+		}
+		return preferShallow(oldPath, newPath)
+	}
+}
+
+// preferShallow prefers the candidate closest to the root of the archive.
+func preferShallow(oldPath, newPath string) bool {
+	return strings.Count(newPath, "/") < strings.Count(oldPath, "/")
+}
+
+// checkExtractors returns an error when `extractors` cannot be used together.
+func checkExtractors(extractors []*Extractor) error {
+	names := make(map[string]bool)
+	for _, e := range extractors {
+		switch {
+		case e.Name == "":
+			return errors.New("extractors must have a name")
+		case names[e.Name]:
+			return fmt.Errorf("duplicate extractor '%s'", e.Name)
+		case e.Pattern == nil:
+			return fmt.Errorf("extractor '%s' has no pattern", e.Name)
+		case e.Writer == nil:
+			return fmt.Errorf("extractor '%s' has no writer", e.Name)
+		}
+		names[e.Name] = true
+	}
+	return nil
+}
+
+// extraction tracks the preferred candidate of an Extractor while an archive is read.
+type extraction struct {
+	*Extractor
+	path  string
+	found bool
+	// buffer holds the contents of the preferred candidate, or the paths of every candidate
+	// for List extractors.
+	buffer bytes.Buffer
+}
+
+// newExtractions returns the extractions for `extractors`.
+func newExtractions(extractors []*Extractor) ([]*extraction, error) {
+	if err := checkExtractors(extractors); err != nil {
+		return nil, err
+	}
+	extractions := make([]*extraction, len(extractors))
+	for i, e := range extractors {
+		extractions[i] = &extraction{Extractor: e}
+	}
+	return extractions, nil
+}
+
+// consider records the candidate `name`. It returns true when the contents of the entry
+// must be written to the buffer, which is then reset.
+func (e *extraction) consider(name string) bool {
+	if e.List {
+		e.found = true
+		e.buffer.WriteString(name + "\n")
+		return false
+	}
+	preferred := e.Preferred
+	if preferred == nil {
+		preferred = preferShallow
+	}
+	if e.found && !preferred(e.path, name) {
+		return false
+	}
+	e.path = name
+	e.found = true
+	e.buffer.Reset()
+	return true
+}
+
+// extractionWriters returns the buffers that the contents of the entry `name` must be
+// written to, and whether it is a candidate for the README.
+func extractionWriters(extractions []*extraction, name string) (writers []io.Writer, readme bool) {
+	for _, e := range extractions {
+		if !e.Pattern.MatchString(name) {
+			continue
+		}
+		readme = readme || e.Name == ExtractReadme
+		if e.consider(name) {
+			writers = append(writers, &e.buffer)
+		}
+	}
+	return
+}
+
+// writeExtractions writes the extracted files to their writers, and returns the paths of
+// the extracted entries for `Results.Extracted`, and whether the README is markdown.
+func writeExtractions(extractions []*extraction) (map[string]string, bool, error) {
+	var extracted map[string]string
+	var markdown bool
+	for _, e := range extractions {
+		if !e.found {
+			continue
+		}
+		if extracted == nil {
+			extracted = make(map[string]string)
+		}
+		extracted[e.Name] = e.path
+		if e.Name == ExtractReadme {
+			markdown = readmeMarkdown(e.path)
+		}
+		if e.buffer.Len() == 0 {
+			continue
+		}
+		if _, err := io.Copy(e.Writer, &e.buffer); err != nil {
+			return nil, false, fmt.Errorf("error writing %s: %w", e.Name, err)
+		}
+	}
+	return extracted, markdown, nil
+}
@@ -0,0 +1,145 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package archive
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+func TestExtractSuite(t *testing.T) {
+	suite.Run(t, &ExtractSuite{})
+}
+
+type ExtractSuite struct {
+	suite.Suite
+}
+
+func (s *ExtractSuite) TestPreferOrder() {
+	preferred := PreferOrder("NEWS.md", "NEWS")
+	s.Require().True(preferred("DT/NEWS", "DT/NEWS.md"))
+	s.Require().False(preferred("DT/NEWS.md", "DT/NEWS"))
+	s.Require().True(preferred("DT/inst/NEWS.Rd", "DT/NEWS"))
+
+	// Other candidates prefer the one closest to the root
+	s.Require().True(preferred("DT/inst/NEWS.Rd", "DT/NEWS.Rd"))
+	s.Require().False(preferred("DT/NEWS.Rd", "DT/inst/NEWS.Rd"))
+	s.Require().False(preferred("DT/NEWS.Rd", "DT/NEWS.txt"))
+
+	// The NEWS extractor prefers the source `inst/NEWS.Rd` over the installed `NEWS.Rd`
+	news := NewsExtractor(nil)
+	s.Require().True(news.Preferred("DT/NEWS.Rd", "DT/inst/NEWS.Rd"))
+	s.Require().True(news.Preferred("DT/inst/NEWS", "DT/NEWS.Rd"))
+	s.Require().True(news.Pattern.MatchString("DT/NEWS.Rd"))
+}
+
+func (s *ExtractSuite) TestCheckExtractors() {
+	var b bytes.Buffer
+	for _, test := range []struct {
+		extractors []*Extractor
+		err        string
+	}{
+		{[]*Extractor{{Pattern: readmeRE, Writer: &b}}, "extractors must have a name"},
+		{[]*Extractor{NewsExtractor(&b), NewsExtractor(&b)}, "duplicate extractor 'NEWS'"},
+		{[]*Extractor{{Name: "a", Writer: &b}}, "extractor 'a' has no pattern"},
+		{[]*Extractor{NewsExtractor(nil)}, "extractor 'NEWS' has no writer"},
+	} {
+		s.Require().EqualError(checkExtractors(test.extractors), test.err)
+	}
+
+	a := NewRPackageArchive(256, 6, RewriteOptions{})
+	f, err := os.Open("../testdata/DT_0.4.tar.gz")
+	s.Require().Nil(err)
+	defer f.Close()
+	_, err = a.RewriteWithExtractors(f, io.Discard, []*Extractor{NewsExtractor(nil)})
+	s.Require().EqualError(err, "extractor 'NEWS' has no writer")
+}
+
+func (s *ExtractSuite) TestRewriteWithExtractors() {
+	a := NewRPackageArchive(256, 6, RewriteOptions{})
+	f, err := os.Open("../testdata/DT_0.4.tar.gz")
+	s.Require().Nil(err)
+	defer f.Close()
+
+	var readme, news, license, citation, vignettes, docs bytes.Buffer
+	var b bytes.Buffer
+	results, err := a.RewriteWithExtractors(f, &b, []*Extractor{
+		ReadmeExtractor(&readme),
+		NewsExtractor(&news),
+		LicenseExtractor(&license),
+		CitationExtractor(&citation),
+		VignetteIndexExtractor(&vignettes),
+		DocListExtractor(&docs),
+	})
+	s.Require().Nil(err)
+	s.Require().Equal(map[string]string{
+		ExtractReadme:        "DT/README.md",
+		ExtractNews:          "DT/NEWS.md",
+		ExtractLicense:       "DT/LICENSE",
+		ExtractVignetteIndex: "DT/build/vignette.rds",
+		ExtractDocs:          "",
+	}, results.Extracted)
+	s.Require().True(results.ReadmeMarkdown)
+	s.Require().True(bytes.HasPrefix(news.Bytes(), []byte("# CHANGES IN DT VERSION")))
+	s.Require().NotZero(license.Len())
+	s.Require().Zero(citation.Len())
+	s.Require().NotZero(vignettes.Len())
+	s.Require().Equal("DT/inst/doc/DT.Rmd\nDT/inst/doc/DT.html\n", docs.String())
+
+	// The extracted files match those of the rewritten package
+	var rewrittenNews bytes.Buffer
+	extracted, err := a.Extract(&b, []*Extractor{NewsExtractor(&rewrittenNews)})
+	s.Require().Nil(err)
+	s.Require().Equal(map[string]string{ExtractNews: "DT/NEWS.md"}, extracted)
+	s.Require().Equal(news.String(), rewrittenNews.String())
+}
+
+func (s *ExtractSuite) TestRewriteWithExtractorsBinary() {
+	a := NewRPackageArchive(256, 6, RewriteOptions{})
+	f, err := os.Open("../testdata/binaries/DT_0.23.tar.gz")
+	s.Require().Nil(err)
+	defer f.Close()
+
+	// Binaries install `inst/NEWS.Rd` in the package directory
+	var news bytes.Buffer
+	results, err := a.RewriteWithExtractors(f, io.Discard, []*Extractor{NewsExtractor(&news)})
+	s.Require().Nil(err)
+	s.Require().Equal("DT/NEWS.Rd", results.Extracted[ExtractNews])
+	s.Require().Contains(news.String(), `\section{`)
+}
+
+func (s *ExtractSuite) TestRewriteWithExtractorsZip() {
+	a := NewRPackageZipArchive(256, RewriteOptions{})
+	f, err := os.Open("../testdata/binaries/bindrcpp_0.2.2.zip")
+	s.Require().Nil(err)
+	defer f.Close()
+
+	var news, license, custom bytes.Buffer
+	var b bytes.Buffer
+	results, err := a.RewriteWithExtractors(f, &b, []*Extractor{
+		NewsExtractor(&news),
+		LicenseExtractor(&license),
+		{Name: "R", Pattern: regexp.MustCompile(`^bindrcpp/R/bindrcpp$`), Writer: &custom},
+	})
+	s.Require().Nil(err)
+	s.Require().Equal(map[string]string{
+		ExtractNews:    "bindrcpp/NEWS.md",
+		ExtractLicense: "bindrcpp/LICENSE",
+		"R":            "bindrcpp/R/bindrcpp",
+	}, results.Extracted)
+	s.Require().False(results.ReadmeMarkdown)
+	s.Require().Equal(1702, news.Len())
+	s.Require().Equal(37, license.Len())
+	s.Require().NotZero(custom.Len())
+
+	// The extracted files match those of the rewritten package
+	var rewrittenNews bytes.Buffer
+	extracted, err := a.Extract(&b, []*Extractor{NewsExtractor(&rewrittenNews)})
+	s.Require().Nil(err)
+	s.Require().Equal(map[string]string{ExtractNews: "bindrcpp/NEWS.md"}, extracted)
+	s.Require().Equal(news.String(), rewrittenNews.String())
+}
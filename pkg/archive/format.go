@@ -0,0 +1,250 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Format identifies the container and compression of a package archive.
+type Format string
+
+const (
+	FormatGzip  Format = "gzip"
+	FormatZip   Format = "zip"
+	FormatTar   Format = "tar"
+	FormatBzip2 Format = "bzip2"
+	FormatXz    Format = "xz"
+	FormatZstd  Format = "zstd"
+)
+
+// formatExtensions are the file extensions of the formats that packages are written in.
+var formatExtensions = map[Format]string{
+	FormatGzip: ".tar.gz",
+	FormatXz:   ".tar.xz",
+	FormatZstd: ".tar.zst",
+	FormatTar:  ".tar",
+	FormatZip:  ".zip",
+}
+
+// Extension returns the file extension of packages written in the format, such as ".tar.gz".
+// Formats that packages are not written in, or no format at all, use the gzip extension.
+func (f Format) Extension() string {
+	if ext, ok := formatExtensions[f]; ok {
+		return ext
+	}
+	return formatExtensions[FormatGzip]
+}
+
+// formatHeaderSize is the number of leading bytes needed to detect a format. A tar
+// header block is the largest signature we check.
+const formatHeaderSize = 512
+
+var (
+	magicGzip  = []byte{0x1f, 0x8b}
+	magicZip   = []byte("PK\x03\x04")
+	magicBzip2 = []byte("BZh")
+	magicXz    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	magicZstd  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// UnrecognizedFormatError is returned when the leading bytes of an archive do not
+// match any supported format.
+type UnrecognizedFormatError struct {
+	// Header holds up to the first 16 bytes of the input.
+	Header []byte
+}
+
+func (e *UnrecognizedFormatError) Error() string {
+	return fmt.Sprintf("unrecognized archive format with leading bytes %x", e.Header)
+}
+
+// UnsupportedFormatError is returned when an archive is in a recognized format that
+// cannot be read by the archive type it was given to.
+type UnsupportedFormatError struct {
+	Format Format
+}
+
+func (e *UnsupportedFormatError) Error() string {
+	return fmt.Sprintf("unsupported archive format %s", e.Format)
+}
+
+// DetectFormat sniffs the format of the archive read from `r` using its leading bytes.
+// It returns a reader that must be used in place of `r`. Seekable readers such as
+// `*os.File` are rewound and returned as-is, so ZIP archives can still be read in
+// place; other readers are wrapped so that the sniffed bytes are read again.
+func DetectFormat(r io.Reader) (Format, io.Reader, error) {
+	if rs, ok := r.(io.ReadSeeker); ok {
+		if pos, err := rs.Seek(0, io.SeekCurrent); err == nil {
+			header := make([]byte, formatHeaderSize)
+			n, err := io.ReadFull(rs, header)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return "", nil, fmt.Errorf("error reading archive header: %s", err)
+			}
+			if _, err = rs.Seek(pos, io.SeekStart); err != nil {
+				return "", nil, fmt.Errorf("error rewinding archive: %s", err)
+			}
+			format, err := detectFormat(header[:n])
+			return format, r, err
+		}
+	}
+
+	br := bufio.NewReaderSize(r, formatHeaderSize)
+	header, err := br.Peek(formatHeaderSize)
+	if err != nil && err != io.EOF {
+		return "", nil, fmt.Errorf("error reading archive header: %s", err)
+	}
+	format, err := detectFormat(header)
+	return format, br, err
+}
+
+func detectFormat(header []byte) (Format, error) {
+	switch {
+	case bytes.HasPrefix(header, magicGzip):
+		return FormatGzip, nil
+	case bytes.HasPrefix(header, magicZip):
+		return FormatZip, nil
+	case bytes.HasPrefix(header, magicBzip2):
+		return FormatBzip2, nil
+	case bytes.HasPrefix(header, magicXz):
+		return FormatXz, nil
+	case bytes.HasPrefix(header, magicZstd):
+		return FormatZstd, nil
+	case isTarHeader(header):
+		return FormatTar, nil
+	}
+	if len(header) > 16 {
+		header = header[:16]
+	}
+	return "", &UnrecognizedFormatError{Header: bytes.Clone(header)}
+}
+
+// isTarHeader validates the checksum of the first tar header block. This recognizes
+// both POSIX (ustar) and older V7 archives, which have no magic value.
+func isTarHeader(header []byte) bool {
+	if len(header) < formatHeaderSize {
+		return false
+	}
+	// The checksum is an octal number terminated by NUL and/or space.
+	field := string(bytes.Trim(header[148:156], " \x00"))
+	expected, err := strconv.ParseInt(field, 8, 64)
+	if err != nil {
+		return false
+	}
+	// The checksum is the sum of the header bytes, with the checksum field itself
+	// counted as spaces.
+	var sum int64
+	for i, b := range header[:formatHeaderSize] {
+		if i >= 148 && i < 156 {
+			b = ' '
+		}
+		sum += int64(b)
+	}
+	return sum == expected
+}
+
+// decompress detects the format of the tarball read from `r` and returns a reader for
+// the uncompressed tar stream along with the detected format.
+func decompress(r io.Reader) (io.ReadCloser, Format, error) {
+	format, r, err := DetectFormat(r)
+	if err != nil {
+		return nil, "", err
+	}
+	var dr io.ReadCloser
+	switch format {
+	case FormatGzip:
+		dr, err = gzip.NewReader(r)
+	case FormatTar:
+		dr = io.NopCloser(r)
+	case FormatBzip2:
+		dr = io.NopCloser(bzip2.NewReader(r))
+	case FormatXz:
+		var xr *xz.Reader
+		if xr, err = xz.NewReader(r); err == nil {
+			dr = io.NopCloser(xr)
+		}
+	case FormatZstd:
+		var zr *zstd.Decoder
+		if zr, err = zstd.NewReader(r); err == nil {
+			dr = zr.IOReadCloser()
+		}
+	default:
+		return nil, "", &UnsupportedFormatError{Format: format}
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("error creating %s reader: %s", format, err)
+	}
+	return dr, format, nil
+}
+
+const (
+	// defaultXzLevel and defaultZstdLevel match the defaults of the `xz` and `zstd` tools
+	defaultXzLevel   = 6
+	defaultZstdLevel = 3
+)
+
+// xzDictCaps maps xz compression levels to dictionary sizes, following the presets of
+// the `xz` tool.
+var xzDictCaps = []int{
+	256 << 10, 1 << 20, 2 << 20, 4 << 20, 4 << 20, 8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20,
+}
+
+// outputFormat returns the format of the tarball written for an input in `format`.
+func (o RewriteOptions) outputFormat(format Format) Format {
+	if o.Output == OutputKeepInput {
+		switch format {
+		case FormatTar, FormatXz, FormatZstd:
+			return format
+		}
+	}
+	return FormatGzip
+}
+
+// compress returns a writer that compresses a tar stream to `w` in `format`. `gzipLevel` is
+// used for gzip unless `CompressionLevels` sets another level.
+func (o RewriteOptions) compress(w io.Writer, format Format, gzipLevel int) (io.WriteCloser, error) {
+	level, ok := o.CompressionLevels[format]
+	switch format {
+	case FormatGzip:
+		if !ok {
+			level = gzipLevel
+		}
+		gw, err := gzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, err
+		}
+		return gw, nil
+	case FormatTar:
+		return nopWriteCloser{w}, nil
+	case FormatXz:
+		if !ok {
+			level = defaultXzLevel
+		}
+		if level < 0 || level >= len(xzDictCaps) {
+			return nil, fmt.Errorf("invalid xz compression level %d", level)
+		}
+		return xz.WriterConfig{DictCap: xzDictCaps[level]}.NewWriter(w)
+	case FormatZstd:
+		if !ok {
+			level = defaultZstdLevel
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	}
+	return nil, &UnsupportedFormatError{Format: format}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,221 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+func TestFormatSuite(t *testing.T) {
+	suite.Run(t, &FormatSuite{})
+}
+
+type FormatSuite struct {
+	suite.Suite
+}
+
+// plainTar returns the uncompressed tarball from the gzipped `path`.
+func plainTar(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(gr)
+}
+
+func (s *FormatSuite) TestDetectFormat() {
+	data, err := plainTar("../testdata/DT_0.4.tar.gz")
+	s.Require().Nil(err)
+
+	// A V7 tar header has no magic value, so only the checksum identifies it.
+	v7 := bytes.Clone(data[:512])
+	copy(v7[257:265], make([]byte, 8))
+	copy(v7[148:156], "        ")
+	var sum int64
+	for _, b := range v7 {
+		sum += int64(b)
+	}
+	copy(v7[148:156], fmt.Sprintf("%06o\x00 ", sum))
+
+	for _, tc := range []struct {
+		name     string
+		data     []byte
+		expected Format
+	}{
+		{"gzip", []byte{0x1f, 0x8b, 0x08, 0x00}, FormatGzip},
+		{"zip", []byte("PK\x03\x04\x14\x00"), FormatZip},
+		{"bzip2", []byte("BZh91AY&SY"), FormatBzip2},
+		{"xz", []byte{0xfd, '7', 'z', 'X', 'Z', 0x00, 0x00}, FormatXz},
+		{"zstd", []byte{0x28, 0xb5, 0x2f, 0xfd, 0x04}, FormatZstd},
+		{"tar", data, FormatTar},
+		{"v7 tar", v7, FormatTar},
+	} {
+		// Non-seekable readers replay the sniffed bytes
+		format, r, err := DetectFormat(io.MultiReader(bytes.NewReader(tc.data)))
+		s.Require().Nil(err, tc.name)
+		s.Require().Equal(tc.expected, format, tc.name)
+		replayed, err := io.ReadAll(r)
+		s.Require().Nil(err)
+		s.Require().Equal(tc.data, replayed, tc.name)
+
+		// Seekable readers are rewound and returned as-is
+		br := bytes.NewReader(tc.data)
+		format, r, err = DetectFormat(br)
+		s.Require().Nil(err, tc.name)
+		s.Require().Equal(tc.expected, format, tc.name)
+		s.Require().Equal(br, r)
+		s.Require().Equal(int64(len(tc.data)), int64(br.Len()), tc.name)
+	}
+}
+
+func (s *FormatSuite) TestDetectFormatFile() {
+	f, err := os.Open("../testdata/binaries/bindrcpp_0.2.2.zip")
+	s.Require().Nil(err)
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+
+	format, r, err := DetectFormat(f)
+	s.Require().Nil(err)
+	s.Require().Equal(FormatZip, format)
+	s.Require().Equal(f, r)
+	pos, err := f.Seek(0, io.SeekCurrent)
+	s.Require().Nil(err)
+	s.Require().Equal(int64(0), pos)
+}
+
+func (s *FormatSuite) TestDetectFormatUnrecognized() {
+	for _, data := range []string{"", "this is a test file\nwith no archive content\n."} {
+		_, _, err := DetectFormat(bytes.NewBufferString(data))
+		var formatErr *UnrecognizedFormatError
+		s.Require().True(errors.As(err, &formatErr))
+	}
+
+	_, _, err := DetectFormat(bytes.NewBufferString("not an archive"))
+	s.Require().EqualError(err, "unrecognized archive format with leading bytes 6e6f7420616e2061726368697665")
+}
+
+func (s *FormatSuite) TestExtension() {
+	s.Require().Equal(".tar.gz", FormatGzip.Extension())
+	s.Require().Equal(".tar.xz", FormatXz.Extension())
+	s.Require().Equal(".tar.zst", FormatZstd.Extension())
+	s.Require().Equal(".tar", FormatTar.Extension())
+	s.Require().Equal(".zip", FormatZip.Extension())
+	s.Require().Equal(".tar.gz", FormatBzip2.Extension())
+	s.Require().Equal(".tar.gz", Format("").Extension())
+}
+
+// readTarFile returns the contents of the file called `name` in the compressed tarball `data`.
+func readTarFile(data []byte, name string) (string, error) {
+	dr, _, err := decompress(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	defer func(dr io.ReadCloser) {
+		_ = dr.Close()
+	}(dr)
+	tr := tar.NewReader(dr)
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			return "", err
+		}
+		if header.Name == name {
+			b, err := io.ReadAll(tr)
+			return string(b), err
+		}
+	}
+}
+
+func (s *FormatSuite) TestRewriteCompressed() {
+	data, err := plainTar("../testdata/readmetest_0.2.0.tar.gz")
+	s.Require().Nil(err)
+	gzipped, err := os.ReadFile("../testdata/readmetest_0.2.0.tar.gz")
+	s.Require().Nil(err)
+	bzipped, err := os.ReadFile("../testdata/readmetest_0.2.0.tar.bz2")
+	s.Require().Nil(err)
+
+	// Compress the tarball with the codecs that can write
+	inputs := map[Format][]byte{
+		FormatTar:   data,
+		FormatGzip:  gzipped,
+		FormatBzip2: bzipped,
+	}
+	for _, format := range []Format{FormatXz, FormatZstd} {
+		var b bytes.Buffer
+		cw, err := RewriteOptions{}.compress(&b, format, 6)
+		s.Require().Nil(err)
+		_, err = cw.Write(data)
+		s.Require().Nil(err)
+		s.Require().Nil(cw.Close())
+		inputs[format] = b.Bytes()
+	}
+
+	for format, input := range inputs {
+		for _, output := range []OutputCompression{OutputGzip, OutputKeepInput} {
+			a := NewRPackageArchive(256, 6, RewriteOptions{Output: output})
+			var b bytes.Buffer
+			var bReadme bytes.Buffer
+			results, err := a.RewriteWithReadme(bytes.NewReader(input), &b, &bReadme)
+			s.Require().Nil(err, format)
+			s.Require().Equal(format, results.Format)
+			s.Require().Equal(fmt.Sprintf("%x", sha256.Sum256(input)), results.OriginalChecksum)
+			s.Require().Contains(results.Description, "\nRepository: RSPM\n")
+			s.Require().Equal("Hi, I'm the correct readme!", bReadme.String())
+
+			// bzip2 input is written with gzip even when the input format is kept
+			expected := FormatGzip
+			if output == OutputKeepInput && format != FormatBzip2 {
+				expected = format
+			}
+			s.Require().Equal(expected, results.RewrittenFormat, format)
+			detected, _, err := DetectFormat(bytes.NewReader(b.Bytes()))
+			s.Require().Nil(err)
+			s.Require().Equal(expected, detected, format)
+
+			desc, err := readTarFile(b.Bytes(), "readmetest/DESCRIPTION")
+			s.Require().Nil(err)
+			s.Require().Equal(results.Description, desc)
+		}
+	}
+}
+
+func (s *FormatSuite) TestCompressionLevels() {
+	data, err := os.ReadFile("../testdata/DT_0.4.tar.gz")
+	s.Require().Nil(err)
+
+	sizes := make(map[int]int64)
+	for _, level := range []int{1, 9} {
+		opts := RewriteOptions{
+			Output:            OutputKeepInput,
+			CompressionLevels: CompressionLevels{FormatGzip: level},
+		}
+		// The gzip level given to the constructor is overridden
+		a := NewRPackageArchive(256, 6, opts)
+		var b bytes.Buffer
+		results, err := a.RewriteBinary(bytes.NewReader(data), &b)
+		s.Require().Nil(err)
+		sizes[level] = results.RewrittenSize
+	}
+	s.Require().Less(sizes[9], sizes[1])
+
+	var b bytes.Buffer
+	_, err = RewriteOptions{CompressionLevels: CompressionLevels{FormatXz: 10}}.compress(&b, FormatXz, 6)
+	s.Require().EqualError(err, "invalid xz compression level 10")
+}
@@ -0,0 +1,150 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"hash"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+// MD5Verification reports the differences between the MD5 file of a package and the
+// files in its archive. Paths are relative to the directory of the MD5 file, and the
+// checksums are those of the original package.
+type MD5Verification struct {
+	// Mismatched lists the files whose checksum differs from the MD5 file.
+	Mismatched []string
+	// Missing lists the files in the MD5 file that are not in the archive.
+	Missing []string
+	// Extra lists the files in the archive that are not in the MD5 file.
+	Extra []string
+}
+
+// OK returns true when the MD5 file matches the archive.
+func (v *MD5Verification) OK() bool {
+	return len(v.Mismatched) == 0 && len(v.Missing) == 0 && len(v.Extra) == 0
+}
+
+// md5Manifest computes the MD5 checksums of the files in an archive while it is
+// rewritten, so that the MD5 file can be verified and regenerated.
+type md5Manifest struct {
+	enabled bool
+	sums    map[string]hash.Hash
+}
+
+func newMD5Manifest(enabled bool) *md5Manifest {
+	return &md5Manifest{enabled: enabled, sums: make(map[string]hash.Hash)}
+}
+
+// tee returns a writer that writes to `w` while computing the checksum of the file `name`.
+func (m *md5Manifest) tee(name string, w io.Writer) io.Writer {
+	if !m.enabled {
+		return w
+	}
+	h := md5.New()
+	m.sums[name] = h
+	return io.MultiWriter(w, h)
+}
+
+// files returns the checksums of the files under `root`, keyed by their path relative to
+// `root`. The MD5 file itself is excluded.
+func (m *md5Manifest) files(root string) map[string]string {
+	files := make(map[string]string)
+	for name, h := range m.sums {
+		rel := strings.TrimPrefix(path.Clean(name), root+"/")
+		if root != "." && rel == path.Clean(name) {
+			continue
+		}
+		if rel != "MD5" {
+			files[rel] = fmt.Sprintf("%x", h.Sum(nil))
+		}
+	}
+	return files
+}
+
+// rewriteMD5 rewrites the authoritative MD5 file at `md5Path`. The `*DESCRIPTION` line is
+// updated with `descMd5`, the checksum of the rewritten DESCRIPTION at `descPath`. When
+// `RewriteOptions.VerifyMD5` is set the original entries are verified, and when
+// `RewriteOptions.RegenerateMD5` is set the file is replaced by the checksums of every file
+// in the archive.
+func (o RewriteOptions) rewriteMD5(m *md5Manifest, md5Path, descPath, descMd5 string, contents []byte) ([]byte, *MD5Verification) {
+	root := path.Dir(path.Clean(md5Path))
+	var files map[string]string
+	if m.enabled {
+		files = m.files(root)
+	}
+
+	var verification *MD5Verification
+	if o.VerifyMD5 {
+		verification = verifyMD5(files, contents)
+	}
+
+	md5Buffer := bytes.NewBuffer([]byte{})
+	if o.RegenerateMD5 {
+		if rel := strings.TrimPrefix(path.Clean(descPath), root+"/"); descMd5 != "" && files[rel] != "" {
+			files[rel] = descMd5
+		}
+		names := make([]string, 0, len(files))
+		for name := range files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			md5Buffer.WriteString(files[name] + " *" + name + "\n")
+		}
+		return md5Buffer.Bytes(), verification
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if bytes.HasSuffix(line, []byte(" *DESCRIPTION")) {
+			if descMd5 == "" {
+				o.logger().Warn("no DESCRIPTION checksum was generated for the MD5 file", "path", md5Path)
+			} else {
+				line = []byte(descMd5 + " *DESCRIPTION")
+			}
+		}
+		md5Buffer.Write(line)
+		md5Buffer.Write([]byte("\n"))
+	}
+	return md5Buffer.Bytes(), verification
+}
+
+// verifyMD5 compares the MD5 file `contents` with the checksums of the archive `files`.
+func verifyMD5(files map[string]string, contents []byte) *MD5Verification {
+	verification := &MD5Verification{}
+	listed := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		sum, name, ok := strings.Cut(line, " ")
+		if !ok {
+			continue
+		}
+		// Binary mode entries are marked with `*`
+		name = strings.TrimPrefix(strings.TrimLeft(name, " "), "*")
+		listed[name] = true
+		actual, found := files[name]
+		switch {
+		case !found:
+			verification.Missing = append(verification.Missing, name)
+		case !strings.EqualFold(actual, sum):
+			verification.Mismatched = append(verification.Mismatched, name)
+		}
+	}
+	for name := range files {
+		if !listed[name] {
+			verification.Extra = append(verification.Extra, name)
+		}
+	}
+	sort.Strings(verification.Mismatched)
+	sort.Strings(verification.Missing)
+	sort.Strings(verification.Extra)
+	return verification
+}
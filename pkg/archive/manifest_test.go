@@ -0,0 +1,166 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io/fs"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+func TestManifestSuite(t *testing.T) {
+	suite.Run(t, &ManifestSuite{})
+}
+
+type ManifestSuite struct {
+	suite.Suite
+}
+
+func (s *ManifestSuite) rewrite(path string, opts RewriteOptions) (*Results, []byte) {
+	f, err := os.Open(path)
+	s.Require().Nil(err)
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+
+	var b bytes.Buffer
+	var results *Results
+	if format, r, _ := DetectFormat(f); format == FormatZip {
+		results, err = NewRPackageZipArchive(256, opts).RewriteBinary(r, &b)
+	} else {
+		results, err = NewRPackageArchive(256, 6, opts).RewriteBinary(r, &b)
+	}
+	s.Require().Nil(err)
+	return results, b.Bytes()
+}
+
+func (s *ManifestSuite) TestVerifyMD5() {
+	// Not verified by default
+	results, _ := s.rewrite("../testdata/DT_0.4.tar.gz", RewriteOptions{})
+	s.Require().Nil(results.MD5)
+
+	results, _ = s.rewrite("../testdata/DT_0.4.tar.gz", RewriteOptions{VerifyMD5: true})
+	s.Require().True(results.MD5.OK())
+
+	// The checksums of nested MD5 files are verified too
+	results, _ = s.rewrite("../testdata/special/SecondMD5_2.2.2.tar.gz", RewriteOptions{VerifyMD5: true})
+	s.Require().Equal(&MD5Verification{
+		Mismatched: []string{"tests/testthat/fixtures/MD5"},
+		Extra:      []string{"._DESCRIPTION"},
+	}, results.MD5)
+	s.Require().False(results.MD5.OK())
+
+	results, _ = s.rewrite("../testdata/binaries/bindrcpp_0.2.2.zip", RewriteOptions{VerifyMD5: true})
+	s.Require().Equal(&MD5Verification{Mismatched: []string{"DESCRIPTION"}}, results.MD5)
+
+	// Packages without an MD5 file are not verified
+	results, _ = s.rewrite("../testdata/binaries/bindrcpp_0.2.2.tar.gz", RewriteOptions{VerifyMD5: true})
+	s.Require().Nil(results.MD5)
+}
+
+func (s *ManifestSuite) TestVerifyMD5Tampered() {
+	file := func(name, contents string) tarEntry {
+		return tarEntry{
+			header: &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(contents))},
+			data:   []byte(contents),
+		}
+	}
+	sum := func(contents string) string {
+		return fmt.Sprintf("%x", md5.Sum([]byte(contents)))
+	}
+	manifest := sum(validateDescription) + " *DESCRIPTION\n" +
+		sum("original") + " *R/tampered.R\n" +
+		sum("ok") + " *R/ok.R\n" +
+		sum("deleted") + " *R/deleted.R\n"
+	data, err := writeTarGz([]tarEntry{
+		{header: &tar.Header{Name: "test/", Typeflag: tar.TypeDir, Mode: 0755}},
+		file("test/DESCRIPTION", validateDescription),
+		file("test/R/tampered.R", "tampered"),
+		file("test/R/ok.R", "ok"),
+		file("test/R/extra.R", "extra"),
+		file("test/MD5", manifest),
+	})
+	s.Require().Nil(err)
+
+	var b bytes.Buffer
+	results, err := NewRPackageArchive(256, 6, RewriteOptions{VerifyMD5: true}).RewriteBinary(bytes.NewReader(data), &b)
+	s.Require().Nil(err)
+	s.Require().Equal(&MD5Verification{
+		Mismatched: []string{"R/tampered.R"},
+		Missing:    []string{"R/deleted.R"},
+		Extra:      []string{"R/extra.R"},
+	}, results.MD5)
+}
+
+func (s *ManifestSuite) TestRegenerateMD5() {
+	opts := RewriteOptions{RegenerateMD5: true, VerifyMD5: true}
+	results, rewritten := s.rewrite("../testdata/special/SecondMD5_2.2.2.tar.gz", opts)
+	// The original package is verified
+	s.Require().False(results.MD5.OK())
+
+	md5File, err := StreamFileFromTarGz(bytes.NewReader(rewritten), "MD5")
+	s.Require().Nil(err)
+	var m bytes.Buffer
+	_, _ = m.ReadFrom(md5File)
+	s.Require().Equal("98dd247622fa357f3448698d9037004c *._DESCRIPTION\n"+
+		fmt.Sprintf("%x", md5.Sum([]byte(results.Description)))+" *DESCRIPTION\n"+
+		"67dae3f768de2008f9b522f0f3f94752 *R/sample.R\n"+
+		"a0ca0f44ffdab83bba83b120f40b81d3 *tests/testthat.R\n"+
+		"3a9f111635908dfc4c940cddd49cffb9 *tests/testthat/fixtures/MD5\n"+
+		"e6e6dcc3cdced9480ee4f21ba251fac4 *tests/testthat/test-SecondMD5.R\n", m.String())
+
+	// The regenerated MD5 file matches the rewritten package
+	var b bytes.Buffer
+	results, err = NewRPackageArchive(256, 6, RewriteOptions{VerifyMD5: true}).RewriteBinary(bytes.NewReader(rewritten), &b)
+	s.Require().Nil(err)
+	s.Require().True(results.MD5.OK(), "%+v", results.MD5)
+}
+
+func (s *ManifestSuite) TestRegenerateMD5Zip() {
+	opts := RewriteOptions{RegenerateMD5: true}
+	_, rewritten := s.rewrite("../testdata/binaries/bindrcpp_0.2.2.zip", opts)
+
+	var b bytes.Buffer
+	results, err := NewRPackageZipArchive(256, RewriteOptions{VerifyMD5: true}).RewriteBinaryAt(bytes.NewReader(rewritten), int64(len(rewritten)), &b)
+	s.Require().Nil(err)
+	s.Require().True(results.MD5.OK(), "%+v", results.MD5)
+}
+
+func (s *ManifestSuite) TestVerifyMD5ZipSymlink() {
+	description := "Package: test\nVersion: 1.0\n"
+	code := "f <- function() 1\n"
+	md5File := fmt.Sprintf("%x *DESCRIPTION\n%x *R/file.R\n", md5.Sum([]byte(description)), md5.Sum([]byte(code)))
+
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	for _, f := range []struct {
+		name     string
+		mode     fs.FileMode
+		contents string
+	}{
+		{"test/DESCRIPTION", 0644, description},
+		{"test/R/file.R", 0644, code},
+		{"test/R/link.R", fs.ModeSymlink | 0777, "file.R"},
+		{"test/MD5", 0644, md5File},
+	} {
+		header := &zip.FileHeader{Name: f.name, Method: zip.Deflate}
+		header.SetMode(f.mode)
+		w, err := zw.CreateHeader(header)
+		s.Require().Nil(err)
+		_, err = w.Write([]byte(f.contents))
+		s.Require().Nil(err)
+	}
+	s.Require().Nil(zw.Close())
+
+	// Like in tarballs, the symlink target is not checksummed as a file
+	var rewritten bytes.Buffer
+	results, err := NewRPackageZipArchive(256, RewriteOptions{VerifyMD5: true}).RewriteBinaryAt(bytes.NewReader(b.Bytes()), int64(b.Len()), &rewritten)
+	s.Require().Nil(err)
+	s.Require().True(results.MD5.OK(), "%+v", results.MD5)
+}
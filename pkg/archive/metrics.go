@@ -0,0 +1,122 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package archive
+
+import (
+	"archive/tar"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// EntryClass groups archive entries in Metrics.
+type EntryClass string
+
+const (
+	EntryDescription EntryClass = "description"
+	EntryReadme      EntryClass = "readme"
+	EntryMD5         EntryClass = "md5"
+	EntryFile        EntryClass = "file"
+	EntryDirectory   EntryClass = "directory"
+	EntryLink        EntryClass = "link"
+	EntryOther       EntryClass = "other"
+)
+
+// EntryMetrics counts the entries of one class and their uncompressed size.
+type EntryMetrics struct {
+	Count int
+	Bytes int64
+}
+
+// Metrics records where the time went while rewriting a package. Since packages are
+// rewritten in a single stream, phases are measured where the work happens and overlap:
+// `Decompress` includes waiting for the original data, and `Copy` includes reading,
+// decompressing and compressing the copied entries.
+type Metrics struct {
+	// Total is the time taken by the whole rewrite.
+	Total time.Duration
+	// Read is the time spent reading the original package.
+	Read time.Duration
+	// Decompress is the time spent reading entries from the decompressed archive.
+	Decompress time.Duration
+	// Copy is the time spent copying entries that are not rewritten.
+	Copy time.Duration
+	// DescriptionRewrite is the time spent rewriting the DESCRIPTION file.
+	DescriptionRewrite time.Duration
+	// Compress is the time spent compressing and writing the rewritten package.
+	Compress time.Duration
+	// Entries counts the entries of the original package by class.
+	Entries map[EntryClass]EntryMetrics
+}
+
+func newMetrics() Metrics {
+	return Metrics{Entries: make(map[EntryClass]EntryMetrics)}
+}
+
+func (m *Metrics) addEntry(class EntryClass, size int64) {
+	e := m.Entries[class]
+	e.Count++
+	e.Bytes += size
+	m.Entries[class] = e
+}
+
+// entryClass classifies an entry that is copied as is by its tar type.
+func entryClass(typeflag byte) EntryClass {
+	switch typeflag {
+	case tar.TypeReg:
+		return EntryFile
+	case tar.TypeDir:
+		return EntryDirectory
+	case tar.TypeSymlink, tar.TypeLink:
+		return EntryLink
+	default:
+		return EntryOther
+	}
+}
+
+// logValue returns the metrics as log attributes.
+func (m *Metrics) logValue() slog.Value {
+	return slog.GroupValue(
+		slog.Duration("total", m.Total),
+		slog.Duration("read", m.Read),
+		slog.Duration("decompress", m.Decompress),
+		slog.Duration("copy", m.Copy),
+		slog.Duration("descriptionRewrite", m.DescriptionRewrite),
+		slog.Duration("compress", m.Compress),
+	)
+}
+
+// timedReader adds the time spent in Read to `d`.
+type timedReader struct {
+	r io.Reader
+	d *time.Duration
+}
+
+func (t *timedReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := t.r.Read(p)
+	*t.d += time.Since(start)
+	return n, err
+}
+
+// timedWriter adds the time spent in Write to `d`.
+type timedWriter struct {
+	w io.Writer
+	d *time.Duration
+}
+
+func (t *timedWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := t.w.Write(p)
+	*t.d += time.Since(start)
+	return n, err
+}
+
+// discardLogger is used when RewriteOptions.Logger is not set.
+var discardLogger = slog.New(slog.DiscardHandler)
+
+func (o RewriteOptions) logger() *slog.Logger {
+	if o.Logger == nil {
+		return discardLogger
+	}
+	return o.Logger
+}
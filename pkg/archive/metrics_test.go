@@ -0,0 +1,114 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+func TestMetricsSuite(t *testing.T) {
+	suite.Run(t, &MetricsSuite{})
+}
+
+type MetricsSuite struct {
+	suite.Suite
+}
+
+func (s *MetricsSuite) TestMetrics() {
+	file := func(name, contents string) tarEntry {
+		return tarEntry{
+			header: &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(contents))},
+			data:   []byte(contents),
+		}
+	}
+	data, err := writeTarGz([]tarEntry{
+		{header: &tar.Header{Name: "test/", Typeflag: tar.TypeDir, Mode: 0755}},
+		file("test/DESCRIPTION", validateDescription),
+		file("test/README.md", "# test"),
+		file("test/R/test.R", "test <- 1"),
+		file("test/R/other.R", "other <- 2"),
+		{header: &tar.Header{Name: "test/R/link.R", Typeflag: tar.TypeSymlink, Linkname: "test.R"}},
+		file("test/MD5", "0 *DESCRIPTION\n"),
+	})
+	s.Require().Nil(err)
+
+	var b, readme bytes.Buffer
+	results, err := NewRPackageArchive(256, 6, RewriteOptions{}).RewriteWithReadme(bytes.NewReader(data), &b, &readme)
+	s.Require().Nil(err)
+
+	m := results.Metrics
+	s.Require().Equal(map[EntryClass]EntryMetrics{
+		EntryDescription: {Count: 1, Bytes: int64(len(validateDescription))},
+		EntryReadme:      {Count: 1, Bytes: 6},
+		EntryMD5:         {Count: 1, Bytes: 15},
+		EntryFile:        {Count: 2, Bytes: 19},
+		EntryDirectory:   {Count: 1},
+		EntryLink:        {Count: 1},
+	}, m.Entries)
+	s.Require().Positive(m.Total)
+	s.Require().Positive(m.Read)
+	s.Require().Positive(m.Decompress)
+	s.Require().Positive(m.Copy)
+	s.Require().Positive(m.DescriptionRewrite)
+	s.Require().Positive(m.Compress)
+	s.Require().LessOrEqual(m.Copy, m.Total)
+}
+
+func (s *MetricsSuite) TestMetricsZip() {
+	f, err := os.Open("../testdata/binaries/readmetest_0.2.0.zip")
+	s.Require().Nil(err)
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+
+	var b, readme bytes.Buffer
+	results, err := NewRPackageZipArchive(256, RewriteOptions{}).RewriteWithReadme(f, &b, &readme)
+	s.Require().Nil(err)
+
+	m := results.Metrics
+	s.Require().Equal(EntryMetrics{Count: 1, Bytes: 500}, m.Entries[EntryDescription])
+	s.Require().Equal(3, m.Entries[EntryReadme].Count)
+	s.Require().Equal(1, m.Entries[EntryMD5].Count)
+	s.Require().Positive(m.Total)
+	s.Require().Positive(m.Read)
+	s.Require().Positive(m.Decompress)
+	s.Require().Positive(m.Compress)
+}
+
+func (s *MetricsSuite) TestLogger() {
+	// A package with an MD5 file and no DESCRIPTION
+	data, err := writeTarGz([]tarEntry{
+		{header: &tar.Header{Name: "test/MD5", Typeflag: tar.TypeReg, Mode: 0644, Size: 15}, data: []byte("0 *DESCRIPTION\n")},
+	})
+	s.Require().Nil(err)
+
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	var b bytes.Buffer
+	_, err = NewRPackageArchive(256, 6, RewriteOptions{Logger: logger}).RewriteBinary(bytes.NewReader(data), &b)
+	s.Require().Nil(err)
+
+	var records []map[string]any
+	for _, line := range bytes.Split(bytes.TrimSpace(logs.Bytes()), []byte("\n")) {
+		var record map[string]any
+		s.Require().Nil(json.Unmarshal(line, &record))
+		records = append(records, record)
+	}
+	s.Require().Len(records, 2)
+	s.Require().Equal("WARN", records[0]["level"])
+	s.Require().Equal("test/MD5", records[0]["path"])
+	s.Require().Equal("rewrote package", records[1]["msg"])
+	s.Require().Equal("gzip", records[1]["format"])
+	s.Require().Contains(records[1]["metrics"], "compress")
+
+	// Nothing is logged without a logger
+	b.Reset()
+	_, err = NewRPackageArchive(256, 6, RewriteOptions{}).RewriteBinary(bytes.NewReader(data), &b)
+	s.Require().Nil(err)
+}
@@ -0,0 +1,112 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package archive
+
+import (
+	"log/slog"
+	"time"
+)
+
+const (
+	// DefaultRepository is the `Repository` value used when RewriteOptions.Repository is empty.
+	DefaultRepository = "RSPM"
+
+	// DefaultSpoolMemoryLimit is the number of bytes of a ZIP stream held in memory when
+	// RewriteOptions.SpoolMemoryLimit is not set.
+	DefaultSpoolMemoryLimit = 32 * 1024 * 1024
+)
+
+// OutputCompression selects how rewritten tarballs are compressed.
+type OutputCompression int
+
+const (
+	// OutputGzip always writes gzipped tarballs. This is the default.
+	OutputGzip OutputCompression = iota
+	// OutputKeepInput writes tarballs with the same compression as the input. Plain tarballs
+	// are written uncompressed. bzip2 tarballs are written with gzip since no bzip2
+	// compressor is available.
+	OutputKeepInput
+)
+
+// CompressionLevels holds the compression level to use for each output format. Levels use
+// the scale of the codec's command line tool: 1-9 for gzip, 0-9 for xz, and 1-22 for zstd.
+type CompressionLevels map[Format]int
+
+// RewriteOptions configures how `RPackageArchive` and `RPackageZipArchive` rewrite packages.
+// The zero value reproduces the historical behavior of stamping `Repository: RSPM`.
+type RewriteOptions struct {
+	// Repository is the value written to the DESCRIPTION `Repository` field. Defaults to
+	// `DefaultRepository` when empty.
+	Repository string
+
+	// Transformers are applied in order to the authoritative DESCRIPTION after the
+	// `Repository` and `Encoding` fields are updated. See `SetField`, `AddField` and
+	// `DeleteField` for the common operations.
+	Transformers []DescriptionTransformer
+
+	// SpoolMemoryLimit is the number of bytes of a ZIP stream without random access that
+	// are buffered in memory before spooling to a temporary file. Defaults to
+	// `DefaultSpoolMemoryLimit` when zero.
+	SpoolMemoryLimit int64
+	// SpoolMaxSize rejects spooled ZIP streams larger than this many bytes. Zero means no limit.
+	SpoolMaxSize int64
+	// TempDir is the directory for spooled temporary files. Defaults to the system
+	// temporary directory when empty.
+	TempDir string
+
+	// Output selects the compression of rewritten tarballs. ZIP binaries are always
+	// written as ZIP archives.
+	Output OutputCompression
+	// CompressionLevels overrides the compression level for each output format. The gzip
+	// level defaults to the `gzipLevel` given to `NewRPackageArchive`, and other formats
+	// default to the codec's own default level.
+	CompressionLevels CompressionLevels
+
+	// Deterministic makes rewritten tarballs depend only on the package contents. The
+	// gzip header carries no name or timestamp, and every tar entry is written with
+	// uid/gid 0, no user or group names, no access or change times, and a modification
+	// time of `ModTime`.
+	Deterministic bool
+	// ModTime is the modification time of every entry in deterministic mode. When zero, the
+	// time is read from the `SOURCE_DATE_EPOCH` environment variable, and defaults to the
+	// Unix epoch when that is not set.
+	ModTime time.Time
+	// SortEntries writes the entries of rewritten tarballs in name order instead of the
+	// order of the original tarball. The entries are collected in a temporary file in
+	// `TempDir` while the package is read.
+	SortEntries bool
+
+	// Validation enables the safety checks in `ValidationOptions` when set. Archives that
+	// fail validation return a `*ValidationError`.
+	Validation *ValidationOptions
+
+	// VerifyMD5 checks every entry of the MD5 file against the files in the archive and
+	// reports the differences in `Results.MD5`.
+	VerifyMD5 bool
+	// RegenerateMD5 replaces the MD5 file with the checksums of every file in the rewritten
+	// archive, instead of only updating the `*DESCRIPTION` line.
+	RegenerateMD5 bool
+
+	// Digests lists the checksum algorithms to compute for the original and rewritten
+	// packages in addition to SHA256, which is always computed. They are returned in
+	// `Results.OriginalDigests` and `Results.RewrittenDigests`.
+	Digests []Digest
+
+	// Logger receives diagnostics and the metrics of each rewrite. Nothing is logged when
+	// nil.
+	Logger *slog.Logger
+}
+
+// repository returns the value for the DESCRIPTION `Repository` field.
+func (o RewriteOptions) repository() string {
+	if o.Repository == "" {
+		return DefaultRepository
+	}
+	return o.Repository
+}
+
+func (o RewriteOptions) spoolMemoryLimit() int64 {
+	if o.SpoolMemoryLimit <= 0 {
+		return DefaultSpoolMemoryLimit
+	}
+	return o.SpoolMemoryLimit
+}
@@ -0,0 +1,30 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package archive
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Support having a leading path segment (as some R packages have)
+var readmeRE = regexp.MustCompile(`^(?i)([^/]+/)?README(\.(txt|md))?$`)
+
+// A map that enumerates the preference of README names, with
+// a lower int value representing a "more preferred" file name
+var readmeMap = map[string]int{
+	"readme.md":  0,
+	"readme.txt": 1,
+	"readme":     2,
+}
+
+func PreferredReadme(oldName, newName string) bool {
+	a, ok := readmeMap[strings.ToLower(oldName)]
+	if !ok {
+		return false
+	}
+	b, ok := readmeMap[strings.ToLower(newName)]
+	if !ok {
+		return false
+	}
+	return b < a
+}
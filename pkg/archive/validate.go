@@ -0,0 +1,272 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// Violation names the validation rule that an archive broke.
+type Violation string
+
+const (
+	// ViolationPath is an entry with an absolute path or a path outside the package root.
+	ViolationPath Violation = "path"
+	// ViolationLink is a symlink that points outside its package directory, or a hardlink
+	// that points outside the package root.
+	ViolationLink Violation = "link"
+	// ViolationEntryType is an entry whose type is not allowed, such as a device file.
+	ViolationEntryType Violation = "entry type"
+	// ViolationEntries is an archive with more entries than allowed.
+	ViolationEntries Violation = "entries"
+	// ViolationSize is an archive whose uncompressed size is larger than allowed.
+	ViolationSize Violation = "size"
+	// ViolationCompressionRatio is an archive that expands more than allowed.
+	ViolationCompressionRatio Violation = "compression ratio"
+)
+
+// DefaultAllowedTypes are the tar entry types allowed when
+// ValidationOptions.AllowedTypes is empty.
+var DefaultAllowedTypes = []byte{tar.TypeReg, tar.TypeDir, tar.TypeSymlink, tar.TypeLink}
+
+// minRatioCheckSize is the uncompressed size below which the compression ratio is not
+// checked, so that small, highly compressible files are not rejected.
+const minRatioCheckSize = 1024 * 1024
+
+// ValidationOptions configures the safety checks applied to each archive. Zero limits are
+// not enforced.
+type ValidationOptions struct {
+	// MaxEntries is the maximum number of entries in an archive.
+	MaxEntries int
+	// MaxUncompressedSize is the maximum number of bytes of the uncompressed tar stream, or
+	// the total uncompressed size of the files in a ZIP archive.
+	MaxUncompressedSize int64
+	// MaxCompressionRatio is the maximum ratio of uncompressed to compressed bytes.
+	MaxCompressionRatio float64
+	// AllowedTypes lists the allowed tar entry types. Defaults to DefaultAllowedTypes.
+	AllowedTypes []byte
+	// Strip drops entries with unsafe paths, unsafe links or disallowed types from the
+	// rewritten archive instead of rejecting the package. Entry count, size and ratio
+	// limits always reject the package.
+	Strip bool
+}
+
+// ValidationError is returned when an archive fails validation.
+type ValidationError struct {
+	Violation Violation
+	// Entry is the name of the offending entry, if any.
+	Entry  string
+	Detail string
+}
+
+func (e *ValidationError) Error() string {
+	if e.Entry == "" {
+		return fmt.Sprintf("archive failed %s validation: %s", e.Violation, e.Detail)
+	}
+	return fmt.Sprintf("archive failed %s validation for entry '%s': %s", e.Violation, e.Entry, e.Detail)
+}
+
+// validator applies ValidationOptions to the entries of a single archive.
+type validator struct {
+	opts    *ValidationOptions
+	entries int
+}
+
+func newValidator(opts *ValidationOptions) *validator {
+	return &validator{opts: opts}
+}
+
+// checkHeader validates a tar entry. It returns false when the entry should be stripped.
+func (v *validator) checkHeader(header *tar.Header) (bool, error) {
+	if v.opts == nil {
+		return true, nil
+	}
+	return v.checkEntry(header.Name, header.Typeflag, header.Linkname)
+}
+
+// reader wraps the uncompressed tar stream `r` to enforce the size and ratio limits.
+// `compressed` counts the bytes read from the original archive.
+func (v *validator) reader(r io.Reader, compressed *countingReader) io.Reader {
+	if v.opts == nil {
+		return r
+	}
+	return &limitedReader{countingReader: countingReader{r: r}, compressed: compressed, v: v}
+}
+
+func (v *validator) checkEntry(name string, typeflag byte, linkname string) (bool, error) {
+	v.entries++
+	if v.opts.MaxEntries > 0 && v.entries > v.opts.MaxEntries {
+		return false, &ValidationError{
+			Violation: ViolationEntries,
+			Detail:    fmt.Sprintf("more than %d entries", v.opts.MaxEntries),
+		}
+	}
+
+	// Global headers only hold PAX records for the entries that follow them
+	if typeflag == tar.TypeXGlobalHeader {
+		return true, nil
+	}
+
+	var violation *ValidationError
+	allowed := v.opts.AllowedTypes
+	if len(allowed) == 0 {
+		allowed = DefaultAllowedTypes
+	}
+	switch {
+	case escapesRoot(name):
+		violation = &ValidationError{Violation: ViolationPath, Entry: name, Detail: "path is outside the package root"}
+	case bytes.IndexByte(allowed, typeflag) < 0:
+		violation = &ValidationError{Violation: ViolationEntryType, Entry: name, Detail: fmt.Sprintf("entry type %q is not allowed", typeflag)}
+	case typeflag == tar.TypeSymlink && escapesPackage(name, linkname):
+		violation = &ValidationError{Violation: ViolationLink, Entry: name, Detail: fmt.Sprintf("symlink target '%s' is outside the package directory", linkname)}
+	case typeflag == tar.TypeLink && escapesRoot(linkname):
+		violation = &ValidationError{Violation: ViolationLink, Entry: name, Detail: fmt.Sprintf("hardlink target '%s' is outside the package root", linkname)}
+	}
+	if violation == nil {
+		return true, nil
+	}
+	if v.opts.Strip {
+		return false, nil
+	}
+	return false, violation
+}
+
+// checkSize validates the uncompressed and compressed sizes of an archive.
+func (v *validator) checkSize(uncompressed, compressed int64) error {
+	if v.opts == nil {
+		return nil
+	}
+	if v.opts.MaxUncompressedSize > 0 && uncompressed > v.opts.MaxUncompressedSize {
+		return &ValidationError{
+			Violation: ViolationSize,
+			Detail:    fmt.Sprintf("uncompressed size exceeds %d bytes", v.opts.MaxUncompressedSize),
+		}
+	}
+	if v.opts.MaxCompressionRatio > 0 && uncompressed > minRatioCheckSize && compressed > 0 &&
+		float64(uncompressed)/float64(compressed) > v.opts.MaxCompressionRatio {
+		return &ValidationError{
+			Violation: ViolationCompressionRatio,
+			Detail:    fmt.Sprintf("compression ratio exceeds %g", v.opts.MaxCompressionRatio),
+		}
+	}
+	return nil
+}
+
+// escapesRoot returns true if `name` is absolute or refers to a path outside the root.
+func escapesRoot(name string) bool {
+	if path.IsAbs(name) || strings.Contains(name, `\`) {
+		return true
+	}
+	cleaned := path.Clean(name)
+	return cleaned == ".." || strings.HasPrefix(cleaned, "../")
+}
+
+// escapesPackage returns true if the symlink `name` points to `linkname` outside the
+// top-level package directory that contains it, such as `pkg/a -> ../other/x`.
+func escapesPackage(name, linkname string) bool {
+	if path.IsAbs(linkname) || strings.Contains(linkname, `\`) {
+		return true
+	}
+	target := path.Join(path.Dir(name), linkname)
+	pkg, _, found := strings.Cut(path.Clean(name), "/")
+	if !found {
+		return escapesRoot(target)
+	}
+	return target != pkg && !strings.HasPrefix(target, pkg+"/")
+}
+
+// countingReader counts the bytes read from `r`.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// limitedReader reads the uncompressed tar stream and fails as soon as the stream breaks
+// the size or ratio limits, so that decompression bombs are never fully expanded.
+type limitedReader struct {
+	countingReader
+	compressed *countingReader
+	v          *validator
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.countingReader.Read(p)
+	if errSize := l.v.checkSize(l.n, l.compressed.n); errSize != nil {
+		return n, errSize
+	}
+	return n, err
+}
+
+// checkZip validates the entries of a ZIP archive of `size` bytes before it is rewritten.
+// It returns the names of the entries to strip.
+func (v *validator) checkZip(zr *zip.Reader, size int64) (map[string]bool, error) {
+	strip := make(map[string]bool)
+	if v.opts == nil {
+		return strip, nil
+	}
+	uncompressed := int64(0)
+	for _, f := range zr.File {
+		mode := f.Mode()
+		typeflag := byte(tar.TypeReg)
+		linkname := ""
+		switch {
+		case mode.IsDir():
+			typeflag = tar.TypeDir
+		case mode&fs.ModeSymlink != 0:
+			typeflag = tar.TypeSymlink
+			// The symlink target is stored as the file contents
+			target, err := readZipFile(f, 4096)
+			if err != nil {
+				return nil, err
+			}
+			linkname = target
+		case mode&(fs.ModeDevice|fs.ModeCharDevice) != 0:
+			typeflag = tar.TypeBlock
+			if mode&fs.ModeCharDevice != 0 {
+				typeflag = tar.TypeChar
+			}
+		case mode&fs.ModeNamedPipe != 0:
+			typeflag = tar.TypeFifo
+		}
+		keep, err := v.checkEntry(f.Name, typeflag, linkname)
+		if err != nil {
+			return nil, err
+		}
+		if !keep {
+			strip[f.Name] = true
+			continue
+		}
+		uncompressed += int64(f.UncompressedSize64)
+		if err = v.checkSize(uncompressed, size); err != nil {
+			return nil, err
+		}
+	}
+	return strip, nil
+}
+
+func readZipFile(f *zip.File, limit int64) (string, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return "", fmt.Errorf("error opening ZIP archive file '%s': %s", f.Name, err)
+	}
+	defer func(rc io.ReadCloser) {
+		_ = rc.Close()
+	}(rc)
+	b, err := io.ReadAll(io.LimitReader(rc, limit))
+	if err != nil {
+		return "", fmt.Errorf("error reading ZIP archive file '%s': %s", f.Name, err)
+	}
+	return string(b), nil
+}
@@ -0,0 +1,237 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+func TestValidateSuite(t *testing.T) {
+	suite.Run(t, &ValidateSuite{})
+}
+
+type ValidateSuite struct {
+	suite.Suite
+}
+
+const validateDescription = "Package: test\nVersion: 1.0\n"
+
+// packageWith returns a gzipped package tarball that also contains `extra`.
+func (s *ValidateSuite) packageWith(extra ...tarEntry) []byte {
+	entries := []tarEntry{
+		{header: &tar.Header{Name: "test/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: &tar.Header{Name: "test/DESCRIPTION", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(validateDescription))}, data: []byte(validateDescription)},
+	}
+	data, err := writeTarGz(append(entries, extra...))
+	s.Require().Nil(err)
+	return data
+}
+
+func (s *ValidateSuite) TestEscapesRoot() {
+	for name, expected := range map[string]bool{
+		"test/DESCRIPTION":   false,
+		"./test/R/file.R":    false,
+		"test/../other/file": false,
+		"test/../../file":    true,
+		"../file":            true,
+		"..":                 true,
+		"/etc/passwd":        true,
+		`test\..\..\file`:    true,
+	} {
+		s.Require().Equal(expected, escapesRoot(name), name)
+	}
+}
+
+func (s *ValidateSuite) TestEscapesPackage() {
+	for link, expected := range map[[2]string]bool{
+		{"test/R/link", "../DESCRIPTION"}:    false,
+		{"./test/R/link", "file.R"}:          false,
+		{"test/link", "."}:                   false,
+		{"test/link", "../test/DESCRIPTION"}: false,
+		{"test/link", "../other/x"}:          true,
+		{"test/R/link", "../../other/x"}:     true,
+		{"test/link", ".."}:                  true,
+		{"test/link", "/etc/passwd"}:         true,
+		{"link", "test/DESCRIPTION"}:         false,
+		{"link", "../file"}:                  true,
+	} {
+		s.Require().Equal(expected, escapesPackage(link[0], link[1]), link)
+	}
+}
+
+func (s *ValidateSuite) TestRewriteViolations() {
+	for _, tc := range []struct {
+		entry     tarEntry
+		violation Violation
+	}{
+		{tarEntry{header: &tar.Header{Name: "test/../../evil", Typeflag: tar.TypeReg, Size: 1}, data: []byte("x")}, ViolationPath},
+		{tarEntry{header: &tar.Header{Name: "/tmp/evil", Typeflag: tar.TypeReg, Size: 1}, data: []byte("x")}, ViolationPath},
+		{tarEntry{header: &tar.Header{Name: "test/passwd", Typeflag: tar.TypeSymlink, Linkname: "../../etc/passwd"}}, ViolationLink},
+		{tarEntry{header: &tar.Header{Name: "test/passwd", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}}, ViolationLink},
+		{tarEntry{header: &tar.Header{Name: "test/other", Typeflag: tar.TypeSymlink, Linkname: "../other/x"}}, ViolationLink},
+		{tarEntry{header: &tar.Header{Name: "test/passwd", Typeflag: tar.TypeLink, Linkname: "../etc/passwd"}}, ViolationLink},
+		{tarEntry{header: &tar.Header{Name: "test/null", Typeflag: tar.TypeChar, Devmajor: 1, Devminor: 3}}, ViolationEntryType},
+		{tarEntry{header: &tar.Header{Name: "test/fifo", Typeflag: tar.TypeFifo}}, ViolationEntryType},
+	} {
+		data := s.packageWith(tc.entry)
+		name := tc.entry.header.Name
+
+		// Without validation, the entry is copied through
+		var b bytes.Buffer
+		_, err := NewRPackageArchive(256, 6, RewriteOptions{}).RewriteBinary(bytes.NewReader(data), &b)
+		s.Require().Nil(err, name)
+
+		// The package is rejected
+		b.Reset()
+		a := NewRPackageArchive(256, 6, RewriteOptions{Validation: &ValidationOptions{}})
+		_, err = a.RewriteBinary(bytes.NewReader(data), &b)
+		var verr *ValidationError
+		s.Require().True(errors.As(err, &verr), name)
+		s.Require().Equal(tc.violation, verr.Violation, name)
+		s.Require().Equal(name, verr.Entry)
+
+		// The entry is stripped
+		b.Reset()
+		a = NewRPackageArchive(256, 6, RewriteOptions{Validation: &ValidationOptions{Strip: true}})
+		results, err := a.RewriteBinary(bytes.NewReader(data), &b)
+		s.Require().Nil(err, name)
+		s.Require().Contains(results.Description, "Package: test\n")
+		entries, err := readTarEntries(b.Bytes())
+		s.Require().Nil(err)
+		s.Require().Len(entries, 2, name)
+	}
+}
+
+func (s *ValidateSuite) TestSafeLinks() {
+	data := s.packageWith(
+		tarEntry{header: &tar.Header{Name: "test/R/link", Typeflag: tar.TypeSymlink, Linkname: "../DESCRIPTION"}},
+		tarEntry{header: &tar.Header{Name: "test/copy", Typeflag: tar.TypeLink, Linkname: "test/DESCRIPTION"}},
+	)
+	var b bytes.Buffer
+	a := NewRPackageArchive(256, 6, RewriteOptions{Validation: &ValidationOptions{}})
+	_, err := a.RewriteBinary(bytes.NewReader(data), &b)
+	s.Require().Nil(err)
+
+	// Global headers are not checked against the allowed types
+	global := s.packageWith(tarEntry{header: &tar.Header{Name: "pax_global_header", Typeflag: tar.TypeXGlobalHeader,
+		PAXRecords: map[string]string{"comment": "0123456789abcdef"}}})
+	b.Reset()
+	a = NewRPackageArchive(256, 6, RewriteOptions{Validation: &ValidationOptions{AllowedTypes: []byte{tar.TypeReg, tar.TypeDir}}})
+	_, err = a.RewriteBinary(bytes.NewReader(global), &b)
+	s.Require().Nil(err)
+
+	// Links can be disallowed
+	b.Reset()
+	a = NewRPackageArchive(256, 6, RewriteOptions{Validation: &ValidationOptions{AllowedTypes: []byte{tar.TypeReg, tar.TypeDir}}})
+	_, err = a.RewriteBinary(bytes.NewReader(data), &b)
+	s.Require().EqualError(err, "archive failed entry type validation for entry 'test/R/link': entry type '2' is not allowed")
+}
+
+func (s *ValidateSuite) TestLimits() {
+	zeros := make([]byte, 4*1024*1024)
+	data := s.packageWith(tarEntry{header: &tar.Header{Name: "test/zeros", Typeflag: tar.TypeReg, Size: int64(len(zeros))}, data: zeros})
+
+	for _, tc := range []struct {
+		opts     ValidationOptions
+		expected string
+	}{
+		{ValidationOptions{MaxEntries: 2}, "archive failed entries validation: more than 2 entries"},
+		{ValidationOptions{MaxUncompressedSize: 1024 * 1024}, "archive failed size validation: uncompressed size exceeds 1048576 bytes"},
+		{ValidationOptions{MaxCompressionRatio: 100}, "archive failed compression ratio validation: compression ratio exceeds 100"},
+		// Stripping does not apply to limits
+		{ValidationOptions{MaxEntries: 2, Strip: true}, "archive failed entries validation: more than 2 entries"},
+	} {
+		var b bytes.Buffer
+		a := NewRPackageArchive(256, 6, RewriteOptions{Validation: &tc.opts})
+		_, err := a.RewriteBinary(bytes.NewReader(data), &b)
+		s.Require().ErrorContains(err, tc.expected)
+		var verr *ValidationError
+		s.Require().True(errors.As(err, &verr))
+	}
+
+	// The package passes within the limits
+	var b bytes.Buffer
+	opts := ValidationOptions{MaxEntries: 3, MaxUncompressedSize: 5 * 1024 * 1024, MaxCompressionRatio: 10000}
+	_, err := NewRPackageArchive(256, 6, RewriteOptions{Validation: &opts}).RewriteBinary(bytes.NewReader(data), &b)
+	s.Require().Nil(err)
+}
+
+// zipWith returns a ZIP binary that contains DESCRIPTION and `name`.
+func (s *ValidateSuite) zipWith(name string, mode fs.FileMode, contents string) []byte {
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	for _, f := range []struct {
+		name     string
+		mode     fs.FileMode
+		contents string
+	}{
+		{"test/DESCRIPTION", 0644, validateDescription},
+		{name, mode, contents},
+	} {
+		header := &zip.FileHeader{Name: f.name, Method: zip.Deflate}
+		header.SetMode(f.mode)
+		w, err := zw.CreateHeader(header)
+		s.Require().Nil(err)
+		_, err = w.Write([]byte(f.contents))
+		s.Require().Nil(err)
+	}
+	s.Require().Nil(zw.Close())
+	return b.Bytes()
+}
+
+func (s *ValidateSuite) TestZipViolations() {
+	for _, tc := range []struct {
+		name      string
+		mode      fs.FileMode
+		contents  string
+		violation Violation
+	}{
+		{"test/../../evil", 0644, "x", ViolationPath},
+		{"test/passwd", fs.ModeSymlink | 0777, "../../etc/passwd", ViolationLink},
+		{"test/null", fs.ModeDevice | fs.ModeCharDevice | 0644, "", ViolationEntryType},
+	} {
+		data := s.zipWith(tc.name, tc.mode, tc.contents)
+
+		var b bytes.Buffer
+		a := NewRPackageZipArchive(256, RewriteOptions{Validation: &ValidationOptions{}})
+		_, err := a.RewriteBinaryAt(bytes.NewReader(data), int64(len(data)), &b)
+		var verr *ValidationError
+		s.Require().True(errors.As(err, &verr), tc.name)
+		s.Require().Equal(tc.violation, verr.Violation, tc.name)
+		s.Require().Equal(tc.name, verr.Entry)
+
+		// The entry is stripped
+		b.Reset()
+		a = NewRPackageZipArchive(256, RewriteOptions{Validation: &ValidationOptions{Strip: true}})
+		_, err = a.RewriteBinaryAt(bytes.NewReader(data), int64(len(data)), &b)
+		s.Require().Nil(err, tc.name)
+		zr, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+		s.Require().Nil(err)
+		s.Require().Len(zr.File, 1)
+		s.Require().Equal("test/DESCRIPTION", zr.File[0].Name)
+	}
+}
+
+func (s *ValidateSuite) TestZipLimits() {
+	f, err := os.Open("../testdata/binaries/bindrcpp_0.2.2.zip")
+	s.Require().Nil(err)
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+
+	var b bytes.Buffer
+	a := NewRPackageZipArchive(256, RewriteOptions{Validation: &ValidationOptions{MaxEntries: 10}})
+	_, err = a.RewriteBinary(f, &b)
+	s.Require().EqualError(err, "archive failed entries validation: more than 10 entries")
+
+	a = NewRPackageZipArchive(256, RewriteOptions{Validation: &ValidationOptions{MaxUncompressedSize: 1024}})
+	_, err = a.RewriteBinary(f, &b)
+	s.Require().EqualError(err, "archive failed size validation: uncompressed size exceeds 1024 bytes")
+}
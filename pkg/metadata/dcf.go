@@ -0,0 +1,187 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package metadata
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Field is a single `Name: Value` field from a Debian Control File (DCF) record such as
+// a DESCRIPTION file. Value excludes the whitespace after the colon; continuation lines
+// are kept in Value separated by "\n", including their leading whitespace. Blank lines are
+// kept with the field, but not in Value.
+//
+// Lines of a DESCRIPTION that are not valid DCF are kept as fields with an empty Name and
+// Value, which are written back unchanged.
+type Field struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+
+	// The original text of the field and its line ending. The text is written back
+	// as-is while Name and Value are unchanged so that untouched fields round-trip
+	// byte-for-byte.
+	raw      string
+	rawName  string
+	rawValue string
+	eol      string
+	parsed   bool
+}
+
+// String returns the DCF text for the field, without a trailing newline.
+func (f Field) String() string {
+	if f.unchanged() {
+		return f.raw
+	}
+	return f.Name + ": " + f.Value
+}
+
+func (f Field) unchanged() bool {
+	return f.parsed && f.Name == f.rawName && f.Value == f.rawValue
+}
+
+// Fields is an ordered list of fields making up a single DCF record.
+type Fields []Field
+
+// MarshalJSON satisfies the JSON marshalling interface. Lines that are not valid DCF are
+// omitted.
+func (fs Fields) MarshalJSON() ([]byte, error) {
+	named := make([]Field, 0, len(fs))
+	for _, f := range fs {
+		if f.Name != "" {
+			named = append(named, f)
+		}
+	}
+	return json.Marshal(named)
+}
+
+// Get returns the value of the first field called `name`.
+func (fs Fields) Get(name string) (string, bool) {
+	for _, f := range fs {
+		if f.Name == name {
+			return f.Value, true
+		}
+	}
+	return "", false
+}
+
+// Bytes serializes the record. Unchanged fields keep their original text and line
+// endings; every other field is written as `Name: Value` followed by "\n".
+func (fs Fields) Bytes() []byte {
+	buf := bytes.NewBuffer([]byte{})
+	for i, f := range fs {
+		buf.WriteString(f.String())
+		switch {
+		case f.unchanged() && f.eol != "":
+			buf.WriteString(f.eol)
+		case f.unchanged() && i == len(fs)-1:
+			// The original record did not end with a newline
+		default:
+			buf.WriteString("\n")
+		}
+	}
+	return buf.Bytes()
+}
+
+// SyntaxError reports a line of a file with multiple records that is not valid DCF.
+type SyntaxError struct {
+	Line int
+	Text string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("invalid DCF at line %d: %q", e.Line, e.Text)
+}
+
+// ParseFields parses a single DCF record such as a DESCRIPTION file. Blank lines are kept
+// with the preceding field, and lines that are not valid DCF are kept as unnamed fields, so
+// that the record can be written back unchanged. Like R, it accepts DESCRIPTIONs with such
+// lines, which never cause an error.
+func ParseFields(data []byte) (Fields, error) {
+	records, err := parse(data, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return Fields{}, nil
+	}
+	return records[0], nil
+}
+
+// ParseDCF parses a file containing any number of DCF records separated by blank lines,
+// such as a PACKAGES file.
+func ParseDCF(data []byte) ([]Fields, error) {
+	return parse(data, true)
+}
+
+func parse(data []byte, multiple bool) ([]Fields, error) {
+	records := make([]Fields, 0)
+	var current Fields
+	lineNo := 0
+	text := string(data)
+	for len(text) > 0 {
+		// Split off the next line and its line ending
+		line := text
+		eol := ""
+		if i := strings.IndexByte(text, '\n'); i >= 0 {
+			line, text = text[:i], text[i+1:]
+			eol = "\n"
+		} else {
+			text = ""
+		}
+		if strings.HasSuffix(line, "\r") {
+			line = strings.TrimSuffix(line, "\r")
+			eol = "\r" + eol
+		}
+		lineNo++
+
+		blank := strings.TrimSpace(line) == ""
+		last := len(current) - 1
+		switch {
+		case blank && multiple:
+			// Blank lines separate records
+			if len(current) > 0 {
+				records = append(records, current)
+				current = nil
+			}
+		case (blank || line[0] == ' ' || line[0] == '\t') && last >= 0:
+			// Continuation line
+			current[last].raw += current[last].eol + line
+			if !blank && current[last].Name != "" {
+				current[last].Value += "\n" + line
+				current[last].rawValue = current[last].Value
+			}
+			current[last].eol = eol
+		case blank || line[0] == ' ' || line[0] == '\t' || !validField(line):
+			if multiple {
+				return nil, &SyntaxError{Line: lineNo, Text: line}
+			}
+			// Keep the line as it is
+			current = append(current, Field{raw: line, eol: eol, parsed: true})
+		default:
+			colon := strings.IndexByte(line, ':')
+			name := line[:colon]
+			value := strings.TrimLeft(line[colon+1:], " \t")
+			current = append(current, Field{
+				Name:     name,
+				Value:    value,
+				raw:      line,
+				rawName:  name,
+				rawValue: value,
+				eol:      eol,
+				parsed:   true,
+			})
+		}
+	}
+	if len(current) > 0 {
+		records = append(records, current)
+	}
+	return records, nil
+}
+
+// validField returns true if `line` starts a field, with a name before the colon.
+func validField(line string) bool {
+	colon := strings.IndexByte(line, ':')
+	return colon > 0 && !strings.ContainsAny(line[:colon], " \t")
+}
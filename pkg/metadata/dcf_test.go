@@ -0,0 +1,135 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package metadata
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+func TestDCFSuite(t *testing.T) {
+	suite.Run(t, &DCFSuite{})
+}
+
+type DCFSuite struct {
+	suite.Suite
+}
+
+func (s *DCFSuite) TestParseFieldsRoundTrip() {
+	for _, desc := range []string{
+		"Package: test\nVersion: 1.0\n",
+		"Package: test\r\nTitle:  Extra  spacing \r\nVersion: 1.0\r\n",
+		"Package: test\nVersion: 1.0",
+		"Package: test\nDescription: Line one\n    line two\n\tline three\nVersion: 1.0\n",
+		"Package: test\nVersion: 1.0\n\n",
+		"Package:test\nVersion:\n",
+	} {
+		fields, err := ParseFields([]byte(desc))
+		s.Require().Nil(err)
+		s.Require().Equal(desc, string(fields.Bytes()))
+	}
+}
+
+func (s *DCFSuite) TestParseFields() {
+	fields, err := ParseFields([]byte("Package: test\r\n" +
+		"Title:  Extra  spacing\n" +
+		"Authors@R: c(\n" +
+		"    person(\"A\", \"B\")\n" +
+		"    )\n" +
+		"Empty:\n"))
+	s.Require().Nil(err)
+	s.Require().Equal([]string{"Package", "Title", "Authors@R", "Empty"}, []string{
+		fields[0].Name, fields[1].Name, fields[2].Name, fields[3].Name,
+	})
+	s.Require().Equal("test", fields[0].Value)
+	s.Require().Equal("Extra  spacing", fields[1].Value)
+	s.Require().Equal("c(\n    person(\"A\", \"B\")\n    )", fields[2].Value)
+	s.Require().Equal("", fields[3].Value)
+
+	value, ok := fields.Get("Authors@R")
+	s.Require().True(ok)
+	s.Require().Equal(fields[2].Value, value)
+	_, ok = fields.Get("Missing")
+	s.Require().False(ok)
+
+	empty, err := ParseFields([]byte{})
+	s.Require().Nil(err)
+	s.Require().Len(empty, 0)
+}
+
+func (s *DCFSuite) TestEditedFields() {
+	fields, err := ParseFields([]byte("Package: test\r\nTitle:  Old\r\nVersion: 1.0"))
+	s.Require().Nil(err)
+
+	// Edited fields are reformatted with a "\n" line ending
+	fields[1].Value = "New"
+	fields = append(fields, Field{Name: "Repository", Value: "RSPM"})
+	s.Require().Equal("Title: New", fields[1].String())
+	s.Require().Equal("Package: test\r\nTitle: New\nVersion: 1.0\nRepository: RSPM\n", string(fields.Bytes()))
+}
+
+func (s *DCFSuite) TestParseFieldsInvalid() {
+	for _, c := range []struct {
+		desc string
+		line int
+	}{
+		{"    continuation first\nPackage: test\n", 1},
+		{"\nPackage: test\n", 1},
+		{"Package: test\nno colon here\n", 2},
+		{"Package: test\nbad name: value\n", 2},
+		{"Package: test\n: value\n", 2},
+	} {
+		// DESCRIPTIONs keep the invalid lines as they are
+		fields, err := ParseFields([]byte(c.desc))
+		s.Require().Nil(err)
+		s.Require().Equal(c.desc, string(fields.Bytes()))
+		name, ok := fields.Get("Package")
+		s.Require().True(ok)
+		s.Require().Equal("test", name)
+
+		fields = append(fields, Field{Name: "Repository", Value: "RSPM"})
+		s.Require().Equal(c.desc+"Repository: RSPM\n", string(fields.Bytes()))
+		data, err := json.Marshal(fields)
+		s.Require().Nil(err)
+		s.Require().Equal(`[{"name":"Package","value":"test"},{"name":"Repository","value":"RSPM"}]`, string(data))
+
+		// while files with multiple records do not
+		_, err = ParseDCF([]byte(c.desc))
+		if c.line == 1 && c.desc[0] == '\n' {
+			// Leading blank lines separate records
+			s.Require().Nil(err)
+			continue
+		}
+		var syntaxErr *SyntaxError
+		s.Require().ErrorAs(err, &syntaxErr)
+		s.Require().Equal(c.line, syntaxErr.Line)
+	}
+}
+
+func (s *DCFSuite) TestParseFieldsBlankLines() {
+	desc := "Package: test\nDescription: Line one\n\n    line two\n\nVersion: 1.0\n\n"
+	fields, err := ParseFields([]byte(desc))
+	s.Require().Nil(err)
+	s.Require().Equal(desc, string(fields.Bytes()))
+	value, _ := fields.Get("Description")
+	s.Require().Equal("Line one\n    line two", value)
+	value, _ = fields.Get("Version")
+	s.Require().Equal("1.0", value)
+}
+
+func (s *DCFSuite) TestParseDCF() {
+	records, err := ParseDCF([]byte("Package: a\nVersion: 1.0\n\n\nPackage: b\nDepends: R (>= 3.0),\n    a\n  \nPackage: c\n"))
+	s.Require().Nil(err)
+	s.Require().Len(records, 3)
+	name, _ := records[1].Get("Package")
+	s.Require().Equal("b", name)
+	depends, _ := records[1].Get("Depends")
+	s.Require().Equal("R (>= 3.0),\n    a", depends)
+	name, _ = records[2].Get("Package")
+	s.Require().Equal("c", name)
+
+	records, err = ParseDCF([]byte("\n\n"))
+	s.Require().Nil(err)
+	s.Require().Len(records, 0)
+}
@@ -84,6 +84,33 @@ func ParseLinks(raw string, linkType LinkType) []Link {
 	return links
 }
 
+// dependencyFields lists the DESCRIPTION fields that declare links to other packages.
+var dependencyFields = []struct {
+	name     string
+	linkType LinkType
+}{
+	{"Depends", LinkDepends},
+	{"Imports", LinkImports},
+	{"Suggests", LinkSuggests},
+	{"LinkingTo", LinkLinkingTo},
+	{"Enhances", LinkEnhances},
+}
+
+// ParseDependencies generates the links declared by the Depends, Imports, Suggests,
+// LinkingTo and Enhances fields of a DESCRIPTION, in that order. Whitespace within a
+// field, including line folding, is collapsed before parsing.
+func ParseDependencies(fields Fields) []Link {
+	var links []Link
+	for _, dep := range dependencyFields {
+		raw, ok := fields.Get(dep.name)
+		if !ok {
+			continue
+		}
+		links = append(links, ParseLinks(strings.Join(strings.Fields(raw), " "), dep.linkType)...)
+	}
+	return links
+}
+
 // resolveOperator maps an operator symbol to the internal value.
 func resolveOperator(components []string) LinkOperator {
 	if len(components) == 1 {
@@ -108,3 +108,24 @@ func (s *LinkSuite) TestParseLinks() {
 
 	}
 }
+
+func (s *LinkSuite) TestParseDependencies() {
+	fields, err := ParseFields([]byte("Package: test\n" +
+		"Imports: bindr (>= 0.1.1), Rcpp (>=\n        0.12.16)\n" +
+		"Depends: R (>= 3.0)\n" +
+		"LinkingTo: Rcpp\n" +
+		"Suggests:\n" +
+		"    testthat,\n" +
+		"    knitr\n"))
+	s.Require().Nil(err)
+	s.Require().Equal([]Link{
+		{Name: "R", Raw: "R (>= 3.0)", Operator: VersionGTE, Version: "3.0", Type: LinkDepends},
+		{Name: "bindr", Raw: "bindr (>= 0.1.1)", Operator: VersionGTE, Version: "0.1.1", Type: LinkImports},
+		{Name: "Rcpp", Raw: "Rcpp (>= 0.12.16)", Operator: VersionGTE, Version: "0.12.16", Type: LinkImports},
+		{Name: "testthat", Raw: "testthat", Type: LinkSuggests},
+		{Name: "knitr", Raw: "knitr", Type: LinkSuggests},
+		{Name: "Rcpp", Raw: "Rcpp", Type: LinkLinkingTo},
+	}, ParseDependencies(fields))
+
+	s.Require().Nil(ParseDependencies(Fields{}))
+}
@@ -0,0 +1,484 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package metadata
+
+import (
+	"errors"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/version"
+)
+
+type NewsFormat int16
+
+const (
+	// NewsMarkdown is the format of `NEWS.md` files, with a heading per version as written
+	// by usethis and read by pkgdown.
+	NewsMarkdown NewsFormat = 0
+	// NewsText is the format of plain `NEWS` files.
+	NewsText NewsFormat = 1
+	// NewsRd is the format of `inst/NEWS.Rd` files, with a `\section` per version.
+	NewsRd NewsFormat = 2
+)
+
+// NewsFormatOf returns the format of the NEWS file at `p`, such as the path extracted by
+// `archive.NewsExtractor`.
+func NewsFormatOf(p string) NewsFormat {
+	switch strings.ToLower(path.Ext(p)) {
+	case ".md":
+		return NewsMarkdown
+	case ".rd":
+		return NewsRd
+	}
+	return NewsText
+}
+
+// ChangelogEntry holds the changes of a single version in a NEWS file.
+type ChangelogEntry struct {
+	// Version is not set for a "development version" heading.
+	Version version.RVersion `json:"version"`
+	// Date is the date in the heading, such as "2023-01-05", if any.
+	Date string `json:"date,omitempty"`
+	// Items holds the bullets and paragraphs listed for the version. Markdown items keep
+	// their inline markup, while Rd markup is reduced to plain text.
+	Items []string `json:"items"`
+}
+
+// ChangesSince returns the entries of `entries` for versions newer than `v`, such as the
+// version that a user has installed. Development versions are always included. All entries
+// are returned when `v` is not set.
+func ChangesSince(entries []ChangelogEntry, v version.RVersion) []ChangelogEntry {
+	changes := []ChangelogEntry{}
+	for _, entry := range entries {
+		if !v.Set || !entry.Version.Set || entry.Version.GreaterThan(v) {
+			changes = append(changes, entry)
+		}
+	}
+	return changes
+}
+
+// ParseNews parses a NEWS file into an entry per version, in the order of the file.
+// Headings are recognized by the version they contain, such as "# DT 0.4 (2018-01-01)",
+// "Changes in version 0.4" or "\section{Changes in DT version 0.4}", or by "development
+// version". Text before the first version heading is ignored.
+func ParseNews(data []byte, format NewsFormat) ([]ChangelogEntry, error) {
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	switch format {
+	case NewsMarkdown:
+		return parseNewsMarkdown(strings.Split(text, "\n")), nil
+	case NewsText:
+		return parseNewsText(strings.Split(text, "\n")), nil
+	case NewsRd:
+		return parseNewsRd(text)
+	}
+	return nil, errors.New("unknown NEWS format")
+}
+
+// newsVersion matches the version in a heading, but not the digits in a package name such
+// as "ggplot2".
+var newsVersion = regexp.MustCompile(`(?:^|[^\w.])v?(\d+(?:[.-]\d+)+)`)
+
+// newsDate matches the date in a heading, which is removed before looking for the version.
+var newsDate = regexp.MustCompile(`\d{4}-\d{2}-\d{2}`)
+
+// newsDevelopment matches headings such as "# DT (development version)".
+var newsDevelopment = regexp.MustCompile(`(?i)\bdevel(opment)?\b`)
+
+// newsHeading returns the entry started by the heading `text`, if it is a version heading.
+func newsHeading(text string) (*ChangelogEntry, bool) {
+	date := newsDate.FindString(text)
+	text = newsDate.ReplaceAllString(text, "")
+	raw := ""
+	if m := newsVersion.FindStringSubmatch(text); m != nil {
+		raw = m[1]
+	} else if !newsDevelopment.MatchString(text) {
+		return nil, false
+	}
+	v, err := version.ParseNewVersion(raw)
+	if err != nil {
+		return nil, false
+	}
+	return &ChangelogEntry{Version: v, Date: date, Items: []string{}}, true
+}
+
+var (
+	// markdownHeading matches ATX headings such as "## DT 0.4 ##".
+	markdownHeading = regexp.MustCompile(`^ {0,3}(#{1,6})\s+(.*?)(\s+#+)?\s*$`)
+	markdownBullet  = regexp.MustCompile(`^([-*+]|\d+[.)])\s+`)
+	markdownFence   = regexp.MustCompile("^\\s*(```|~~~)")
+	textBullet      = regexp.MustCompile(`^([-*+o•]|\d+[.)])\s+`)
+	// newsUnderline matches the underlines of setext headings, and other rules.
+	newsUnderline = regexp.MustCompile(`^\s*(={3,}|-{3,}|\*{3,}|_{3,}|~{3,})\s*$`)
+	// textHeading matches the version headings of plain NEWS files in the forms read by R's
+	// `news()`: "CHANGES IN (R )VERSION 1.0", "R VERSION 1.0", "Version 1.0" or "pkg 1.0",
+	// optionally followed by a date, or "pkg (development version)".
+	textHeading = regexp.MustCompile(`(?i)^(?:(?:changes\s+in\s+(?:[a-z][\w.]*\s+)?|r\s+)?version|[a-z][\w.]*)\s+` +
+		`(?:v?\d+(?:[.-]\d+)+(?:\s*[-:,]?\s*\(?(?:released\s+)?(?:on\s+)?\d{4}-\d{2}-\d{2}\)?)?|\(?devel(?:opment)?(?:\s+version)?\)?)\s*:?$`)
+	// newsCategory matches the capitalized categories of plain NEWS files, such as
+	// "NEW FEATURES", which are dropped like the subheadings of markdown files.
+	newsCategory = regexp.MustCompile(`^[A-Z][A-Z0-9 ,&/()'-]*:?$`)
+)
+
+// newsParser collects the items of the entries of a markdown or plain NEWS file.
+type newsParser struct {
+	entries []ChangelogEntry
+	current *ChangelogEntry
+	// item holds the lines of the current item, and indent the indentation of its first line.
+	item   []string
+	indent int
+	blank  bool
+}
+
+// start starts a new entry, or only ends the current one when `entry` is nil.
+func (p *newsParser) start(entry *ChangelogEntry) {
+	if p.current != nil {
+		p.endItem()
+		p.entries = append(p.entries, *p.current)
+	}
+	p.current = entry
+	p.item = nil
+	p.blank = false
+}
+
+func (p *newsParser) endItem() {
+	if p.current != nil && len(p.item) > 0 {
+		p.current.Items = append(p.current.Items, strings.Join(p.item, " "))
+	}
+	p.item = nil
+}
+
+// line adds a line of the body of an entry. Bullets start an item, which continues on the
+// following lines until a blank line or a line that is not indented deeper than the bullet.
+// Other text forms an item per paragraph.
+func (p *newsParser) line(line string, bullet *regexp.Regexp) {
+	if p.current == nil {
+		return
+	}
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" {
+		p.blank = true
+		return
+	}
+	blank := p.blank
+	p.blank = false
+	indent := indentation(line)
+
+	if loc := bullet.FindStringIndex(trimmed); loc != nil {
+		p.endItem()
+		p.item = []string{trimmed[loc[1]:]}
+		p.indent = indent
+		return
+	}
+	if len(p.item) > 0 && (!blank || indent > p.indent) {
+		p.item = append(p.item, trimmed)
+		return
+	}
+	p.endItem()
+	if newsCategory.MatchString(trimmed) {
+		return
+	}
+	p.item = []string{trimmed}
+	p.indent = indent
+}
+
+func (p *newsParser) finish() []ChangelogEntry {
+	p.start(nil)
+	if p.entries == nil {
+		return []ChangelogEntry{}
+	}
+	return p.entries
+}
+
+// indentation returns the width of the leading whitespace of `line`, with tabs as 4 spaces.
+func indentation(line string) int {
+	width := 0
+	for _, r := range line {
+		switch r {
+		case ' ':
+			width++
+		case '\t':
+			width += 4
+		default:
+			return width
+		}
+	}
+	return width
+}
+
+// parseNewsMarkdown parses a NEWS.md file. The level of the first version heading is the
+// level of every version heading, and deeper headings are subheadings such as "## Bug fixes".
+func parseNewsMarkdown(lines []string) []ChangelogEntry {
+	p := &newsParser{}
+	level := 0
+	fenced := false
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		if markdownFence.MatchString(line) {
+			fenced = !fenced
+			continue
+		}
+		if fenced {
+			continue
+		}
+
+		headingLevel, heading := 0, ""
+		if m := markdownHeading.FindStringSubmatch(line); m != nil {
+			headingLevel, heading = len(m[1]), m[2]
+		} else if i+1 < len(lines) && strings.TrimSpace(line) != "" && !markdownBullet.MatchString(strings.TrimSpace(line)) &&
+			newsUnderline.MatchString(lines[i+1]) && strings.ContainsAny(lines[i+1], "=-") {
+			// A setext heading, underlined with "=" for level 1 and "-" for level 2
+			headingLevel, heading = 2, strings.TrimSpace(line)
+			if strings.Contains(lines[i+1], "=") {
+				headingLevel = 1
+			}
+			i++
+		}
+		if headingLevel == 0 {
+			if !newsUnderline.MatchString(line) {
+				p.line(line, markdownBullet)
+			}
+			continue
+		}
+
+		entry, ok := newsHeading(heading)
+		switch {
+		case ok && (level == 0 || headingLevel <= level):
+			level = headingLevel
+			p.start(entry)
+		case level != 0 && headingLevel <= level:
+			// Such as "# Older versions"
+			p.start(nil)
+		default:
+			p.endItem()
+		}
+	}
+	return p.finish()
+}
+
+// parseNewsText parses a plain NEWS file, where version headings are lines that are not
+// indented and match `textHeading`.
+func parseNewsText(lines []string) []ChangelogEntry {
+	p := &newsParser{}
+	for _, line := range lines {
+		if newsUnderline.MatchString(line) {
+			continue
+		}
+		trimmed := strings.TrimSpace(line)
+		if indentation(line) == 0 && textHeading.MatchString(trimmed) {
+			if entry, ok := newsHeading(trimmed); ok {
+				p.start(entry)
+				continue
+			}
+		}
+		p.line(line, textBullet)
+	}
+	return p.finish()
+}
+
+var errRdBraces = errors.New("unbalanced braces in NEWS.Rd")
+
+// parseNewsRd parses a NEWS.Rd file, with an entry per `\section` that has a version in its
+// title. The items are the `\item`s of the lists in the section and its subsections.
+func parseNewsRd(text string) ([]ChangelogEntry, error) {
+	text = rdStripComments(text)
+	entries := []ChangelogEntry{}
+	for {
+		i := strings.Index(text, `\section`)
+		if i < 0 {
+			break
+		}
+		text = text[i+len(`\section`):]
+		if !strings.HasPrefix(strings.TrimSpace(text), "{") {
+			continue
+		}
+		title, rest, err := rdArg(text)
+		if err != nil {
+			return nil, err
+		}
+		body, rest, err := rdArg(rest)
+		if err != nil {
+			return nil, err
+		}
+		text = rest
+
+		entry, ok := newsHeading(rdText(title))
+		if !ok {
+			continue
+		}
+		if entry.Items, err = rdItems(body, entry.Items); err != nil {
+			return nil, err
+		}
+		entries = append(entries, *entry)
+	}
+	return entries, nil
+}
+
+// rdStripComments removes the comments, from an unescaped "%" to the end of the line.
+func rdStripComments(text string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		for j := 0; j < len(line); j++ {
+			if line[j] == '\\' {
+				j++
+			} else if line[j] == '%' {
+				lines[i] = line[:j]
+				break
+			}
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// rdArg splits the braced argument at the start of `s`, after any whitespace, from the rest.
+func rdArg(s string) (arg, rest string, err error) {
+	s = strings.TrimLeft(s, " \t\n")
+	if !strings.HasPrefix(s, "{") {
+		return "", s, errRdBraces
+	}
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return s[1:i], s[i+1:], nil
+			}
+		}
+	}
+	return "", "", errRdBraces
+}
+
+// rdMacro splits the name of the macro at the start of `s`, which begins with a backslash,
+// from the rest. Escaped characters such as `\%` have no name.
+func rdMacro(s string) (name, rest string) {
+	i := 1
+	for i < len(s) && (s[i] >= 'a' && s[i] <= 'z' || s[i] >= 'A' && s[i] <= 'Z') {
+		i++
+	}
+	if i == 1 && len(s) > 1 {
+		return "", s[2:]
+	}
+	return s[1:i], s[i:]
+}
+
+// rdItems appends the items of the lists in `body` to `items`.
+func rdItems(body string, items []string) ([]string, error) {
+	for {
+		i := strings.IndexByte(body, '\\')
+		if i < 0 {
+			return items, nil
+		}
+		name, rest := rdMacro(body[i:])
+		var arg string
+		var err error
+		switch name {
+		case "subsection":
+			if _, rest, err = rdArg(rest); err != nil {
+				return nil, err
+			}
+			if arg, rest, err = rdArg(rest); err != nil {
+				return nil, err
+			}
+			if items, err = rdItems(arg, items); err != nil {
+				return nil, err
+			}
+		case "itemize", "enumerate":
+			if arg, rest, err = rdArg(rest); err != nil {
+				return nil, err
+			}
+			for _, item := range rdSplitItems(arg) {
+				if text := rdText(item); text != "" {
+					items = append(items, text)
+				}
+			}
+		}
+		body = rest
+	}
+}
+
+// rdSplitItems splits a list at the `\item`s that are not nested in braces.
+func rdSplitItems(list string) []string {
+	var items []string
+	start := -1
+	depth := 0
+	for i := 0; i < len(list); i++ {
+		switch list[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case '\\':
+			if name, _ := rdMacro(list[i:]); name == "item" && depth == 0 {
+				if start >= 0 {
+					items = append(items, list[start:i])
+				}
+				start = i + len(`\item`)
+			}
+			i++
+		}
+	}
+	if start >= 0 {
+		items = append(items, list[start:])
+	}
+	return items
+}
+
+// rdText reduces Rd markup such as `\code{x}` to plain text, with collapsed whitespace.
+func rdText(s string) string {
+	var b strings.Builder
+	for len(s) > 0 {
+		switch s[0] {
+		case '{', '}':
+			s = s[1:]
+			continue
+		case '\\':
+		default:
+			b.WriteByte(s[0])
+			s = s[1:]
+			continue
+		}
+
+		name, rest := rdMacro(s)
+		if name == "" {
+			// An escaped character
+			if len(s) > 1 {
+				b.WriteByte(s[1])
+			}
+			s = rest
+			continue
+		}
+		// Skip an option such as `\link[pkg]{topic}`, and collect the arguments
+		if strings.HasPrefix(rest, "[") {
+			if i := strings.IndexByte(rest, ']'); i >= 0 {
+				rest = rest[i+1:]
+			}
+		}
+		var args []string
+		for strings.HasPrefix(rest, "{") {
+			arg, r, err := rdArg(rest)
+			if err != nil {
+				break
+			}
+			args, rest = append(args, arg), r
+		}
+		switch {
+		case name == "dots" || name == "ldots":
+			b.WriteString("...")
+		case name == "R":
+			b.WriteString("R")
+		case name == "href" && len(args) > 1:
+			b.WriteString(rdText(args[1]))
+		default:
+			for _, arg := range args {
+				b.WriteString(rdText(arg))
+			}
+		}
+		s = rest
+	}
+	return strings.Join(strings.Fields(b.String()), " ")
+}
@@ -0,0 +1,177 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package metadata
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/version"
+)
+
+func TestNewsSuite(t *testing.T) {
+	suite.Run(t, &NewsSuite{})
+}
+
+type NewsSuite struct {
+	suite.Suite
+}
+
+// summary returns the versions, dates and items of `entries`.
+func (s *NewsSuite) summary(entries []ChangelogEntry) [][]string {
+	summary := [][]string{}
+	for _, entry := range entries {
+		summary = append(summary, append([]string{entry.Version.String(), entry.Date}, entry.Items...))
+	}
+	return summary
+}
+
+func (s *NewsSuite) TestNewsFormatOf() {
+	s.Require().Equal(NewsMarkdown, NewsFormatOf("DT/NEWS.md"))
+	s.Require().Equal(NewsText, NewsFormatOf("DT/NEWS"))
+	s.Require().Equal(NewsRd, NewsFormatOf("DT/inst/NEWS.Rd"))
+}
+
+func (s *NewsSuite) TestParseNewsMarkdown() {
+	entries, err := ParseNews([]byte("# News\n\n"+
+		"Ignored text.\n\n"+
+		"# DT (development version)\n\n"+
+		"* Unreleased.\n\n"+
+		"# DT 0.4 (2018-01-01)\n\n"+
+		"## BUG FIXES\n\n"+
+		"- A table will never appear again after `renderDT(NULL)`\n"+
+		"  once (thanks, @jcheng5, #488).\n\n"+
+		"- `updateSearch()` fixes:\n"+
+		"    ```r\n"+
+		"    # DT 1.0\n"+
+		"    ```\n\n"+
+		"A paragraph\nover two lines.\n\n"+
+		"ggplot2 3.0.0\r\n"+
+		"=============\r\n\r\n"+
+		"1. Ordered.\r\n\r\n"+
+		"# Older versions\n\n"+
+		"- Ignored.\n"), NewsMarkdown)
+	s.Require().Nil(err)
+	s.Require().Equal([][]string{
+		{"", "", "Unreleased."},
+		{"0.4", "2018-01-01",
+			"A table will never appear again after `renderDT(NULL)` once (thanks, @jcheng5, #488).",
+			"`updateSearch()` fixes:",
+			"A paragraph over two lines.",
+		},
+		{"3.0.0", "", "Ordered."},
+	}, s.summary(entries))
+	s.Require().False(entries[0].Version.Set)
+	s.Require().Equal(0, entries[1].Version.Major)
+	s.Require().Equal(4, entries[1].Version.Minor)
+
+	// Versions at a deeper level are only headings until a version heading is found
+	entries, err = ParseNews([]byte("## pkg 1.1\n\n### Bug fixes\n\n* Fixed.\n\n## pkg 1.0\n"), NewsMarkdown)
+	s.Require().Nil(err)
+	s.Require().Equal([][]string{{"1.1", "", "Fixed."}, {"1.0", ""}}, s.summary(entries))
+
+	entries, err = ParseNews([]byte("No versions here.\n"), NewsMarkdown)
+	s.Require().Nil(err)
+	s.Require().Empty(entries)
+	s.Require().NotNil(entries)
+}
+
+func (s *NewsSuite) TestParseNewsText() {
+	entries, err := ParseNews([]byte("Changes in version 1.2-3 (2020-01-05)\n"+
+		"-------------------------------------\n\n"+
+		"  NEW FEATURES\n\n"+
+		"    o   First item,\n"+
+		"        continued.\n\n"+
+		"        Second paragraph of the first item.\n\n"+
+		"    o   Second item.\n\n"+
+		"Requires R 3.5.0 from now on.\n\n"+
+		"CHANGES IN VERSION 1.1\n\n"+
+		"  * Old item.\n"), NewsText)
+	s.Require().Nil(err)
+	s.Require().Equal([][]string{
+		{"1.2-3", "2020-01-05",
+			"First item, continued. Second paragraph of the first item.",
+			"Second item.",
+			"Requires R 3.5.0 from now on.",
+		},
+		{"1.1", "", "Old item."},
+	}, s.summary(entries))
+	s.Require().Equal([]int{1, 2, 3}, entries[0].Version.Parts)
+
+	// Other forms of version headings
+	entries, err = ParseNews([]byte("CHANGES IN DT VERSION 0.5\n\n"+
+		"R VERSION 0.4:\n\n"+
+		"Version 0.3, 2019-01-02\n\n"+
+		"DT 0.2 (released 2018-02-03)\n"+
+		"===========================\n\n"+
+		"DT (development version)\n"), NewsText)
+	s.Require().Nil(err)
+	s.Require().Equal([][]string{
+		{"0.5", ""}, {"0.4", ""}, {"0.3", "2019-01-02"}, {"0.2", "2018-02-03"}, {"", ""},
+	}, s.summary(entries))
+
+	// Unindented lines that mention versions are not headings
+	entries, err = ParseNews([]byte("pkg 1.0\n\n"+
+		"Requires R >= 3.5.0\n"+
+		"Depends on Rcpp 1.0.7\n"+
+		"Fixed a crash in version 0.9 of pkg\n"+
+		"Now works with R 4.0.0 and later\n"), NewsText)
+	s.Require().Nil(err)
+	s.Require().Equal([][]string{{"1.0", "",
+		"Requires R >= 3.5.0 Depends on Rcpp 1.0.7 Fixed a crash in version 0.9 of pkg Now works with R 4.0.0 and later",
+	}}, s.summary(entries))
+}
+
+func (s *NewsSuite) TestParseNewsRd() {
+	entries, err := ParseNews([]byte(`% A comment with a \section{0.9}{}
+\name{NEWS}
+\title{News for Package \pkg{foo}}
+\encoding{UTF-8}
+\section{Changes in \pkg{foo} version 1.0 (2021-03-04)}{
+  \subsection{NEW FEATURES}{
+    \itemize{
+      \item Added \code{bar()}, see
+        \href{https://example.com}{the docs} \dots
+      \item Escaped \{braces\} and 100\% % with a comment
+        \itemize{ \item nested }
+    }
+  }
+  \subsection{BUG FIXES}{
+    \enumerate{
+      \item Fixed \link[base]{paste}.
+    }
+  }
+}
+\section{Changes in foo version 0.1}{
+  \itemize{\item First release.}
+}
+`), NewsRd)
+	s.Require().Nil(err)
+	s.Require().Equal([][]string{
+		{"1.0", "2021-03-04",
+			"Added bar(), see the docs ...",
+			"Escaped {braces} and 100% nested",
+			"Fixed paste.",
+		},
+		{"0.1", "", "First release."},
+	}, s.summary(entries))
+
+	_, err = ParseNews([]byte(`\section{Changes in version 1.0}{ \itemize{ \item Open }`), NewsRd)
+	s.Require().EqualError(err, "unbalanced braces in NEWS.Rd")
+
+	_, err = ParseNews([]byte{}, NewsFormat(-1))
+	s.Require().EqualError(err, "unknown NEWS format")
+}
+
+func (s *NewsSuite) TestChangesSince() {
+	entries, err := ParseNews([]byte("# pkg (development version)\n"+
+		"# pkg 1.10.0\n# pkg 1.9.0\n# pkg 1.2.0\n"), NewsMarkdown)
+	s.Require().Nil(err)
+
+	installed, err := version.ParseNewVersion("1.2.0")
+	s.Require().Nil(err)
+	s.Require().Equal([][]string{{"", ""}, {"1.10.0", ""}, {"1.9.0", ""}},
+		s.summary(ChangesSince(entries, installed)))
+
+	s.Require().Equal(entries, ChangesSince(entries, version.RVersion{}))
+}
@@ -0,0 +1,90 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package packages
+
+import (
+	"io"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// dcfWidth and dcfIndent are the defaults of R's `write.dcf` with the standard console
+	// width of 80: fields are folded at `width = 0.9 * getOption("width")` columns, and
+	// continuation lines are indented by `indent = 0.1 * getOption("width")` spaces.
+	dcfWidth  = 72
+	dcfIndent = 8
+)
+
+// sentenceEndRE matches the words that `strwrap` treats as the end of a sentence.
+var sentenceEndRE = regexp.MustCompile(`[.?!][)"']*$`)
+
+// field is a single field of a record written by writeDCF.
+type field struct {
+	name  string
+	value string
+	// keep writes the value on a single line, without folding.
+	keep bool
+}
+
+// writeDCF writes `records` like R's `write.dcf`: every field that is not kept is folded with
+// `strwrap`, and records are separated by an empty line.
+func writeDCF(w io.Writer, records [][]field) error {
+	var b strings.Builder
+	for i, record := range records {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		for _, f := range record {
+			if f.keep {
+				b.WriteString(f.name + ": " + f.value + "\n")
+				continue
+			}
+			for _, line := range strwrap(f.name+": "+f.value, dcfWidth, dcfIndent) {
+				b.WriteString(line)
+				b.WriteString("\n")
+			}
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// strwrap folds `s` like R's `strwrap(s, width, exdent = exdent)` for a single paragraph.
+// Whitespace, including line breaks, is collapsed, sentence ends are followed by two
+// spaces, and words are added to a line while the line stays shorter than `width - 1`
+// columns.
+func strwrap(s string, width, exdent int) []string {
+	words := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ' ' || r == '\t' || r == '\n'
+	})
+	if len(words) == 0 {
+		return []string{""}
+	}
+
+	lines := make([]string, 0, 1)
+	var line strings.Builder
+	maxLen := width - 1
+	lineLen := 0
+	for i, word := range words {
+		wordLen := utf8.RuneCountInString(word) + 1
+		sentenceEnd := i < len(words)-1 && sentenceEndRE.MatchString(word)
+		if sentenceEnd {
+			wordLen++
+		}
+		if lineLen > 0 && lineLen+wordLen > maxLen {
+			lines = append(lines, strings.TrimRight(line.String(), " "))
+			line.Reset()
+			line.WriteString(strings.Repeat(" ", exdent))
+			maxLen = width - exdent - 1
+			lineLen = 0
+		}
+		line.WriteString(word)
+		line.WriteString(" ")
+		if sentenceEnd {
+			line.WriteString(" ")
+		}
+		lineLen += wordLen
+	}
+	return append(lines, strings.TrimRight(line.String(), " "))
+}
@@ -0,0 +1,51 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package packages
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+func TestDCFSuite(t *testing.T) {
+	suite.Run(t, &DCFSuite{})
+}
+
+type DCFSuite struct {
+	suite.Suite
+}
+
+func (s *DCFSuite) TestStrwrap() {
+	for _, tc := range []struct {
+		in       string
+		expected []string
+	}{
+		{"Package: test", []string{"Package: test"}},
+		{"Empty:", []string{"Empty:"}},
+		// Whitespace and line breaks are collapsed
+		{"Depends: R (>= 3.5.0),\n    methods,  stats", []string{"Depends: R (>= 3.5.0), methods, stats"}},
+		// Lines are shorter than 71 columns
+		{"Imports: methods, stats, utils, grDevices, graphics, lattice, Matrix (>= 1.2-10), Rcpp", []string{
+			"Imports: methods, stats, utils, grDevices, graphics, lattice, Matrix",
+			"        (>= 1.2-10), Rcpp",
+		}},
+		// Sentence ends are followed by two spaces, except at the end of a line
+		{"Title: A package. Does things!", []string{"Title: A package.  Does things!"}},
+		// Words longer than a line are not broken
+		{"MD5sum: " + string(bytes.Repeat([]byte("a"), 70)), []string{"MD5sum:", "        " + string(bytes.Repeat([]byte("a"), 70))}},
+	} {
+		s.Require().Equal(tc.expected, strwrap(tc.in, dcfWidth, dcfIndent), tc.in)
+	}
+}
+
+func (s *DCFSuite) TestWriteDCF() {
+	// Kept fields are not folded
+	long := string(bytes.Repeat([]byte("a"), 70)) + ".tar.gz"
+	var b bytes.Buffer
+	s.Require().Nil(writeDCF(&b, [][]field{
+		{{"Package", "a", false}, {"Version", "1.0", false}},
+		{{"Package", "b", false}, {"File", long, true}},
+	}))
+	s.Require().Equal("Package: a\nVersion: 1.0\n\nPackage: b\nFile: "+long+"\n", b.String())
+}
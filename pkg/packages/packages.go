@@ -0,0 +1,212 @@
+// Copyright (C) 2023 by Posit Software, PBC
+
+// Package packages writes CRAN-style `PACKAGES` indexes for rewritten packages, so that a
+// directory of rewritten packages can be served as an R repository.
+package packages
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/archive"
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/metadata"
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/version"
+)
+
+// Type is the repository type of an index, as passed to `tools::write_PACKAGES`.
+type Type string
+
+const (
+	TypeSource     Type = "source"
+	TypeMacBinary  Type = "mac.binary"
+	TypeWinBinary  Type = "win.binary"
+	packagesFile        = "PACKAGES"
+	packagesGzFile      = "PACKAGES.gz"
+)
+
+// StandardFields returns the DESCRIPTION fields written for each package of type `t`, in
+// order. They match `tools:::.get_standard_repository_db_fields`.
+func StandardFields(t Type) []string {
+	fields := []string{
+		"Package", "Version", "Priority",
+		"Depends", "Imports", "LinkingTo", "Suggests", "Enhances",
+		"License", "License_is_FOSS", "License_restricts_use",
+		"OS_type", "Archs", "MD5sum",
+	}
+	if t == TypeSource {
+		fields = append(fields, "NeedsCompilation")
+	}
+	return fields
+}
+
+// Entry is a single package in an index.
+type Entry struct {
+	// Fields are the DESCRIPTION fields of the package.
+	Fields metadata.Fields
+	// MD5sum is the MD5 checksum of the package file.
+	MD5sum string
+	// File is the name of the package file when it is not `<Package>_<Version>.<ext>`.
+	File string
+	// Path is the directory of the package file relative to the repository directory,
+	// when it is not the repository directory itself.
+	Path string
+}
+
+// NewEntry returns the entry for a rewritten package. The MD5 checksum is taken from
+// `Results.RewrittenDigests`, so `archive.DigestMD5` must be in
+// `archive.RewriteOptions.Digests`. When the package was written to a file, `File` and
+// `Path` locate `RewrittenPath` relative to the repository directory `dir`.
+func NewEntry(results *archive.RewriteResults, dir string) (Entry, error) {
+	md5sum := results.RewrittenDigests[archive.DigestMD5]
+	if md5sum == "" {
+		return Entry{}, fmt.Errorf("no MD5 checksum for rewritten package; add %s to the rewrite digests", archive.DigestMD5)
+	}
+	entry := Entry{Fields: results.DescriptionFields, MD5sum: md5sum}
+	if results.RewrittenPath != "" {
+		rel, err := filepath.Rel(dir, results.RewrittenPath)
+		if err != nil {
+			return Entry{}, fmt.Errorf("error locating %s in %s: %s", results.RewrittenPath, dir, err)
+		}
+		entry.File = filepath.Base(rel)
+		if path := filepath.ToSlash(filepath.Dir(rel)); path != "." {
+			entry.Path = path
+		}
+	}
+	return entry, nil
+}
+
+func (e Entry) field(name string) string {
+	switch name {
+	case "MD5sum":
+		return e.MD5sum
+	case "File":
+		return e.File
+	case "Path":
+		return e.Path
+	}
+	value, _ := e.Fields.Get(name)
+	return value
+}
+
+// Index collects the entries of a `PACKAGES` file.
+type Index struct {
+	Type Type
+	// LatestOnly keeps only the latest version of each package, like the default of
+	// `tools::write_PACKAGES`.
+	LatestOnly bool
+
+	entries []Entry
+}
+
+// NewIndex returns an index of type `t` that keeps only the latest version of each package.
+func NewIndex(t Type) *Index {
+	return &Index{Type: t, LatestOnly: true}
+}
+
+// Add adds an entry to the index.
+func (i *Index) Add(entry Entry) {
+	i.entries = append(i.entries, entry)
+}
+
+// AddResults adds a rewritten package to the index. See `NewEntry`.
+func (i *Index) AddResults(results *archive.RewriteResults, dir string) error {
+	entry, err := NewEntry(results, dir)
+	if err != nil {
+		return err
+	}
+	i.Add(entry)
+	return nil
+}
+
+// Write writes the index in the format of a `PACKAGES` file. Packages are sorted by name and
+// version, and the fields of each package follow `StandardFields` and are followed by
+// `Path` and `File` when set. Empty fields are omitted, and `Path` and `File` are never
+// folded so that long file names stay readable by clients.
+func (i *Index) Write(w io.Writer) error {
+	fields := append(StandardFields(i.Type), "Path", "File")
+	records := make([][]field, 0, len(i.entries))
+	for _, entry := range i.sorted() {
+		record := make([]field, 0, len(fields))
+		for _, name := range fields {
+			if value := entry.field(name); value != "" {
+				keep := name == "Path" || name == "File"
+				record = append(record, field{name: name, value: value, keep: keep})
+			}
+		}
+		records = append(records, record)
+	}
+	return writeDCF(w, records)
+}
+
+// WriteFiles writes the `PACKAGES` and `PACKAGES.gz` files to `dir`.
+func (i *Index) WriteFiles(dir string) error {
+	var b bytes.Buffer
+	if err := i.Write(&b); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, packagesFile), b.Bytes(), 0644); err != nil {
+		return fmt.Errorf("error writing %s: %s", packagesFile, err)
+	}
+
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	if _, err := gw.Write(b.Bytes()); err != nil {
+		return fmt.Errorf("error compressing %s: %s", packagesGzFile, err)
+	}
+	if err := gw.Close(); err != nil {
+		return fmt.Errorf("error compressing %s: %s", packagesGzFile, err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, packagesGzFile), gz.Bytes(), 0644); err != nil {
+		return fmt.Errorf("error writing %s: %s", packagesGzFile, err)
+	}
+	return nil
+}
+
+// sorted returns the entries sorted by package name and version, keeping only the latest
+// version of each package when `LatestOnly` is set.
+func (i *Index) sorted() []Entry {
+	entries := make([]Entry, len(i.entries))
+	copy(entries, i.entries)
+	sort.SliceStable(entries, func(a, b int) bool {
+		nameA, nameB := entries[a].field("Package"), entries[b].field("Package")
+		if nameA != nameB {
+			return nameA < nameB
+		}
+		return compareVersions(entries[a].field("Version"), entries[b].field("Version")) < 0
+	})
+	if !i.LatestOnly {
+		return entries
+	}
+
+	latest := make([]Entry, 0, len(entries))
+	for _, entry := range entries {
+		if n := len(latest); n > 0 && latest[n-1].field("Package") == entry.field("Package") {
+			latest[n-1] = entry
+			continue
+		}
+		latest = append(latest, entry)
+	}
+	return latest
+}
+
+// compareVersions compares R package versions, falling back to comparing the strings when
+// either version cannot be parsed.
+func compareVersions(a, b string) int {
+	va, errA := version.ParseNewVersion(a)
+	vb, errB := version.ParseNewVersion(b)
+	if errA != nil || errB != nil {
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+		return 0
+	}
+	return version.CompareVersions(va, vb)
+}
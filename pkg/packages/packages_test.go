@@ -0,0 +1,145 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package packages
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/archive"
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/metadata"
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/rewriter"
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/utils"
+)
+
+func TestPackagesSuite(t *testing.T) {
+	suite.Run(t, &PackagesSuite{})
+}
+
+type PackagesSuite struct {
+	suite.Suite
+}
+
+func entry(fields ...string) Entry {
+	var fs metadata.Fields
+	for i := 0; i < len(fields); i += 2 {
+		fs = append(fs, metadata.Field{Name: fields[i], Value: fields[i+1]})
+	}
+	return Entry{Fields: fs, MD5sum: "0123456789abcdef0123456789abcdef"}
+}
+
+func (s *PackagesSuite) TestWrite() {
+	index := NewIndex(TypeSource)
+	index.Add(entry("Package", "b", "Version", "1.0", "Title", "Not in PACKAGES",
+		"Imports", "methods,\n    stats", "License", "MIT + file LICENSE", "NeedsCompilation", "no"))
+	index.Add(entry("Package", "a", "Version", "1.10", "Depends", "R (>= 3.5.0)", "License", "GPL-2"))
+	index.Add(entry("Package", "a", "Version", "1.9", "License", "GPL-2"))
+
+	var b bytes.Buffer
+	s.Require().Nil(index.Write(&b))
+	s.Require().Equal(`Package: a
+Version: 1.10
+Depends: R (>= 3.5.0)
+License: GPL-2
+MD5sum: 0123456789abcdef0123456789abcdef
+
+Package: b
+Version: 1.0
+Imports: methods, stats
+License: MIT + file LICENSE
+MD5sum: 0123456789abcdef0123456789abcdef
+NeedsCompilation: no
+`, b.String())
+
+	// Every version can be kept
+	index.LatestOnly = false
+	b.Reset()
+	s.Require().Nil(index.Write(&b))
+	records, err := metadata.ParseDCF(b.Bytes())
+	s.Require().Nil(err)
+	s.Require().Len(records, 3)
+	v, _ := records[0].Get("Version")
+	s.Require().Equal("1.9", v)
+
+	// Binary indexes have no NeedsCompilation field
+	index = NewIndex(TypeWinBinary)
+	index.Add(entry("Package", "b", "Version", "1.0", "NeedsCompilation", "yes"))
+	b.Reset()
+	s.Require().Nil(index.Write(&b))
+	s.Require().NotContains(b.String(), "NeedsCompilation")
+}
+
+func (s *PackagesSuite) TestWriteFiles() {
+	root := s.T().TempDir()
+	contrib := filepath.Join(root, "files")
+	s.Require().Nil(os.Mkdir(contrib, 0755))
+	fpg, err := utils.NewFilePathGetterFactory().GetFilePathGetter(2)
+	s.Require().Nil(err)
+	opts := rewriter.Options{RewriteOptions: archive.RewriteOptions{Digests: []archive.Digest{archive.DigestMD5}}}
+	rw := rewriter.NewRPackageRewriter(contrib, s.T().TempDir(), s.T().TempDir(), fpg, 1024, 6, opts)
+
+	index := NewIndex(TypeSource)
+	for _, path := range []string{"../testdata/DT_0.4.tar.gz", "../testdata/adhoc_1.1.tar.gz"} {
+		results, err := rw.Rewrite(path)
+		s.Require().Nil(err)
+		s.Require().Nil(index.AddResults(results, root))
+	}
+	s.Require().Nil(index.WriteFiles(root))
+
+	packages, err := os.ReadFile(filepath.Join(root, "PACKAGES"))
+	s.Require().Nil(err)
+	records, err := metadata.ParseDCF(packages)
+	s.Require().Nil(err)
+	s.Require().Len(records, 2)
+	for _, record := range records {
+		// The package files are found with Path and File
+		path, _ := record.Get("Path")
+		s.Require().Equal("files", path)
+		file, _ := record.Get("File")
+		data, err := os.ReadFile(filepath.Join(root, path, file))
+		s.Require().Nil(err)
+		sum, _ := record.Get("MD5sum")
+		s.Require().Equal(fmt.Sprintf("%x", md5.Sum(data)), sum)
+
+		// Fields follow the write_PACKAGES layout
+		names := make([]string, 0, len(record))
+		for _, f := range record {
+			names = append(names, f.Name)
+		}
+		s.Require().Equal("Package", names[0])
+		s.Require().Equal([]string{"MD5sum", "NeedsCompilation", "Path", "File"}, names[len(names)-4:])
+	}
+	name, _ := records[0].Get("Package")
+	s.Require().Equal("DT", name)
+
+	// PACKAGES.gz holds the same index
+	f, err := os.Open(filepath.Join(root, "PACKAGES.gz"))
+	s.Require().Nil(err)
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+	gr, err := gzip.NewReader(f)
+	s.Require().Nil(err)
+	gz, err := io.ReadAll(gr)
+	s.Require().Nil(err)
+	s.Require().Equal(packages, gz)
+}
+
+func (s *PackagesSuite) TestNewEntryRequiresMD5() {
+	_, err := NewEntry(&archive.RewriteResults{}, "")
+	s.Require().ErrorContains(err, "no MD5 checksum for rewritten package")
+
+	results := &archive.RewriteResults{
+		Results: archive.Results{RewrittenDigests: archive.Digests{archive.DigestMD5: "abc"}},
+	}
+	e, err := NewEntry(results, "")
+	s.Require().Nil(err)
+	s.Require().Equal(Entry{MD5sum: "abc"}, e)
+}
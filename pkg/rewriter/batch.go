@@ -0,0 +1,281 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package rewriter
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/archive"
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/store"
+)
+
+// PackageExtensions are the file extensions of the package archives found by WalkPackages.
+var PackageExtensions = []string{".tar.gz", ".tgz", ".tar.bz2", ".tar.xz", ".tar.zst", ".tar", ".zip"}
+
+// IsPackageFile returns true if `name` has one of the `PackageExtensions`.
+func IsPackageFile(name string) bool {
+	for _, ext := range PackageExtensions {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// WalkPackages returns the paths of the package archives in `dir` and its subdirectories,
+// in lexical order.
+func WalkPackages(dir string) ([]string, error) {
+	var paths []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() && IsPackageFile(d.Name()) {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error searching %s for packages: %s", dir, err)
+	}
+	return paths, nil
+}
+
+// DefaultMemoryOverhead is the memory estimated for the compression state and copy buffers
+// of a single rewrite.
+const DefaultMemoryOverhead = 4 * 1024 * 1024
+
+// NewMemoryEstimate returns a `BatchOptions.MemoryEstimate` for rewriters that hold up to
+// `spoolMemoryLimit` bytes of a spooled ZIP stream in memory, or
+// `archive.DefaultSpoolMemoryLimit` when zero. A rewrite is estimated to use
+// `DefaultMemoryOverhead`, plus the size of the package for the DESCRIPTION, MD5 and README
+// files it buffers, which are a part of the package. ZIP packages that are not regular files
+// are spooled before they are read, and are charged the whole spool limit since their size
+// is not known.
+func NewMemoryEstimate(spoolMemoryLimit int64) func(path string, size int64) int64 {
+	if spoolMemoryLimit <= 0 {
+		spoolMemoryLimit = archive.DefaultSpoolMemoryLimit
+	}
+	return func(path string, size int64) int64 {
+		estimate := DefaultMemoryOverhead + size
+		if strings.HasSuffix(path, ".zip") {
+			if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+				estimate += spoolMemoryLimit
+			}
+		}
+		return estimate
+	}
+}
+
+// DefaultMemoryEstimate estimates the memory used to rewrite a package like
+// `NewMemoryEstimate` with the default spool limit.
+func DefaultMemoryEstimate(path string, size int64) int64 {
+	return NewMemoryEstimate(0)(path, size)
+}
+
+// BatchOptions configures RewriteBatch.
+type BatchOptions struct {
+	// Workers is the number of packages rewritten at once. Defaults to
+	// `runtime.GOMAXPROCS(0)` when zero.
+	Workers int
+	// MemoryBudget bounds the sum of the `MemoryEstimate`s of the packages being rewritten
+	// at once. A package is only started once its estimate fits in the budget, and packages
+	// larger than the whole budget are rewritten alone. The budget limits the estimated
+	// memory of the rewrites, not the memory of the process. Zero means no limit.
+	MemoryBudget int64
+	// MemoryEstimate returns the number of bytes used to rewrite the package at `path`,
+	// which is `size` bytes long. Defaults to `NewMemoryEstimate` with the spool limit of
+	// the rewriters returned by NewRPackageRewriter, and to DefaultMemoryEstimate for
+	// other rewriters.
+	MemoryEstimate func(path string, size int64) int64
+	// Journal records every package that is rewritten. Packages that the journal shows were
+	// already rewritten from the same input, and whose rewritten package still exists, are
+	// skipped. The journal is not closed by RewriteBatch.
+	Journal *Journal
+	// Store is the store that `rw` writes packages to, which is checked for the rewritten
+	// packages recorded by the journal. When nil, the recorded `RewrittenPath` is checked
+	// as a local file, as written by a `store.LocalStore`.
+	Store store.Store
+}
+
+func (o BatchOptions) workers() int {
+	if o.Workers <= 0 {
+		return runtime.GOMAXPROCS(0)
+	}
+	return o.Workers
+}
+
+func (o BatchOptions) memoryEstimate(rw RPackageRewriter) func(path string, size int64) int64 {
+	if o.MemoryEstimate != nil {
+		return o.MemoryEstimate
+	}
+	if r, ok := rw.(*rPackageRewriter); ok {
+		return NewMemoryEstimate(r.opts.SpoolMemoryLimit)
+	}
+	return DefaultMemoryEstimate
+}
+
+// BatchResult holds the outcome of rewriting a single package of a batch.
+type BatchResult struct {
+	Path    string
+	Results *archive.RewriteResults
+	Err     error
+	// Skipped is true when the package was not rewritten since the journal shows it was
+	// already rewritten. `Results` are those recorded in the journal.
+	Skipped bool
+	// Changed is true when the package was rewritten again since its input changed after
+	// it was recorded in the journal.
+	Changed bool
+}
+
+// RewriteBatch rewrites the packages at `paths` with `rw`, using up to `opts.Workers`
+// packages at once, and sends the result of every package on the returned channel as it
+// completes. Packages are started in the order of `paths`. The channel is closed once
+// every package has a result, and must be read until then.
+//
+// When `ctx` is done, the packages being rewritten stop, and the packages that were not
+// started are reported with the context error.
+func RewriteBatch(ctx context.Context, rw RPackageRewriter, paths []string, opts BatchOptions) <-chan BatchResult {
+	results := make(chan BatchResult)
+	jobs := make(chan batchJob)
+	budget := newMemoryBudget(opts.MemoryBudget)
+	memoryEstimate := opts.memoryEstimate(rw)
+
+	var wg sync.WaitGroup
+	for i := 0; i < opts.workers(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				if err := ctx.Err(); err != nil {
+					budget.release(job.cost)
+					results <- BatchResult{Path: job.path, Err: err}
+					continue
+				}
+				res := rewriteJob(ctx, rw, opts, job.path)
+				budget.release(job.cost)
+				results <- res
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(jobs)
+		for _, path := range paths {
+			if err := ctx.Err(); err != nil {
+				results <- BatchResult{Path: path, Err: err}
+				continue
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				results <- BatchResult{Path: path, Err: fmt.Errorf("error: could not open %s: %s", path, err)}
+				continue
+			}
+			cost := memoryEstimate(path, info.Size())
+			if cost, err = budget.acquire(ctx, cost); err != nil {
+				results <- BatchResult{Path: path, Err: err}
+				continue
+			}
+			jobs <- batchJob{path: path, cost: cost}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
+
+// rewriteJob rewrites the package at `path` and records it in the journal of `opts`, unless
+// the journal shows it was already rewritten.
+func rewriteJob(ctx context.Context, rw RPackageRewriter, opts BatchOptions, path string) BatchResult {
+	result := BatchResult{Path: path}
+	journal := opts.Journal
+	if journal != nil {
+		res, err := journal.journalResults(ctx, path, opts.Store)
+		switch {
+		case err == errInputChanged:
+			result.Changed = true
+		case err != nil:
+			result.Err = err
+			return result
+		case res != nil:
+			result.Results = res
+			result.Skipped = true
+			return result
+		}
+	}
+
+	result.Results, result.Err = rw.RewriteContext(ctx, path)
+	if result.Err == nil && journal != nil {
+		result.Err = journal.Record(path, result.Results)
+	}
+	return result
+}
+
+type batchJob struct {
+	path string
+	cost int64
+}
+
+// memoryBudget limits the estimated memory of the packages being rewritten at once.
+type memoryBudget struct {
+	limit int64
+	used  int64
+	mu    sync.Mutex
+	cond  *sync.Cond
+}
+
+func newMemoryBudget(limit int64) *memoryBudget {
+	b := &memoryBudget{limit: limit}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// acquire waits until `n` bytes fit in the budget, or `ctx` is done, and returns the number
+// of bytes acquired. Requests larger than the whole budget acquire the whole budget.
+func (b *memoryBudget) acquire(ctx context.Context, n int64) (int64, error) {
+	if b.limit <= 0 {
+		return 0, nil
+	}
+	if n > b.limit {
+		n = b.limit
+	}
+	stop := context.AfterFunc(ctx, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.cond.Broadcast()
+	})
+	defer stop()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ctx.Err() == nil && b.used+n > b.limit {
+		b.cond.Wait()
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	b.used += n
+	return n, nil
+}
+
+// release returns `n` acquired bytes to the budget.
+func (b *memoryBudget) release(n int64) {
+	if n == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+	b.cond.Broadcast()
+}
@@ -0,0 +1,268 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package rewriter
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/archive"
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/utils"
+)
+
+func TestBatchSuite(t *testing.T) {
+	suite.Run(t, &BatchSuite{})
+}
+
+type BatchSuite struct {
+	suite.Suite
+}
+
+// concurrencyRewriter records how many packages it rewrites at once. Rewrites wait for
+// `release` to be closed, or for the context to be done.
+type concurrencyRewriter struct {
+	RPackageRewriter
+	release chan struct{}
+
+	mu      sync.Mutex
+	running int
+	max     int
+	started []string
+}
+
+func (r *concurrencyRewriter) RewriteContext(ctx context.Context, fullPath string) (*archive.RewriteResults, error) {
+	r.mu.Lock()
+	r.running++
+	r.max = max(r.max, r.running)
+	r.started = append(r.started, fullPath)
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		r.running--
+		r.mu.Unlock()
+	}()
+
+	select {
+	case <-r.release:
+		return &archive.RewriteResults{RewrittenPath: fullPath}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// packageFiles creates `n` empty package files and returns their paths.
+func (s *BatchSuite) packageFiles(n int) []string {
+	dir := s.T().TempDir()
+	paths := make([]string, n)
+	for i := range paths {
+		paths[i] = filepath.Join(dir, string(rune('a'+i))+"_1.0.tar.gz")
+		s.Require().Nil(os.WriteFile(paths[i], nil, 0644))
+	}
+	return paths
+}
+
+// collect reads every result from `results`, keyed by path.
+func (s *BatchSuite) collect(results <-chan BatchResult) map[string]BatchResult {
+	collected := make(map[string]BatchResult)
+	for res := range results {
+		_, ok := collected[res.Path]
+		s.Require().False(ok, "duplicate result for %s", res.Path)
+		collected[res.Path] = res
+	}
+	return collected
+}
+
+func (s *BatchSuite) TestWalkPackages() {
+	paths, err := WalkPackages("../testdata/binaries")
+	s.Require().Nil(err)
+	s.Require().Equal([]string{
+		"../testdata/binaries/DT_0.23.tar.gz",
+		"../testdata/binaries/bindrcpp_0.2.2-no-desc.tar.gz",
+		"../testdata/binaries/bindrcpp_0.2.2.tar.gz",
+		"../testdata/binaries/bindrcpp_0.2.2.zip",
+		"../testdata/binaries/readmetest_0.2.0.zip",
+	}, paths)
+
+	_, err = WalkPackages("../testdata/missing")
+	s.Require().ErrorContains(err, "error searching ../testdata/missing for packages")
+
+	s.Require().True(IsPackageFile("DT_0.4.tgz"))
+	s.Require().False(IsPackageFile("PACKAGES.gz"))
+}
+
+func (s *BatchSuite) TestRewriteBatch() {
+	dir := s.T().TempDir()
+	fpg, err := utils.NewFilePathGetterFactory().GetFilePathGetter(2)
+	s.Require().Nil(err)
+	rewriter := NewRPackageRewriter(dir, s.T().TempDir(), dir, fpg, 1024*2, 6, Options{})
+
+	paths := []string{
+		"../testdata/DT_0.4.tar.gz",
+		"../testdata/adhoc_1.1.tar.gz",
+		"../testdata/MortCast_2.6-1.tar.gz",
+		"../testdata/binaries/bindrcpp_0.2.2.zip",
+		"../testdata/missing_1.0.tar.gz",
+	}
+	results := s.collect(RewriteBatch(context.Background(), rewriter, paths, BatchOptions{Workers: 3}))
+	s.Require().Len(results, len(paths))
+	for _, path := range paths[:4] {
+		s.Require().Nil(results[path].Err, path)
+		s.Require().FileExists(results[path].Results.RewrittenPath)
+		data, err := os.ReadFile(path)
+		s.Require().Nil(err)
+		s.Require().Equal(fmt.Sprintf("%x", sha256.Sum256(data)), results[path].Results.OriginalChecksum, path)
+	}
+	s.Require().Nil(results[paths[4]].Results)
+	s.Require().ErrorContains(results[paths[4]].Err, "error: could not open ../testdata/missing_1.0.tar.gz")
+}
+
+func (s *BatchSuite) TestRewriteBatchWorkers() {
+	paths := s.packageFiles(6)
+	rewriter := &concurrencyRewriter{release: make(chan struct{})}
+	results := RewriteBatch(context.Background(), rewriter, paths, BatchOptions{Workers: 2})
+
+	s.Require().Eventually(func() bool {
+		rewriter.mu.Lock()
+		defer rewriter.mu.Unlock()
+		return rewriter.running == 2
+	}, time.Second, time.Millisecond)
+	close(rewriter.release)
+	s.Require().Len(s.collect(results), 6)
+	s.Require().Equal(2, rewriter.max)
+}
+
+func (s *BatchSuite) TestRewriteBatchMemoryBudget() {
+	paths := s.packageFiles(6)
+	rewriter := &concurrencyRewriter{release: make(chan struct{})}
+
+	// Only two packages fit in the budget at once
+	opts := BatchOptions{
+		Workers:      6,
+		MemoryBudget: 25,
+		MemoryEstimate: func(path string, size int64) int64 {
+			s.Require().Equal(int64(0), size)
+			return 10
+		},
+	}
+	results := RewriteBatch(context.Background(), rewriter, paths, opts)
+	s.Require().Eventually(func() bool {
+		rewriter.mu.Lock()
+		defer rewriter.mu.Unlock()
+		return rewriter.running == 2
+	}, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	close(rewriter.release)
+	s.Require().Len(s.collect(results), 6)
+	s.Require().Equal(2, rewriter.max)
+
+	// Packages larger than the budget are rewritten alone
+	rewriter = &concurrencyRewriter{release: make(chan struct{})}
+	close(rewriter.release)
+	opts.MemoryEstimate = func(path string, size int64) int64 {
+		return 100
+	}
+	results = RewriteBatch(context.Background(), rewriter, paths, opts)
+	s.Require().Len(s.collect(results), 6)
+	s.Require().Equal(1, rewriter.max)
+}
+
+func (s *BatchSuite) TestRewriteBatchDefaultMemoryEstimate() {
+	// Each package is charged its size on top of the overhead of a rewrite
+	paths := s.packageFiles(6)
+	for _, path := range paths {
+		s.Require().Nil(os.Truncate(path, 1024*1024))
+	}
+	rewriter := &concurrencyRewriter{release: make(chan struct{})}
+	opts := BatchOptions{Workers: 6, MemoryBudget: 3 * (DefaultMemoryOverhead + 1024*1024)}
+	results := RewriteBatch(context.Background(), rewriter, paths, opts)
+	s.Require().Eventually(func() bool {
+		rewriter.mu.Lock()
+		defer rewriter.mu.Unlock()
+		return rewriter.running == 3
+	}, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	close(rewriter.release)
+	s.Require().Len(s.collect(results), 6)
+	s.Require().Equal(3, rewriter.max)
+}
+
+func (s *BatchSuite) TestDefaultMemoryEstimate() {
+	dir := s.T().TempDir()
+	tarball := filepath.Join(dir, "a_1.0.tar.gz")
+	s.Require().Nil(os.WriteFile(tarball, nil, 0644))
+	s.Require().Equal(int64(DefaultMemoryOverhead+1024), DefaultMemoryEstimate(tarball, 1024))
+
+	// ZIP files are read in place
+	zip := filepath.Join(dir, "a_1.0.zip")
+	s.Require().Nil(os.WriteFile(zip, nil, 0644))
+	s.Require().Equal(int64(DefaultMemoryOverhead+1024), DefaultMemoryEstimate(zip, 1024))
+
+	// ZIP packages that are not regular files are spooled
+	stream := filepath.Join(dir, "b_1.0.zip")
+	s.Require().Nil(os.Mkdir(stream, 0755))
+	s.Require().Equal(int64(DefaultMemoryOverhead+archive.DefaultSpoolMemoryLimit), DefaultMemoryEstimate(stream, 0))
+	s.Require().Equal(int64(DefaultMemoryOverhead+4096), NewMemoryEstimate(4096)(stream, 0))
+
+	// Batches use the spool limit of the rewriter
+	rw := NewRPackageRewriter(dir, dir, dir, nil, 256, 6, Options{RewriteOptions: archive.RewriteOptions{SpoolMemoryLimit: 4096}})
+	s.Require().Equal(int64(DefaultMemoryOverhead+4096), BatchOptions{}.memoryEstimate(rw)(stream, 0))
+	s.Require().Equal(int64(DefaultMemoryOverhead+archive.DefaultSpoolMemoryLimit), BatchOptions{}.memoryEstimate(&concurrencyRewriter{})(stream, 0))
+}
+
+func (s *BatchSuite) TestRewriteBatchCancel() {
+	paths := s.packageFiles(5)
+	rewriter := &concurrencyRewriter{release: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	results := RewriteBatch(ctx, rewriter, paths, BatchOptions{Workers: 2, MemoryBudget: 1})
+
+	s.Require().Eventually(func() bool {
+		rewriter.mu.Lock()
+		defer rewriter.mu.Unlock()
+		return rewriter.running == 1
+	}, time.Second, time.Millisecond)
+	cancel()
+
+	// Every package is reported, including those that never started
+	collected := s.collect(results)
+	s.Require().Len(collected, 5)
+	var canceled []string
+	for path, res := range collected {
+		s.Require().True(errors.Is(res.Err, context.Canceled), path)
+		canceled = append(canceled, path)
+	}
+	sort.Strings(canceled)
+	s.Require().Equal(paths, canceled)
+	s.Require().Equal([]string{paths[0]}, rewriter.started)
+}
+
+func (s *BatchSuite) TestMemoryBudget() {
+	b := newMemoryBudget(0)
+	n, err := b.acquire(context.Background(), 100)
+	s.Require().Nil(err)
+	s.Require().Equal(int64(0), n)
+
+	b = newMemoryBudget(10)
+	n, err = b.acquire(context.Background(), 100)
+	s.Require().Nil(err)
+	s.Require().Equal(int64(10), n)
+
+	// Waits for the budget to be released
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = b.acquire(ctx, 1)
+	s.Require().ErrorIs(err, context.DeadlineExceeded)
+
+	go b.release(5)
+	n, err = b.acquire(context.Background(), 5)
+	s.Require().Nil(err)
+	s.Require().Equal(int64(5), n)
+}
@@ -0,0 +1,196 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package rewriter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/rstudio/package-manager-rpackagerewriter/internal/utils"
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/archive"
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/store"
+)
+
+// JournalEntry records a package that was rewritten.
+type JournalEntry struct {
+	// Path is the input path of the package.
+	Path string
+	// OriginalChecksum and OriginalSize are the SHA256 checksum and size of the input when
+	// it was rewritten. Unlike the `Results`, they are never overridden.
+	OriginalChecksum string
+	OriginalSize     int64
+	Results          *archive.RewriteResults
+}
+
+// Journal is an append-only checkpoint of the packages rewritten by a batch, stored as one
+// JSON `JournalEntry` per line. Entries are keyed by input path, and later entries replace
+// earlier ones for the same path. Since a batch may be interrupted at any point, a partial
+// last line is discarded when the journal is opened.
+type Journal struct {
+	mu      sync.Mutex
+	f       *os.File
+	entries map[string]JournalEntry
+}
+
+// OpenJournal opens the journal at `path`, creating it if needed, and loads its entries.
+func OpenJournal(path string) (*Journal, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening journal %s: %s", path, err)
+	}
+	j := &Journal{f: f, entries: make(map[string]JournalEntry)}
+	if err = j.load(); err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("error reading journal %s: %s", path, err)
+	}
+	return j, nil
+}
+
+// load reads the entries of the journal, and truncates a partial last line so that new
+// entries are appended after the last complete one.
+func (j *Journal) load() error {
+	r := bufio.NewReader(j.f)
+	var offset int64
+	for line := 1; ; line++ {
+		data, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// A line without a newline was interrupted while it was written
+			if len(data) > 0 {
+				if err = j.f.Truncate(offset); err != nil {
+					return err
+				}
+			}
+			break
+		} else if err != nil {
+			return err
+		}
+		offset += int64(len(data))
+		if len(bytes.TrimSpace(data)) == 0 {
+			continue
+		}
+		var entry JournalEntry
+		if err = json.Unmarshal(data, &entry); err != nil {
+			return fmt.Errorf("invalid entry on line %d: %s", line, err)
+		}
+		j.entries[entry.Path] = entry
+	}
+	_, err := j.f.Seek(offset, io.SeekStart)
+	return err
+}
+
+// Lookup returns the latest entry for the input `path`.
+func (j *Journal) Lookup(path string) (JournalEntry, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	entry, ok := j.entries[filepath.Clean(path)]
+	return entry, ok
+}
+
+// Record appends an entry for the package at the input `path`, which was rewritten with
+// `results`, and syncs the journal to disk. The input is recorded with the
+// `InputChecksum` and `InputSize` of `results`, which are computed while the package is
+// rewritten. Only results without them, such as those of other RPackageRewriters, have
+// their input read again.
+func (j *Journal) Record(path string, results *archive.RewriteResults) error {
+	checksum, size := results.InputChecksum, results.InputSize
+	if checksum == "" {
+		var err error
+		if checksum, size, err = fileChecksum(path); err != nil {
+			return err
+		}
+	}
+	entry := JournalEntry{
+		Path:             filepath.Clean(path),
+		OriginalChecksum: checksum,
+		OriginalSize:     size,
+		Results:          results,
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("error encoding journal entry for %s: %s", path, err)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err = j.f.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("error writing journal entry for %s: %s", path, err)
+	}
+	if err = j.f.Sync(); err != nil {
+		return fmt.Errorf("error syncing journal: %s", err)
+	}
+	j.entries[entry.Path] = entry
+	return nil
+}
+
+// Close closes the journal.
+func (j *Journal) Close() error {
+	return j.f.Close()
+}
+
+// errInputChanged is returned by journalResults when an input no longer matches its entry.
+var errInputChanged = errors.New("input changed since it was rewritten")
+
+// journalResults returns the recorded results for the package at `path` when it is
+// unchanged since it was rewritten and its rewritten package still exists in `st`, or as a
+// local file when `st` is nil. It returns errInputChanged when the input differs from the
+// journal, and nil results when the package has no entry or must be rewritten again.
+func (j *Journal) journalResults(ctx context.Context, path string, st store.Store) (*archive.RewriteResults, error) {
+	entry, ok := j.Lookup(path)
+	if !ok || entry.Results == nil {
+		return nil, nil
+	}
+
+	// A different size avoids reading the input
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("error: could not open %s: %s", path, err)
+	}
+	if info.Size() != entry.OriginalSize {
+		return nil, errInputChanged
+	}
+	checksum, _, err := fileChecksum(path)
+	if err != nil {
+		return nil, err
+	}
+	if checksum != entry.OriginalChecksum {
+		return nil, errInputChanged
+	}
+
+	var here bool
+	switch {
+	case st == nil:
+		here, _ = utils.FileExists(entry.Results.RewrittenPath)
+	case entry.Results.RewrittenKey != "":
+		if here, err = st.Exists(ctx, entry.Results.RewrittenKey); err != nil {
+			return nil, fmt.Errorf("error checking for the rewritten package of %s: %s", path, err)
+		}
+	}
+	if !here {
+		return nil, nil
+	}
+	return entry.Results, nil
+}
+
+// fileChecksum returns the SHA256 checksum and size of the file at `path`.
+func fileChecksum(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, fmt.Errorf("error: could not open %s: %s", path, err)
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+	hr := utils.NewHashingReader(f)
+	if _, err = io.Copy(io.Discard, hr); err != nil {
+		return "", 0, fmt.Errorf("error reading %s: %s", path, err)
+	}
+	return hex.EncodeToString(hr.Sum()), hr.Size(), nil
+}
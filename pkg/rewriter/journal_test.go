@@ -0,0 +1,218 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package rewriter
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/archive"
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/store"
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/utils"
+)
+
+func TestJournalSuite(t *testing.T) {
+	suite.Run(t, &JournalSuite{})
+}
+
+type JournalSuite struct {
+	suite.Suite
+}
+
+func (s *JournalSuite) TestJournal() {
+	dir := s.T().TempDir()
+	a := filepath.Join(dir, "a.tar.gz")
+	b := filepath.Join(dir, "b.tar.gz")
+	s.Require().Nil(os.WriteFile(a, []byte("a"), 0644))
+	s.Require().Nil(os.WriteFile(b, []byte("bb"), 0644))
+
+	path := filepath.Join(dir, "journal.jsonl")
+	j, err := OpenJournal(path)
+	s.Require().Nil(err)
+	_, ok := j.Lookup(a)
+	s.Require().False(ok)
+
+	s.Require().Nil(j.Record(filepath.Join(dir, ".", "a.tar.gz"), &archive.RewriteResults{Results: archive.Results{OriginalChecksum: "1"}}))
+	s.Require().Nil(j.Record(b, &archive.RewriteResults{Results: archive.Results{OriginalChecksum: "2"}}))
+	s.Require().Nil(j.Record(a, &archive.RewriteResults{Results: archive.Results{OriginalChecksum: "3"}}))
+	s.Require().ErrorContains(j.Record(filepath.Join(dir, "missing.tar.gz"), &archive.RewriteResults{}), "could not open")
+
+	// The checksum computed by the rewrite is recorded without reading the input again
+	c := filepath.Join(dir, "c.tar.gz")
+	s.Require().Nil(j.Record(c, &archive.RewriteResults{InputChecksum: "4", InputSize: 4}))
+	s.Require().Nil(j.Close())
+
+	// The latest entry for each path is loaded, with the checksum of the input
+	j, err = OpenJournal(path)
+	s.Require().Nil(err)
+	entry, ok := j.Lookup(a)
+	s.Require().True(ok)
+	s.Require().Equal(a, entry.Path)
+	s.Require().Equal(fmt.Sprintf("%x", sha256.Sum256([]byte("a"))), entry.OriginalChecksum)
+	s.Require().Equal(int64(1), entry.OriginalSize)
+	s.Require().Equal("3", entry.Results.OriginalChecksum)
+	entry, ok = j.Lookup(b)
+	s.Require().True(ok)
+	s.Require().Equal(int64(2), entry.OriginalSize)
+	s.Require().Equal("2", entry.Results.OriginalChecksum)
+	entry, ok = j.Lookup(filepath.Join(dir, "c.tar.gz"))
+	s.Require().True(ok)
+	s.Require().Equal("4", entry.OriginalChecksum)
+	s.Require().Equal(int64(4), entry.OriginalSize)
+	s.Require().Nil(j.Close())
+}
+
+func (s *JournalSuite) TestJournalInterrupted() {
+	path := filepath.Join(s.T().TempDir(), "journal.jsonl")
+	s.Require().Nil(os.WriteFile(path, []byte(`{"Path":"a.tar.gz","OriginalChecksum":"1"}`+"\n"+`{"Path":"b.tar.`), 0644))
+
+	// The partial line is discarded and new entries follow the last complete one
+	j, err := OpenJournal(path)
+	s.Require().Nil(err)
+	_, ok := j.Lookup("b.tar.gz")
+	s.Require().False(ok)
+	c := filepath.Join(filepath.Dir(path), "c.tar.gz")
+	s.Require().Nil(os.WriteFile(c, nil, 0644))
+	s.Require().Nil(j.Record(c, &archive.RewriteResults{}))
+	s.Require().Nil(j.Close())
+
+	data, err := os.ReadFile(path)
+	s.Require().Nil(err)
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	s.Require().Len(lines, 2)
+	s.Require().Equal(`{"Path":"a.tar.gz","OriginalChecksum":"1"}`, lines[0])
+	s.Require().True(strings.HasPrefix(lines[1], `{"Path":"`+c+`",`), lines[1])
+	j, err = OpenJournal(path)
+	s.Require().Nil(err)
+	_, ok = j.Lookup(c)
+	s.Require().True(ok)
+	s.Require().Nil(j.Close())
+
+	// Complete lines must be valid
+	s.Require().Nil(os.WriteFile(path, []byte("{}\nnot json\n{}\n"), 0644))
+	_, err = OpenJournal(path)
+	s.Require().ErrorContains(err, "invalid entry on line 2")
+}
+
+func (s *JournalSuite) TestRewriteBatchJournal() {
+	inputDir := s.T().TempDir()
+	outputDir := s.T().TempDir()
+	var paths []string
+	for _, name := range []string{"DT_0.4.tar.gz", "adhoc_1.1.tar.gz", "MortCast_2.6-1.tar.gz"} {
+		data, err := os.ReadFile(filepath.Join("../testdata", name))
+		s.Require().Nil(err)
+		paths = append(paths, filepath.Join(inputDir, name))
+		s.Require().Nil(os.WriteFile(paths[len(paths)-1], data, 0644))
+	}
+	fpg, err := utils.NewFilePathGetterFactory().GetFilePathGetter(2)
+	s.Require().Nil(err)
+	rewriter := NewRPackageRewriter(outputDir, s.T().TempDir(), outputDir, fpg, 1024*2, 6, Options{})
+
+	journalPath := filepath.Join(s.T().TempDir(), "journal.jsonl")
+	run := func() map[string]BatchResult {
+		journal, err := OpenJournal(journalPath)
+		s.Require().Nil(err)
+		defer func() {
+			s.Require().Nil(journal.Close())
+		}()
+		results := make(map[string]BatchResult)
+		for res := range RewriteBatch(context.Background(), rewriter, paths, BatchOptions{Workers: 2, Journal: journal}) {
+			s.Require().Nil(res.Err, res.Path)
+			results[res.Path] = res
+		}
+		s.Require().Len(results, len(paths))
+		return results
+	}
+
+	first := run()
+	for _, res := range first {
+		s.Require().False(res.Skipped)
+		s.Require().False(res.Changed)
+	}
+
+	// Completed packages are skipped on restart
+	second := run()
+	for path, res := range second {
+		s.Require().True(res.Skipped, path)
+		s.Require().Equal(first[path].Results.RewrittenPath, res.Results.RewrittenPath)
+		s.Require().Equal(first[path].Results.RewrittenChecksum, res.Results.RewrittenChecksum)
+		s.Require().Equal(first[path].Results.DescriptionFields.Bytes(), res.Results.DescriptionFields.Bytes())
+	}
+
+	// Changed inputs and missing outputs are rewritten
+	data, err := os.ReadFile("../testdata/ff_2.2-14.tar.gz")
+	s.Require().Nil(err)
+	s.Require().Nil(os.WriteFile(paths[0], data, 0644))
+	s.Require().Nil(os.Remove(first[paths[1]].Results.RewrittenPath))
+	third := run()
+	s.Require().True(third[paths[0]].Changed)
+	s.Require().False(third[paths[0]].Skipped)
+	name, _ := third[paths[0]].Results.DescriptionFields.Get("Package")
+	s.Require().Equal("ff", name)
+	s.Require().False(third[paths[1]].Changed)
+	s.Require().False(third[paths[1]].Skipped)
+	s.Require().FileExists(third[paths[1]].Results.RewrittenPath)
+	s.Require().True(third[paths[2]].Skipped)
+
+	// Inputs are compared with their own checksum even when the results are overridden
+	s.Require().Nil(os.WriteFile(paths[2]+".original.checksum", []byte("abc\n"), 0644))
+	s.Require().Nil(os.Remove(third[paths[2]].Results.RewrittenPath))
+	fourth := run()
+	s.Require().False(fourth[paths[2]].Changed)
+	s.Require().Equal("abc", fourth[paths[2]].Results.OriginalChecksum)
+	input, err := os.ReadFile(paths[2])
+	s.Require().Nil(err)
+	s.Require().Equal(fmt.Sprintf("%x", sha256.Sum256(input)), fourth[paths[2]].Results.InputChecksum)
+	fifth := run()
+	s.Require().True(fifth[paths[2]].Skipped)
+	s.Require().Equal("abc", fifth[paths[2]].Results.OriginalChecksum)
+}
+
+func (s *JournalSuite) TestRewriteBatchJournalStore() {
+	paths := []string{"../testdata/DT_0.4.tar.gz", "../testdata/adhoc_1.1.tar.gz"}
+	fpg, err := utils.NewFilePathGetterFactory().GetFilePathGetter(2)
+	s.Require().Nil(err)
+	journal, err := OpenJournal(filepath.Join(s.T().TempDir(), "journal.jsonl"))
+	s.Require().Nil(err)
+	defer func() {
+		s.Require().Nil(journal.Close())
+	}()
+	run := func(packages store.Store, opts BatchOptions) map[string]BatchResult {
+		rewriter := NewRPackageRewriter("", "", s.T().TempDir(), fpg, 1024*2, 6,
+			Options{Store: packages, ReadmeStore: store.NewMemoryStore()})
+		opts.Journal = journal
+		results := make(map[string]BatchResult)
+		for res := range RewriteBatch(context.Background(), rewriter, paths, opts) {
+			s.Require().Nil(res.Err, res.Path)
+			results[res.Path] = res
+		}
+		return results
+	}
+
+	packages := store.NewMemoryStore()
+	first := run(packages, BatchOptions{Store: packages})
+	for _, res := range first {
+		s.Require().False(res.Skipped)
+		s.Require().Equal(res.Results.OriginalChecksum+".tar.gz", res.Results.RewrittenKey)
+	}
+
+	// Packages in the store are skipped, even though their locations are not local files
+	for path, res := range run(packages, BatchOptions{Store: packages}) {
+		s.Require().True(res.Skipped, path)
+		s.Require().Equal(first[path].Results.RewrittenKey, res.Results.RewrittenKey)
+	}
+
+	// Packages missing from the store are rewritten
+	packages = store.NewMemoryStore()
+	for path, res := range run(packages, BatchOptions{Store: packages}) {
+		s.Require().False(res.Skipped, path)
+		_, ok := packages.Get(res.Results.RewrittenKey)
+		s.Require().True(ok)
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package rewriter
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/rstudio/package-manager-rpackagerewriter/internal/utils"
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/archive"
+)
+
+// MetadataOverrides maps the names of `archive.Results` fields to the JSON encoding of the
+// values that replace them, such as `{"OriginalChecksum": "..."}`. Overriding a field does
+// not update the fields derived from it; for example, `Description` and
+// `DescriptionFields` are overridden separately.
+type MetadataOverrides map[string]json.RawMessage
+
+// MetadataOverrideSource provides the overrides for the results of rewritten packages. This
+// is used when recreating manifests, where packages must keep metadata such as the checksum
+// of their upstream archive.
+type MetadataOverrideSource interface {
+	// Overrides returns the overrides for the package at `path`, which was rewritten with
+	// `results`. `path` is empty for packages rewritten from a stream. It returns nil when
+	// there are no overrides for the package.
+	Overrides(path string, results *archive.Results) (MetadataOverrides, error)
+}
+
+// OriginalChecksumSidecar overrides `OriginalChecksum` with the contents of the
+// `<path>.original.checksum` file next to a package, when it exists. This is the default
+// MetadataOverrideSource of a rewriter.
+type OriginalChecksumSidecar struct{}
+
+func (OriginalChecksumSidecar) Overrides(path string, results *archive.Results) (MetadataOverrides, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if here, _ := utils.FileExists(path + ".original.checksum"); !here {
+		return nil, nil
+	}
+	bts, err := os.ReadFile(path + ".original.checksum")
+	if err != nil {
+		return nil, err
+	}
+	checksum, err := json.Marshal(strings.TrimSpace(string(bts)))
+	if err != nil {
+		return nil, err
+	}
+	return MetadataOverrides{"OriginalChecksum": checksum}, nil
+}
+
+// SidecarOverrides reads the overrides of a package from the JSON object in the
+// `<path><Suffix>` file next to it, when it exists.
+type SidecarOverrides struct {
+	// Suffix is appended to the path of a package to find its overrides. Defaults to
+	// `DefaultSidecarSuffix` when empty.
+	Suffix string
+}
+
+// DefaultSidecarSuffix is the suffix of the files read by SidecarOverrides.
+const DefaultSidecarSuffix = ".overrides.json"
+
+func (s SidecarOverrides) Overrides(path string, results *archive.Results) (MetadataOverrides, error) {
+	if path == "" {
+		return nil, nil
+	}
+	suffix := s.Suffix
+	if suffix == "" {
+		suffix = DefaultSidecarSuffix
+	}
+	if here, _ := utils.FileExists(path + suffix); !here {
+		return nil, nil
+	}
+	bts, err := os.ReadFile(path + suffix)
+	if err != nil {
+		return nil, err
+	}
+	var overrides MetadataOverrides
+	if err = json.Unmarshal(bts, &overrides); err != nil {
+		return nil, fmt.Errorf("error reading overrides %s: %s", path+suffix, err)
+	}
+	return overrides, nil
+}
+
+// MapOverrides holds the overrides of packages in memory. Packages are looked up by their
+// original checksum first, so that packages rewritten from streams can be overridden, and
+// then by path.
+type MapOverrides map[string]MetadataOverrides
+
+func (m MapOverrides) Overrides(path string, results *archive.Results) (MetadataOverrides, error) {
+	if overrides, ok := m[results.OriginalChecksum]; ok {
+		return overrides, nil
+	}
+	if path == "" {
+		return nil, nil
+	}
+	return m[path], nil
+}
+
+// ManifestOverrides holds the overrides for the packages of a directory, read from a JSON
+// manifest that maps package paths relative to the manifest, or original checksums, to
+// their overrides:
+//
+//	{
+//	  "src/contrib/DT_0.4.tar.gz": {"OriginalChecksum": "..."},
+//	  "3daa96b8...": {"Repository": "CRAN"}
+//	}
+type ManifestOverrides struct {
+	dir       string
+	overrides MapOverrides
+}
+
+// LoadManifestOverrides reads the manifest at `path`.
+func LoadManifestOverrides(path string) (*ManifestOverrides, error) {
+	bts, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading overrides manifest %s: %s", path, err)
+	}
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	m := &ManifestOverrides{dir: dir}
+	if err = json.Unmarshal(bts, &m.overrides); err != nil {
+		return nil, fmt.Errorf("error reading overrides manifest %s: %s", path, err)
+	}
+	return m, nil
+}
+
+func (m *ManifestOverrides) Overrides(path string, results *archive.Results) (MetadataOverrides, error) {
+	if overrides, ok := m.overrides[results.OriginalChecksum]; ok {
+		return overrides, nil
+	}
+	if path == "" {
+		return nil, nil
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	rel, err := filepath.Rel(m.dir, abs)
+	if err != nil {
+		return nil, nil
+	}
+	return m.overrides[filepath.ToSlash(rel)], nil
+}
+
+// OverrideSources combines several sources. Overrides from later sources replace those of
+// earlier sources for the same field.
+type OverrideSources []MetadataOverrideSource
+
+func (s OverrideSources) Overrides(path string, results *archive.Results) (MetadataOverrides, error) {
+	var combined MetadataOverrides
+	for _, source := range s {
+		overrides, err := source.Overrides(path, results)
+		if err != nil {
+			return nil, err
+		}
+		for name, value := range overrides {
+			if combined == nil {
+				combined = make(MetadataOverrides)
+			}
+			combined[name] = value
+		}
+	}
+	return combined, nil
+}
+
+// applyOverrides replaces the fields of `results` named by `overrides`.
+func applyOverrides(results *archive.Results, overrides MetadataOverrides) error {
+	v := reflect.ValueOf(results).Elem()
+	for name, value := range overrides {
+		field, ok := v.Type().FieldByName(name)
+		if !ok || !field.IsExported() || len(field.Index) != 1 {
+			return fmt.Errorf("cannot override unknown result field '%s'", name)
+		}
+		replacement := reflect.New(field.Type)
+		if err := json.Unmarshal(value, replacement.Interface()); err != nil {
+			return fmt.Errorf("error overriding result field '%s': %s", name, err)
+		}
+		v.FieldByIndex(field.Index).Set(replacement.Elem())
+	}
+	return nil
+}
+
+// overrideResults applies the overrides configured for the package at `path`.
+func (r *rPackageRewriter) overrideResults(path string, results *archive.Results) error {
+	source := r.opts.Overrides
+	if source == nil {
+		source = OriginalChecksumSidecar{}
+	}
+	overrides, err := source.Overrides(path, results)
+	if err != nil {
+		return fmt.Errorf("error getting overrides: %s", err)
+	}
+	return applyOverrides(results, overrides)
+}
@@ -0,0 +1,185 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package rewriter
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/archive"
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/metadata"
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/utils"
+)
+
+func TestOverridesSuite(t *testing.T) {
+	suite.Run(t, &OverridesSuite{})
+}
+
+type OverridesSuite struct {
+	suite.Suite
+}
+
+// dtChecksum is the SHA256 checksum of `../testdata/DT_0.4.tar.gz`.
+const dtChecksum = "3daa96b819ca54e5fbc2c7d78cb3637982a2d44be58cea0683663b71cfc7fa19"
+
+// newRewriter returns a rewriter that writes to a temporary directory with `overrides`.
+func (s *OverridesSuite) newRewriter(overrides MetadataOverrideSource) (RPackageRewriter, string) {
+	dir := s.T().TempDir()
+	fpg, err := utils.NewFilePathGetterFactory().GetFilePathGetter(2)
+	s.Require().Nil(err)
+	return NewRPackageRewriter(dir, s.T().TempDir(), dir, fpg, 1024*2, 6, Options{Overrides: overrides}), dir
+}
+
+// copyPackage copies `../testdata/<name>` to a temporary directory and returns its path.
+func (s *OverridesSuite) copyPackage(name string) string {
+	data, err := os.ReadFile(filepath.Join("../testdata", name))
+	s.Require().Nil(err)
+	path := filepath.Join(s.T().TempDir(), name)
+	s.Require().Nil(os.WriteFile(path, data, 0644))
+	return path
+}
+
+func (s *OverridesSuite) TestApplyOverrides() {
+	results := &archive.Results{
+		OriginalChecksum: "abc",
+		OriginalSize:     10,
+		OriginalDigests:  archive.Digests{archive.DigestMD5: "1", archive.DigestSHA1: "2"},
+	}
+	s.Require().Nil(applyOverrides(results, MetadataOverrides{
+		"OriginalSize":      json.RawMessage(`20`),
+		"OriginalDigests":   json.RawMessage(`{"md5": "3"}`),
+		"DescriptionFields": json.RawMessage(`[{"name": "Package", "value": "DT"}]`),
+		"MD5":               json.RawMessage(`{"Missing": ["R/a.R"]}`),
+	}))
+	s.Require().Equal(&archive.Results{
+		OriginalChecksum:  "abc",
+		OriginalSize:      20,
+		OriginalDigests:   archive.Digests{archive.DigestMD5: "3"},
+		DescriptionFields: metadata.Fields{{Name: "Package", Value: "DT"}},
+		MD5:               &archive.MD5Verification{Missing: []string{"R/a.R"}},
+	}, results)
+
+	s.Require().EqualError(applyOverrides(results, MetadataOverrides{"Unknown": json.RawMessage(`1`)}),
+		"cannot override unknown result field 'Unknown'")
+	s.Require().ErrorContains(applyOverrides(results, MetadataOverrides{"OriginalSize": json.RawMessage(`"big"`)}),
+		"error overriding result field 'OriginalSize'")
+	s.Require().Equal(int64(20), results.OriginalSize)
+}
+
+func (s *OverridesSuite) TestOriginalChecksumSidecar() {
+	path := s.copyPackage("DT_0.4.tar.gz")
+	s.Require().Nil(os.WriteFile(path+".original.checksum", []byte("abc\n"), 0644))
+
+	// The sidecar is read by default, and names the rewritten package
+	rewriter, dir := s.newRewriter(nil)
+	results, err := rewriter.Rewrite(path)
+	s.Require().Nil(err)
+	s.Require().Equal("abc", results.OriginalChecksum)
+	s.Require().Equal(filepath.Join(dir, "abc.tar.gz"), results.RewrittenPath)
+
+	// Other sources replace it
+	rewriter, _ = s.newRewriter(MapOverrides{})
+	results, err = rewriter.Rewrite(path)
+	s.Require().Nil(err)
+	s.Require().Equal(dtChecksum, results.OriginalChecksum)
+}
+
+func (s *OverridesSuite) TestSidecarOverrides() {
+	path := s.copyPackage("DT_0.4.tar.gz")
+	s.Require().Nil(os.WriteFile(path+".overrides.json", []byte(`{"OriginalChecksum": "abc", "OriginalSize": 1}`), 0644))
+	s.Require().Nil(os.WriteFile(path+".meta", []byte(`{"ReadmeMarkdown": false}`), 0644))
+
+	rewriter, _ := s.newRewriter(SidecarOverrides{})
+	results, err := rewriter.Rewrite(path)
+	s.Require().Nil(err)
+	s.Require().Equal("abc", results.OriginalChecksum)
+	s.Require().Equal(int64(1), results.OriginalSize)
+	s.Require().True(results.ReadmeMarkdown)
+
+	rewriter, _ = s.newRewriter(SidecarOverrides{Suffix: ".meta"})
+	results, err = rewriter.Rewrite(path)
+	s.Require().Nil(err)
+	s.Require().Equal(dtChecksum, results.OriginalChecksum)
+	s.Require().False(results.ReadmeMarkdown)
+
+	// Invalid overrides fail the rewrite
+	s.Require().Nil(os.WriteFile(path+".overrides.json", []byte(`{"Size": 1}`), 0644))
+	rewriter, _ = s.newRewriter(SidecarOverrides{})
+	_, err = rewriter.Rewrite(path)
+	s.Require().ErrorContains(err, "cannot override unknown result field 'Size'")
+}
+
+func (s *OverridesSuite) TestManifestOverrides() {
+	path := s.copyPackage("DT_0.4.tar.gz")
+	manifest := filepath.Join(filepath.Dir(path), "overrides.json")
+	s.Require().Nil(os.WriteFile(manifest, []byte(`{
+		"DT_0.4.tar.gz": {"OriginalChecksum": "abc"},
+		"`+dtChecksum+`": {"OriginalSize": 1}
+	}`), 0644))
+	overrides, err := LoadManifestOverrides(manifest)
+	s.Require().Nil(err)
+
+	// Checksums take precedence over paths
+	rewriter, _ := s.newRewriter(overrides)
+	results, err := rewriter.Rewrite(path)
+	s.Require().Nil(err)
+	s.Require().Equal(dtChecksum, results.OriginalChecksum)
+	s.Require().Equal(int64(1), results.OriginalSize)
+
+	// Paths are relative to the manifest
+	s.Require().Nil(os.WriteFile(manifest, []byte(`{"DT_0.4.tar.gz": {"OriginalChecksum": "abc"}}`), 0644))
+	overrides, err = LoadManifestOverrides(manifest)
+	s.Require().Nil(err)
+	rewriter, _ = s.newRewriter(overrides)
+	results, err = rewriter.Rewrite(path)
+	s.Require().Nil(err)
+	s.Require().Equal("abc", results.OriginalChecksum)
+	results, err = rewriter.Rewrite("../testdata/DT_0.4.tar.gz")
+	s.Require().Nil(err)
+	s.Require().Equal(dtChecksum, results.OriginalChecksum)
+
+	_, err = LoadManifestOverrides(filepath.Join(filepath.Dir(path), "missing.json"))
+	s.Require().ErrorContains(err, "error reading overrides manifest")
+}
+
+func (s *OverridesSuite) TestStreamOverrides() {
+	overrides := MapOverrides{dtChecksum: {"Description": json.RawMessage(`"Package: DT\n"`)}}
+	rewriter, _ := s.newRewriter(overrides)
+	data, err := os.ReadFile("../testdata/DT_0.4.tar.gz")
+	s.Require().Nil(err)
+
+	var b bytes.Buffer
+	results, err := rewriter.RewriteStream(bytes.NewReader(data), &b)
+	s.Require().Nil(err)
+	s.Require().Equal("Package: DT\n", results.Description)
+
+	b.Reset()
+	results, err = rewriter.RewriteBinary(bytes.NewReader(data), &b)
+	s.Require().Nil(err)
+	s.Require().Equal("Package: DT\n", results.Description)
+	// Only the overridden fields change
+	title, _ := results.DescriptionFields.Get("Title")
+	s.Require().Equal("A Wrapper of the JavaScript Library 'DataTables'", title)
+	s.Require().Equal(int64(b.Len()), results.RewrittenSize)
+}
+
+func (s *OverridesSuite) TestOverrideSources() {
+	path := s.copyPackage("DT_0.4.tar.gz")
+	s.Require().Nil(os.WriteFile(path+".original.checksum", []byte("abc"), 0644))
+	s.Require().Nil(os.WriteFile(path+".overrides.json", []byte(`{"OriginalChecksum": "def", "OriginalSize": 1}`), 0644))
+
+	// Later sources win
+	rewriter, _ := s.newRewriter(OverrideSources{
+		SidecarOverrides{},
+		OriginalChecksumSidecar{},
+		MapOverrides{path: {"OriginalSize": json.RawMessage(`2`)}},
+	})
+	results, err := rewriter.Rewrite(path)
+	s.Require().Nil(err)
+	s.Require().Equal("abc", results.OriginalChecksum)
+	s.Require().Equal(int64(2), results.OriginalSize)
+}
@@ -2,16 +2,21 @@
 package rewriter
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
-	"strings"
 
-	"github.com/rstudio/package-manager-rpackagerewriter/internal/utils"
 	"github.com/rstudio/package-manager-rpackagerewriter/pkg/archive"
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/store"
 	fpg "github.com/rstudio/package-manager-rpackagerewriter/pkg/utils"
 )
 
+// ErrNoDescription is the cause of the RPackageRewriteError returned for package binaries
+// that do not have a DESCRIPTION file.
+var ErrNoDescription = errors.New("no DESCRIPTION file found in archive")
+
 // NewRPackageRewriteError creates a RPackageRewriteError
 func NewRPackageRewriteError(err error) RPackageRewriteError {
 	return RPackageRewriteError{error: err}
@@ -26,18 +31,72 @@ func (r RPackageRewriteError) Error() string {
 	return r.error.Error()
 }
 
+// Unwrap returns the underlying error
+func (r RPackageRewriteError) Unwrap() error {
+	return r.error
+}
+
 // Is returns true if an error is a RPackageRewriteError
 func (r RPackageRewriteError) Is(err error) bool {
 	_, ok := err.(RPackageRewriteError)
 	return ok
 }
 
+// RPackageValidationError records a package that failed the archive safety validation
+// configured by `archive.RewriteOptions.Validation`. It is a RPackageRewriteError that names
+// the violated rule and the offending entry, if any.
+type RPackageValidationError struct {
+	RPackageRewriteError
+	Violation archive.Violation
+	Entry     string
+}
+
+// asValidationError returns a RPackageValidationError if `err` was caused by a package that
+// failed validation.
+func asValidationError(err error) (RPackageValidationError, bool) {
+	var verr *archive.ValidationError
+	if !errors.As(err, &verr) {
+		return RPackageValidationError{}, false
+	}
+	return RPackageValidationError{
+		RPackageRewriteError: RPackageRewriteError{error: err},
+		Violation:            verr.Violation,
+		Entry:                verr.Entry,
+	}, true
+}
+
 // RPackageRewriter support rewriting source and binary packages
 type RPackageRewriter interface {
 	Rewrite(fullPath string) (*archive.RewriteResults, error)
 	RewriteStream(r io.Reader, w io.Writer) (*archive.RewriteResults, error)
-	RewriteBinary(r *os.File, w io.Writer, zip bool) (*archive.RewriteResults, error)
+	RewriteBinary(r io.Reader, w io.Writer) (*archive.RewriteResults, error)
 	GetReadme(stream io.Reader) (*archive.RewriteResults, error)
+
+	// The Context variants stop with the context error when `ctx` is canceled or its
+	// deadline passes, even while a read from the package is blocked, and remove any
+	// temporary files they created.
+	RewriteContext(ctx context.Context, fullPath string) (*archive.RewriteResults, error)
+	RewriteStreamContext(ctx context.Context, r io.Reader, w io.Writer) (*archive.RewriteResults, error)
+	RewriteBinaryContext(ctx context.Context, r io.Reader, w io.Writer) (*archive.RewriteResults, error)
+	GetReadmeContext(ctx context.Context, stream io.Reader) (*archive.RewriteResults, error)
+}
+
+// Options configures an RPackageRewriter. The embedded `archive.RewriteOptions` are passed
+// through to every archive the rewriter creates.
+type Options struct {
+	archive.RewriteOptions
+
+	// Overrides replaces fields of the results of rewritten packages. Defaults to
+	// OriginalChecksumSidecar when nil; use an empty MapOverrides to disable it.
+	Overrides MetadataOverrideSource
+
+	// Store receives the rewritten packages, under the keys of the FilePathGetter.
+	// `RewrittenPath` is the location returned by the store. Defaults to a
+	// `store.LocalStore` for the output directory when nil.
+	Store store.Store
+	// ReadmeStore receives the extracted READMEs. Defaults to a `store.LocalStore` for the
+	// README output directory when nil.
+	ReadmeStore store.Store
 }
 
 type rPackageRewriter struct {
@@ -45,24 +104,42 @@ type rPackageRewriter struct {
 	ReadmeOutputDir string
 	tempDir         string
 	fpg             fpg.FilePathGetter
+	store           store.Store
+	readmeStore     store.Store
 	bufferSize      int
 	gzipLevel       int
+	opts            Options
 }
 
 // NewRPackageRewriter creates a new RPackageRewriter
-func NewRPackageRewriter(outputDir, readmeOutputDir, tempDir string, fpg fpg.FilePathGetter, bufferSize, gzipLevel int) RPackageRewriter {
-	return &rPackageRewriter{
+func NewRPackageRewriter(outputDir, readmeOutputDir, tempDir string, fpg fpg.FilePathGetter, bufferSize, gzipLevel int, opts Options) RPackageRewriter {
+	r := &rPackageRewriter{
 		OutputDir:       outputDir,
 		ReadmeOutputDir: readmeOutputDir,
 		tempDir:         tempDir,
 		fpg:             fpg,
+		store:           opts.Store,
+		readmeStore:     opts.ReadmeStore,
 		bufferSize:      bufferSize,
 		gzipLevel:       gzipLevel,
+		opts:            opts,
+	}
+	if r.store == nil {
+		r.store = store.NewLocalStore(outputDir)
+	}
+	if r.readmeStore == nil {
+		r.readmeStore = store.NewLocalStore(readmeOutputDir)
 	}
+	return r
 }
 
 // Rewrite rewrites a source package
 func (r *rPackageRewriter) Rewrite(fullPath string) (*archive.RewriteResults, error) {
+	return r.RewriteContext(context.Background(), fullPath)
+}
+
+// RewriteContext rewrites a source package, and stops when `ctx` is done
+func (r *rPackageRewriter) RewriteContext(ctx context.Context, fullPath string) (*archive.RewriteResults, error) {
 	f, err := os.Open(fullPath)
 	if err != nil {
 		return nil, fmt.Errorf("error: could not open %s: %s", fullPath, err)
@@ -71,154 +148,145 @@ func (r *rPackageRewriter) Rewrite(fullPath string) (*archive.RewriteResults, er
 		_ = f.Close()
 	}(f)
 
-	w, err := os.CreateTemp(r.OutputDir, "")
+	w, err := r.store.Create(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("error: could not create temp file for %s. %s", fullPath, err)
 	}
-	tempFileName := w.Name()
-	defer func(err *error) {
-		if *err != nil {
-			_ = os.Remove(tempFileName)
-		}
-	}(&err)
+	defer func() {
+		_ = w.Abort()
+	}()
 
-	wReadme, err := os.CreateTemp(r.ReadmeOutputDir, "")
+	wReadme, err := r.readmeStore.Create(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("error: could not create readme temp file for %s. %s", fullPath, err)
 	}
-	tempFileNameReadme := wReadme.Name()
-	defer func(err *error) {
-		if *err != nil {
-			_ = os.Remove(tempFileNameReadme)
-		}
-	}(&err)
+	defer func() {
+		_ = wReadme.Abort()
+	}()
 
 	// Rewrite the file and save using the checksum as the filename.
-	arch := archive.NewRPackageArchive(r.bufferSize, r.gzipLevel)
+	readme := &countingWriter{w: wReadme}
 	var aResults *archive.Results
-	if aResults, err = arch.RewriteWithReadme(f, w, wReadme); err != nil {
-		return nil, fmt.Errorf("error rewriting %s: %s", w.Name(), err)
+	if aResults, err = r.rewriteArchive(ctx, f, w, readme); err != nil {
+		if verr, ok := asValidationError(err); ok {
+			err = verr
+		}
+		return nil, fmt.Errorf("error rewriting %s: %w", fullPath, err)
 	}
 
-	readmeStat, err := wReadme.Stat()
-	if err != nil {
-		return nil, fmt.Errorf("error getting readme stats on %s: %s", wReadme.Name(), err)
-	}
-	_ = wReadme.Close()
-
-	// Special case where we recreate a manifest by recording original checksums in a special file.
-	if here, _ := utils.FileExists(fullPath + ".original.checksum"); here {
-		var bts []byte
-		var origFile *os.File
-		origFile, err = os.Open(fullPath + ".original.checksum")
-		if err != nil {
-			return nil, err
-		}
-		defer func() {
-			_ = origFile.Close()
-		}()
-		bts, err = io.ReadAll(origFile)
-		if err != nil {
-			return nil, err
-		}
-		aResults.OriginalChecksum = strings.TrimSpace(string(bts))
+	// Apply overrides before naming the rewritten package, since its name may depend on them
+	inputChecksum, inputSize := aResults.OriginalChecksum, aResults.OriginalSize
+	if err = r.overrideResults(fullPath, aResults); err != nil {
+		return nil, fmt.Errorf("error rewriting %s: %w", fullPath, err)
 	}
 
-	// Move the temp file
-	checksumFilePath := r.fpg.GetFilePath(r.OutputDir, aResults)
-	err = os.Rename(tempFileName, checksumFilePath)
+	// Commit the rewritten package and its README together, so that either both or neither
+	// are stored
+	writers := []store.Writer{w}
+	keys := []string{r.fpg.GetFileKey(aResults)}
+	if readme.n > 0 {
+		writers = append(writers, wReadme)
+		keys = append(keys, r.fpg.GetReadmeKey(aResults))
+	}
+	locations, err := store.CommitAll(ctx, writers, keys)
 	if err != nil {
-		return nil, fmt.Errorf("error moving file %s to %s: %s", tempFileName, checksumFilePath, err)
+		return nil, fmt.Errorf("error storing %s: %s", fullPath, err)
 	}
-
-	// Move the temp README file
-	checksumFilePathReadme := ""
-	if readmeStat.Size() > 0 {
-		checksumFilePathReadme = r.fpg.GetReadmePath(r.ReadmeOutputDir, aResults)
-		err = os.Rename(tempFileNameReadme, checksumFilePathReadme)
-		if err != nil {
-			return nil, fmt.Errorf("error moving readme file %s to %s: %s", tempFileNameReadme, checksumFilePathReadme, err)
-		}
-	} else {
-		err = os.Remove(tempFileNameReadme)
-		if err != nil {
-			return nil, fmt.Errorf("error removing empty temp readme file %s: %s", tempFileNameReadme, err)
-		}
+	rewrittenPath := locations[0]
+	readmePath := ""
+	if len(locations) > 1 {
+		readmePath = locations[1]
 	}
 
 	return &archive.RewriteResults{
 		Results:             *aResults,
-		RewrittenPath:       checksumFilePath,
-		ExtractedReadmePath: checksumFilePathReadme,
+		RewrittenPath:       rewrittenPath,
+		RewrittenKey:        keys[0],
+		ExtractedReadmePath: readmePath,
+		InputChecksum:       inputChecksum,
+		InputSize:           inputSize,
 	}, nil
 }
 
+// commitReadme stores the README written to `w` under its key, and returns its location.
+// Empty READMEs are discarded, and have no location.
+func (r *rPackageRewriter) commitReadme(ctx context.Context, w store.Writer, size int64, aResults *archive.Results) (string, error) {
+	if size == 0 {
+		if err := w.Abort(); err != nil {
+			return "", fmt.Errorf("error removing empty temp readme: %s", err)
+		}
+		return "", nil
+	}
+	key := r.fpg.GetReadmeKey(aResults)
+	path, err := store.Commit(ctx, w, key)
+	if err != nil {
+		return "", fmt.Errorf("error storing readme as %s: %s", key, err)
+	}
+	return path, nil
+}
+
 // RewriteStream rewrites a package in a single stream
 func (r *rPackageRewriter) RewriteStream(reader io.Reader, w io.Writer) (*archive.RewriteResults, error) {
-	wReadme, err := os.CreateTemp(r.ReadmeOutputDir, "")
+	return r.RewriteStreamContext(context.Background(), reader, w)
+}
+
+// RewriteStreamContext rewrites a package in a single stream, and stops when `ctx` is done
+func (r *rPackageRewriter) RewriteStreamContext(ctx context.Context, reader io.Reader, w io.Writer) (*archive.RewriteResults, error) {
+	wReadme, err := r.readmeStore.Create(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("error: could not create readme temp file for stream. %s", err)
 	}
-	tempFileNameReadme := wReadme.Name()
-	defer func(err *error) {
-		if *err != nil {
-			_ = os.Remove(tempFileNameReadme)
-		}
-	}(&err)
+	defer func() {
+		_ = wReadme.Abort()
+	}()
 
 	// Rewrite the file and save using the checksum as the filename.
-	arch := archive.NewRPackageArchive(r.bufferSize, r.gzipLevel)
+	readme := &countingWriter{w: wReadme}
 	var aResults *archive.Results
-	if aResults, err = arch.RewriteWithReadme(reader, w, wReadme); err != nil {
-		return nil, fmt.Errorf("error rewriting stream: %s", err)
+	if aResults, err = r.rewriteArchive(ctx, reader, w, readme); err != nil {
+		if verr, ok := asValidationError(err); ok {
+			err = verr
+		}
+		return nil, fmt.Errorf("error rewriting stream: %w", err)
+	}
+	if err = r.overrideResults("", aResults); err != nil {
+		return nil, fmt.Errorf("error rewriting stream: %w", err)
 	}
 
-	readmeStat, err := wReadme.Stat()
+	readmePath, err := r.commitReadme(ctx, wReadme, readme.n, aResults)
 	if err != nil {
-		return nil, fmt.Errorf("error getting readme stats on %s: %s", wReadme.Name(), err)
-	}
-	_ = wReadme.Close()
-
-	// Move the temp README file
-	checksumFilePathReadme := ""
-	if readmeStat.Size() > 0 {
-		checksumFilePathReadme = r.fpg.GetReadmePath(r.ReadmeOutputDir, aResults)
-		err = os.Rename(tempFileNameReadme, checksumFilePathReadme)
-		if err != nil {
-			return nil, fmt.Errorf("error moving readme file %s to %s: %s", tempFileNameReadme, checksumFilePathReadme, err)
-		}
-	} else {
-		err = os.Remove(tempFileNameReadme)
-		if err != nil {
-			return nil, fmt.Errorf("error removing empty temp readme file %s: %s", tempFileNameReadme, err)
-		}
+		return nil, err
 	}
 
 	return &archive.RewriteResults{
 		Results:             *aResults,
-		ExtractedReadmePath: checksumFilePathReadme,
+		ExtractedReadmePath: readmePath,
 	}, nil
 }
 
-// RewriteBinary rewrites a package binary
-func (r *rPackageRewriter) RewriteBinary(file *os.File, w io.Writer, zip bool) (*archive.RewriteResults, error) {
-	var err error
-	var aResults *archive.Results
-	if zip {
-		arch := archive.NewRPackageZipArchive(r.bufferSize)
-		aResults, err = arch.RewriteBinary(file, w)
-	} else {
-		arch := archive.NewRPackageArchive(r.bufferSize, r.gzipLevel)
-		aResults, err = arch.RewriteBinary(file, w)
-	}
+// RewriteBinary rewrites a package binary. ZIP binaries that are not read from a regular file
+// or another `io.ReaderAt` are spooled to memory or a temporary file in the rewriter's temp
+// directory first.
+func (r *rPackageRewriter) RewriteBinary(reader io.Reader, w io.Writer) (*archive.RewriteResults, error) {
+	return r.RewriteBinaryContext(context.Background(), reader, w)
+}
 
+// RewriteBinaryContext rewrites a package binary like `RewriteBinary`, and stops when `ctx`
+// is done.
+func (r *rPackageRewriter) RewriteBinaryContext(ctx context.Context, reader io.Reader, w io.Writer) (*archive.RewriteResults, error) {
+	aResults, err := r.rewriteArchive(ctx, reader, w, nil)
 	if err != nil {
+		if verr, ok := asValidationError(err); ok {
+			return nil, fmt.Errorf("error rewriting stream: %w", verr)
+		}
 		return nil, fmt.Errorf("error rewriting stream: %w", RPackageRewriteError{error: err})
 	}
 
 	// Require a DESCRIPTION
 	if aResults.Description == "" {
-		err = fmt.Errorf("no DESCRIPTION file found in archive")
+		return nil, fmt.Errorf("error rewriting stream: %w", RPackageRewriteError{error: ErrNoDescription})
+	}
+	if err = r.overrideResults("", aResults); err != nil {
 		return nil, fmt.Errorf("error rewriting stream: %w", RPackageRewriteError{error: err})
 	}
 
@@ -227,51 +295,93 @@ func (r *rPackageRewriter) RewriteBinary(file *os.File, w io.Writer, zip bool) (
 	}, nil
 }
 
-// GetReadme retrieves a README from an R package
+// rewriteArchive detects the format of the package read from `reader` and rewrites it with
+// the matching archive type. The README is only extracted when `wReadme` is not nil.
+func (r *rPackageRewriter) rewriteArchive(ctx context.Context, reader io.Reader, w, wReadme io.Writer) (*archive.Results, error) {
+	format, reader, err := archive.DetectFormat(reader)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	if format == archive.FormatZip {
+		arch := archive.NewRPackageZipArchive(r.bufferSize, r.zipOptions())
+		return arch.RewriteWithReadmeContext(ctx, reader, w, wReadme)
+	}
+	arch := archive.NewRPackageArchive(r.bufferSize, r.gzipLevel, r.opts.RewriteOptions)
+	return arch.RewriteWithReadmeContext(ctx, reader, w, wReadme)
+}
+
+// contextError returns the context error instead of `err` once `ctx` is done.
+func contextError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// zipOptions returns the archive options for ZIP binaries, spooling to the rewriter's
+// temp directory unless another directory was configured.
+func (r *rPackageRewriter) zipOptions() archive.RewriteOptions {
+	opts := r.opts.RewriteOptions
+	if opts.TempDir == "" {
+		opts.TempDir = r.tempDir
+	}
+	return opts
+}
+
+// GetReadme retrieves a README from an R package in any format supported by `archive.DetectFormat`.
 func (r *rPackageRewriter) GetReadme(stream io.Reader) (*archive.RewriteResults, error) {
-	arc := &archive.RPackageArchive{}
+	return r.GetReadmeContext(context.Background(), stream)
+}
+
+// GetReadmeContext retrieves a README like `GetReadme`, and stops when `ctx` is done.
+func (r *rPackageRewriter) GetReadmeContext(ctx context.Context, stream io.Reader) (*archive.RewriteResults, error) {
 	results := &archive.RewriteResults{}
 
-	wReadme, err := os.CreateTemp(r.ReadmeOutputDir, "")
+	wReadme, err := r.readmeStore.Create(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("error: could not create readme temp file: %s", err)
 	}
-	tempFileNameReadme := wReadme.Name()
-	defer func(err *error) {
-		if *err != nil {
-			_ = os.Remove(tempFileNameReadme)
-		}
-	}(&err)
+	defer func() {
+		_ = wReadme.Abort()
+	}()
 
 	// Rewrite the file and save using the checksum as the filename.
+	readme := &countingWriter{w: wReadme}
 	var markdown bool
-	if markdown, err = arc.GetReadme(stream, wReadme); err != nil {
-		return nil, fmt.Errorf("error getting readme %s: %s", wReadme.Name(), err)
+	var format archive.Format
+	if format, stream, err = archive.DetectFormat(stream); err != nil {
+		return nil, fmt.Errorf("error getting readme: %w", contextError(ctx, err))
+	}
+	if format == archive.FormatZip {
+		arc := archive.NewRPackageZipArchive(r.bufferSize, r.zipOptions())
+		markdown, err = arc.GetReadmeContext(ctx, stream, readme)
+	} else {
+		arc := &archive.RPackageArchive{}
+		markdown, err = arc.GetReadmeContext(ctx, stream, readme)
 	}
-
-	readmeStat, err := wReadme.Stat()
 	if err != nil {
-		return nil, fmt.Errorf("error getting readme stats on %s: %s", wReadme.Name(), err)
+		return nil, fmt.Errorf("error getting readme: %w", err)
 	}
-	_ = wReadme.Close()
-
-	// Move the temp README file
-	checksumFilePathReadme := ""
-	if readmeStat.Size() > 0 {
-		checksumFilePathReadme = r.fpg.GetReadmePath(r.ReadmeOutputDir, &archive.Results{ReadmeMarkdown: markdown})
-		err = os.Rename(tempFileNameReadme, checksumFilePathReadme)
-		if err != nil {
-			return nil, fmt.Errorf("error moving readme file %s to %s: %s", tempFileNameReadme, checksumFilePathReadme, err)
-		}
-	} else {
-		err = os.Remove(tempFileNameReadme)
-		if err != nil {
-			return nil, fmt.Errorf("error removing empty temp readme file %s: %s", tempFileNameReadme, err)
-		}
+
+	readmePath, err := r.commitReadme(ctx, wReadme, readme.n, &archive.Results{ReadmeMarkdown: markdown})
+	if err != nil {
+		return nil, err
 	}
 
-	// Track the changes in the checkpoint JSON.
-	results.ExtractedReadmePath = checksumFilePathReadme
+	results.ExtractedReadmePath = readmePath
+	results.ReadmeMarkdown = markdown
 
 	return results, nil
 }
+
+// countingWriter counts the bytes written to a README, since empty READMEs are discarded.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -3,15 +3,24 @@ package rewriter
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"errors"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/suite"
+	"github.com/ulikunitz/xz"
 
 	"github.com/rstudio/package-manager-rpackagerewriter/internal/test"
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/archive"
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/store"
 	"github.com/rstudio/package-manager-rpackagerewriter/pkg/utils"
 )
 
@@ -28,14 +37,17 @@ func (s *RewriterSuite) TestNewArchiveRewriter() {
 	s.Require().Nil(err)
 	fpg, err := utils.NewFilePathGetterFactory().GetFilePathGetter(1)
 	s.Require().Nil(err)
-	r := NewRPackageRewriter("outputDir", "readmeDir", dir, fpg, 256, 6)
+	r := NewRPackageRewriter("outputDir", "readmeDir", dir, fpg, 256, 6, Options{})
 	s.Require().Equal(&rPackageRewriter{
 		OutputDir:       "outputDir",
 		ReadmeOutputDir: "readmeDir",
 		tempDir:         dir,
 		fpg:             fpg,
+		store:           store.NewLocalStore("outputDir"),
+		readmeStore:     store.NewLocalStore("readmeDir"),
 		bufferSize:      256,
 		gzipLevel:       6,
+		opts:            Options{},
 	}, r)
 }
 
@@ -45,7 +57,7 @@ func (s *RewriterSuite) TestArchiveRewriterRewrite() {
 	s.Require().Nil(err)
 	fpg, err := utils.NewFilePathGetterFactory().GetFilePathGetter(1)
 	s.Require().Nil(err)
-	rewriter := NewRPackageRewriter(dir, readmeDir, dir, fpg, 1024*2, 6)
+	rewriter := NewRPackageRewriter(dir, readmeDir, dir, fpg, 1024*2, 6, Options{})
 	results, err := rewriter.Rewrite("../testdata/adhoc_1.1.tar.gz")
 	s.Require().Nil(err)
 	s.Require().Equal(int64(27126), results.OriginalSize)
@@ -78,13 +90,27 @@ Encoding: UTF-8
 	s.Require().Equal(true, os.IsNotExist(err))
 }
 
+func (s *RewriterSuite) TestArchiveRewriterRewriteRepository() {
+	dir, _ := os.MkdirTemp("", "")
+	readmeDir, err := os.MkdirTemp("", "readme")
+	s.Require().Nil(err)
+	fpg, err := utils.NewFilePathGetterFactory().GetFilePathGetter(1)
+	s.Require().Nil(err)
+	opts := Options{RewriteOptions: archive.RewriteOptions{Repository: "Internal"}}
+	rewriter := NewRPackageRewriter(dir, readmeDir, dir, fpg, 1024*2, 6, opts)
+	results, err := rewriter.Rewrite("../testdata/adhoc_1.1.tar.gz")
+	s.Require().Nil(err)
+	s.Require().Contains(results.Description, "\nRepository: Internal\n")
+	s.Require().NotContains(results.Description, "RSPM")
+}
+
 func (s *RewriterSuite) TestArchiveRewriterRewriteStream() {
 	dir, _ := os.MkdirTemp("", "")
 	readmeDir, err := os.MkdirTemp("", "readme")
 	s.Require().Nil(err)
 	fpg, err := utils.NewFilePathGetterFactory().GetFilePathGetter(1)
 	s.Require().Nil(err)
-	rewriter := NewRPackageRewriter(dir, readmeDir, dir, fpg, 1024*2, 6)
+	rewriter := NewRPackageRewriter(dir, readmeDir, dir, fpg, 1024*2, 6, Options{})
 	f, err := os.Open("../testdata/adhoc_1.1.tar.gz")
 	s.Require().Nil(err)
 	w := bytes.NewBuffer([]byte{})
@@ -128,7 +154,7 @@ func (s *RewriterSuite) TestArchiveRewriterGetNoReadme() {
 	s.Require().Nil(err)
 	fpg, err := utils.NewFilePathGetterFactory().GetFilePathGetter(1)
 	s.Require().Nil(err)
-	rewriter := NewRPackageRewriter("", readmeDir, dir, fpg, 256, 6)
+	rewriter := NewRPackageRewriter("", readmeDir, dir, fpg, 256, 6, Options{})
 	f, err := os.Open("../testdata/adhoc_1.1.tar.gz")
 	s.Require().Nil(err)
 	archive, err := rewriter.GetReadme(f)
@@ -141,6 +167,27 @@ func (s *RewriterSuite) TestArchiveRewriterGetNoReadme() {
 	s.Require().Equal(true, os.IsNotExist(err))
 }
 
+func (s *RewriterSuite) TestArchiveRewriterGetReadmeZip() {
+	dir, err := os.MkdirTemp("", "")
+	s.Require().Nil(err)
+	readmeDir, err := os.MkdirTemp("", "readme")
+	s.Require().Nil(err)
+	fpg, err := utils.NewFilePathGetterFactory().GetFilePathGetter(1)
+	s.Require().Nil(err)
+	rewriter := NewRPackageRewriter("", readmeDir, dir, fpg, 256, 6, Options{})
+	f, err := os.Open("../testdata/binaries/readmetest_0.2.0.zip")
+	s.Require().Nil(err)
+	archive, err := rewriter.GetReadme(f)
+	s.Require().Nil(err)
+
+	// Find readme file
+	s.Require().True(archive.ReadmeMarkdown)
+	s.Require().True(strings.HasSuffix(archive.ExtractedReadmePath, ".readme.md"))
+	readme, err := os.ReadFile(archive.ExtractedReadmePath)
+	s.Require().Nil(err)
+	s.Require().Equal("Hi, I'm the correct readme!", string(readme))
+}
+
 func (s *RewriterSuite) TestArchiveRewriterRewriteReadme() {
 	dir, err := os.MkdirTemp("", "")
 	s.Require().Nil(err)
@@ -148,7 +195,7 @@ func (s *RewriterSuite) TestArchiveRewriterRewriteReadme() {
 	s.Require().Nil(err)
 	fpg, err := utils.NewFilePathGetterFactory().GetFilePathGetter(2)
 	s.Require().Nil(err)
-	rewriter := NewRPackageRewriter(dir, readmeDir, dir, fpg, 256, 6)
+	rewriter := NewRPackageRewriter(dir, readmeDir, dir, fpg, 256, 6, Options{})
 	archive, err := rewriter.Rewrite("../testdata/readmetest_0.2.0.tar.gz")
 	s.Require().Nil(err)
 	s.Require().Equal(`Package: readmetest
@@ -177,13 +224,124 @@ Repository: RSPM
 	test.TestifyGolden(string(readme), &s.Suite)
 }
 
+func (s *RewriterSuite) TestArchiveRewriterStore() {
+	packages := store.NewMemoryStore()
+	readmes := store.NewMemoryStore()
+	fpg, err := utils.NewFilePathGetterFactory().GetFilePathGetter(2)
+	s.Require().Nil(err)
+	rewriter := NewRPackageRewriter("", "", s.T().TempDir(), fpg, 256, 6, Options{Store: packages, ReadmeStore: readmes})
+
+	results, err := rewriter.Rewrite("../testdata/readmetest_0.2.0.tar.gz")
+	s.Require().Nil(err)
+	s.Require().Equal(results.OriginalChecksum+".tar.gz", results.RewrittenPath)
+	s.Require().Equal(results.OriginalChecksum+".readme.md", results.ExtractedReadmePath)
+	data, ok := packages.Get(results.RewrittenPath)
+	s.Require().True(ok)
+	s.Require().Equal(int64(len(data)), results.RewrittenSize)
+	readme, ok := readmes.Get(results.ExtractedReadmePath)
+	s.Require().True(ok)
+	s.Require().Equal("Hi, I'm the correct readme!", string(readme))
+
+	// Failed rewrites and empty READMEs are not stored
+	_, err = rewriter.Rewrite("../testdata/binaries/bindrcpp_0.2.2.zip")
+	s.Require().Nil(err)
+	results, err = rewriter.GetReadme(bytes.NewReader([]byte("not a package")))
+	s.Require().NotNil(err)
+	s.Require().Nil(results)
+	s.Require().Len(packages.Keys(), 2)
+	s.Require().Len(readmes.Keys(), 1)
+}
+
+// Stored packages are named after the format they were written in.
+func (s *RewriterSuite) TestArchiveRewriterStoreFormats() {
+	packages := store.NewMemoryStore()
+	fpg, err := utils.NewFilePathGetterFactory().GetFilePathGetter(2)
+	s.Require().Nil(err)
+	opts := Options{
+		RewriteOptions: archive.RewriteOptions{Output: archive.OutputKeepInput},
+		Store:          packages,
+		ReadmeStore:    store.NewMemoryStore(),
+	}
+	rewriter := NewRPackageRewriter("", "", s.T().TempDir(), fpg, 256, 6, opts)
+
+	results, err := rewriter.Rewrite("../testdata/binaries/bindrcpp_0.2.2.zip")
+	s.Require().Nil(err)
+	s.Require().Equal(results.OriginalChecksum+".zip", results.RewrittenPath)
+
+	// Recompress a tarball with xz, which is kept with OutputKeepInput
+	f, err := os.Open("../testdata/readmetest_0.2.0.tar.gz")
+	s.Require().Nil(err)
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	s.Require().Nil(err)
+	path := filepath.Join(s.T().TempDir(), "readmetest_0.2.0.tar.xz")
+	out, err := os.Create(path)
+	s.Require().Nil(err)
+	xw, err := xz.NewWriter(out)
+	s.Require().Nil(err)
+	_, err = io.Copy(xw, gr)
+	s.Require().Nil(err)
+	s.Require().Nil(xw.Close())
+	s.Require().Nil(out.Close())
+
+	results, err = rewriter.Rewrite(path)
+	s.Require().Nil(err)
+	s.Require().Equal(archive.FormatXz, results.RewrittenFormat)
+	s.Require().Equal(results.OriginalChecksum+".tar.xz", results.RewrittenPath)
+	_, ok := packages.Get(results.RewrittenPath)
+	s.Require().True(ok)
+}
+
+// failingStore is a store whose writers fail to commit.
+type failingStore struct {
+	store.Store
+}
+
+func (f failingStore) Create(ctx context.Context) (store.Writer, error) {
+	w, err := f.Store.Create(ctx)
+	return failingWriter{Writer: w}, err
+}
+
+type failingWriter struct {
+	store.Writer
+}
+
+func (f failingWriter) Commit(ctx context.Context) (string, error) {
+	return "", errors.New("commit failed")
+}
+
+func (s *RewriterSuite) TestArchiveRewriterStoreTransaction() {
+	dir := s.T().TempDir()
+	readmeDir := s.T().TempDir()
+	fpg, err := utils.NewFilePathGetterFactory().GetFilePathGetter(2)
+	s.Require().Nil(err)
+
+	// The package is not stored when its README cannot be
+	readmes := failingStore{Store: store.NewLocalStore(readmeDir)}
+	rewriter := NewRPackageRewriter(dir, readmeDir, dir, fpg, 256, 6, Options{ReadmeStore: readmes})
+	_, err = rewriter.Rewrite("../testdata/readmetest_0.2.0.tar.gz")
+	s.Require().ErrorContains(err, "commit failed")
+	entries, err := os.ReadDir(dir)
+	s.Require().Nil(err)
+	s.Require().Empty(entries)
+	entries, err = os.ReadDir(readmeDir)
+	s.Require().Nil(err)
+	s.Require().Empty(entries)
+
+	// Packages without a README do not depend on it
+	results, err := rewriter.Rewrite("../testdata/adhoc_1.1.tar.gz")
+	s.Require().Nil(err)
+	s.Require().FileExists(results.RewrittenPath)
+	s.Require().Empty(results.ExtractedReadmePath)
+}
+
 func (s *RewriterSuite) TestArchiveRewriterRewriteReadmeStream() {
 	dir, _ := os.MkdirTemp("", "")
 	readmeDir, err := os.MkdirTemp("", "readme")
 	s.Require().Nil(err)
 	fpg, err := utils.NewFilePathGetterFactory().GetFilePathGetter(2)
 	s.Require().Nil(err)
-	rewriter := NewRPackageRewriter(dir, readmeDir, dir, fpg, 256, 6)
+	rewriter := NewRPackageRewriter(dir, readmeDir, dir, fpg, 256, 6, Options{})
 	f, err := os.Open("../testdata/readmetest_0.2.0.tar.gz")
 	s.Require().Nil(err)
 	w := bytes.NewBuffer([]byte{})
@@ -222,7 +380,7 @@ func (s *RewriterSuite) TestArchiveRewriterGetReadme() {
 	s.Require().Nil(err)
 	fpg, err := utils.NewFilePathGetterFactory().GetFilePathGetter(2)
 	s.Require().Nil(err)
-	rewriter := NewRPackageRewriter("", readmeDir, dir, fpg, 256, 6)
+	rewriter := NewRPackageRewriter("", readmeDir, dir, fpg, 256, 6, Options{})
 	f, err := os.Open("../testdata/readmetest_0.2.0.tar.gz")
 	s.Require().Nil(err)
 	archive, err := rewriter.GetReadme(f)
@@ -242,9 +400,11 @@ func (s *RewriterSuite) TestArchiveRewriterCleanup() {
 	s.Require().Nil(err)
 	fpg, err := utils.NewFilePathGetterFactory().GetFilePathGetter(2)
 	s.Require().Nil(err)
-	rewriter := NewRPackageRewriter(dir, readmeDir, dir, fpg, 256, 6)
-	// Attempt will fail since ff_2.2-14.zip is not an archive
-	_, err = rewriter.Rewrite("../testdata/ff_2.2-14.zip")
+	rewriter := NewRPackageRewriter(dir, readmeDir, dir, fpg, 256, 6, Options{})
+	invalid := filepath.Join(s.T().TempDir(), "invalid_1.0.tar.gz")
+	s.Require().Nil(os.WriteFile(invalid, []byte("this is a test file\nwith no archive content\n."), 0644))
+	// Attempt will fail since invalid_1.0.tar.gz is not an archive
+	_, err = rewriter.Rewrite(invalid)
 	s.Require().ErrorContains(err, "error rewriting")
 
 	// Ensure that the output directories are empty
@@ -267,11 +427,10 @@ func (s *RewriterSuite) TestArchiveRewriterStreamCleanup() {
 	s.Require().Nil(err)
 	fpg, err := utils.NewFilePathGetterFactory().GetFilePathGetter(2)
 	s.Require().Nil(err)
-	rewriter := NewRPackageRewriter(dir, readmeDir, dir, fpg, 256, 6)
-	f, err := os.Open("../testdata/ff_2.2-14.zip")
-	s.Require().Nil(err)
+	rewriter := NewRPackageRewriter(dir, readmeDir, dir, fpg, 256, 6, Options{})
+	f := bytes.NewBufferString("this is a test file\nwith no archive content\n.")
 	w := bytes.NewBuffer([]byte{})
-	// Attempt will fail since ff_2.2-14.zip is not an archive
+	// Attempt will fail since the stream is not an archive
 	_, err = rewriter.RewriteStream(f, w)
 	s.Require().ErrorContains(err, "error rewriting")
 
@@ -295,11 +454,11 @@ func (s *RewriterSuite) TestArchiveRewriterRewriteBinaryTar() {
 	s.Require().Nil(err)
 	fpg, err := utils.NewFilePathGetterFactory().GetFilePathGetter(1)
 	s.Require().Nil(err)
-	rewriter := NewRPackageRewriter(dir, readmeDir, dir, fpg, 1024*2, 6)
+	rewriter := NewRPackageRewriter(dir, readmeDir, dir, fpg, 1024*2, 6, Options{})
 	f, err := os.Open("../testdata/binaries/bindrcpp_0.2.2.tar.gz")
 	s.Require().Nil(err)
 	w := bytes.NewBuffer([]byte{})
-	results, err := rewriter.RewriteBinary(f, w, false)
+	results, err := rewriter.RewriteBinary(f, w)
 	s.Require().Nil(err)
 	s.Require().Equal(int64(813035), results.OriginalSize)
 	s.Require().Equal(int64(831722), results.RewrittenSize)
@@ -343,11 +502,11 @@ func (s *RewriterSuite) TestArchiveRewriterRewriteBinaryTarNoDescription() {
 	s.Require().Nil(err)
 	fpg, err := utils.NewFilePathGetterFactory().GetFilePathGetter(1)
 	s.Require().Nil(err)
-	rewriter := NewRPackageRewriter(dir, readmeDir, dir, fpg, 1024*2, 6)
+	rewriter := NewRPackageRewriter(dir, readmeDir, dir, fpg, 1024*2, 6, Options{})
 	f, err := os.Open("../testdata/binaries/bindrcpp_0.2.2-no-desc.tar.gz")
 	s.Require().Nil(err)
 	w := bytes.NewBuffer([]byte{})
-	_, err = rewriter.RewriteBinary(f, w, false)
+	_, err = rewriter.RewriteBinary(f, w)
 	s.Require().ErrorContains(err, "error rewriting stream: no DESCRIPTION file found in archive")
 	s.Require().Equal(true, errors.Is(err, RPackageRewriteError{}))
 }
@@ -358,11 +517,11 @@ func (s *RewriterSuite) TestArchiveRewriterRewriteBinaryZip() {
 	s.Require().Nil(err)
 	fpg, err := utils.NewFilePathGetterFactory().GetFilePathGetter(1)
 	s.Require().Nil(err)
-	rewriter := NewRPackageRewriter(dir, readmeDir, dir, fpg, 1024*2, 6)
+	rewriter := NewRPackageRewriter(dir, readmeDir, dir, fpg, 1024*2, 6, Options{})
 	f, err := os.Open("../testdata/binaries/bindrcpp_0.2.2.zip")
 	s.Require().Nil(err)
 	w := bytes.NewBuffer([]byte{})
-	results, err := rewriter.RewriteBinary(f, w, true)
+	results, err := rewriter.RewriteBinary(f, w)
 	s.Require().Nil(err)
 	s.Require().Equal(int64(412918), results.OriginalSize)
 	s.Require().Equal(int64(431367), results.RewrittenSize)
@@ -401,3 +560,192 @@ Repository: RSPM
 `, results.Description)
 	s.Require().Equal(431367, w.Len())
 }
+
+func (s *RewriterSuite) TestArchiveRewriterRewriteBinaryZipStream() {
+	dir, _ := os.MkdirTemp("", "")
+	readmeDir, err := os.MkdirTemp("", "readme")
+	s.Require().Nil(err)
+	fpg, err := utils.NewFilePathGetterFactory().GetFilePathGetter(1)
+	s.Require().Nil(err)
+	opts := Options{RewriteOptions: archive.RewriteOptions{SpoolMemoryLimit: 1024}}
+	rewriter := NewRPackageRewriter(dir, readmeDir, dir, fpg, 1024*2, 6, opts)
+	f, err := os.Open("../testdata/binaries/bindrcpp_0.2.2.zip")
+	s.Require().Nil(err)
+	w := bytes.NewBuffer([]byte{})
+
+	// Hide the *os.File so that the stream must be spooled to the temp directory
+	results, err := rewriter.RewriteBinary(io.MultiReader(f), w)
+	s.Require().Nil(err)
+	s.Require().Equal(int64(412918), results.OriginalSize)
+	s.Require().Equal("dc4387dcd7a5ba5f778f2139121bc81dea5a44a0c2adb19a0c09dbff17e1247a", results.OriginalChecksum)
+	s.Require().Equal(int64(w.Len()), results.RewrittenSize)
+
+	// The spooled file is removed from the temp directory
+	files, _ := os.ReadDir(dir)
+	s.Require().Len(files, 0)
+}
+
+func (s *RewriterSuite) TestArchiveRewriterRewriteZip() {
+	dir := s.T().TempDir()
+	readmeDir := s.T().TempDir()
+	fpg, err := utils.NewFilePathGetterFactory().GetFilePathGetter(2)
+	s.Require().Nil(err)
+	rewriter := NewRPackageRewriter(dir, readmeDir, dir, fpg, 256, 6, Options{})
+
+	// Rewrite a ZIP binary from a path
+	results, err := rewriter.Rewrite("../testdata/binaries/readmetest_0.2.0.zip")
+	s.Require().Nil(err)
+	s.Require().Contains(results.Description, "\nRepository: RSPM\n")
+	s.Require().True(results.ReadmeMarkdown)
+	readme, err := os.ReadFile(results.ExtractedReadmePath)
+	s.Require().Nil(err)
+	s.Require().Equal("Hi, I'm the correct readme!", string(readme))
+	rewritten, err := os.ReadFile(results.RewrittenPath)
+	s.Require().Nil(err)
+	s.Require().True(bytes.HasPrefix(rewritten, []byte("PK\x03\x04")))
+
+	// Rewrite the same ZIP binary from a stream
+	f, err := os.Open("../testdata/binaries/readmetest_0.2.0.zip")
+	s.Require().Nil(err)
+	w := bytes.NewBuffer([]byte{})
+	streamResults, err := rewriter.RewriteStream(io.MultiReader(f), w)
+	s.Require().Nil(err)
+	// Timings differ between rewrites
+	s.Require().Equal(results.Metrics.Entries, streamResults.Metrics.Entries)
+	streamResults.Metrics = results.Metrics
+	s.Require().Equal(results.Results, streamResults.Results)
+	s.Require().Equal(rewritten, w.Bytes())
+}
+
+func (s *RewriterSuite) TestArchiveRewriterUnrecognizedFormat() {
+	dir := s.T().TempDir()
+	readmeDir := s.T().TempDir()
+	fpg, err := utils.NewFilePathGetterFactory().GetFilePathGetter(1)
+	s.Require().Nil(err)
+	rewriter := NewRPackageRewriter(dir, readmeDir, dir, fpg, 256, 6, Options{})
+
+	var formatErr *archive.UnrecognizedFormatError
+	w := bytes.NewBuffer([]byte{})
+	_, err = rewriter.RewriteBinary(bytes.NewBufferString("not an archive"), w)
+	s.Require().True(errors.As(err, &formatErr))
+	s.Require().True(errors.Is(err, RPackageRewriteError{}))
+
+	_, err = rewriter.RewriteStream(bytes.NewBufferString("not an archive"), w)
+	s.Require().True(errors.As(err, &formatErr))
+
+	_, err = rewriter.GetReadme(bytes.NewBufferString("not an archive"))
+	s.Require().True(errors.As(err, &formatErr))
+
+	// Temporary files are cleaned up
+	files, _ := os.ReadDir(readmeDir)
+	s.Require().Len(files, 0)
+}
+
+func (s *RewriterSuite) TestArchiveRewriterValidation() {
+	dir := s.T().TempDir()
+	readmeDir := s.T().TempDir()
+	fpg, err := utils.NewFilePathGetterFactory().GetFilePathGetter(1)
+	s.Require().Nil(err)
+	opts := Options{RewriteOptions: archive.RewriteOptions{
+		Validation: &archive.ValidationOptions{MaxEntries: 10},
+	}}
+	rewriter := NewRPackageRewriter(dir, readmeDir, dir, fpg, 256, 6, opts)
+
+	f, err := os.Open("../testdata/binaries/bindrcpp_0.2.2.zip")
+	s.Require().Nil(err)
+	w := bytes.NewBuffer([]byte{})
+	_, err = rewriter.RewriteBinary(f, w)
+	s.Require().ErrorContains(err, "error rewriting stream: archive failed entries validation: more than 10 entries")
+	var verr RPackageValidationError
+	s.Require().True(errors.As(err, &verr))
+	s.Require().Equal(archive.ViolationEntries, verr.Violation)
+	s.Require().True(errors.Is(err, RPackageRewriteError{}))
+
+	_, err = rewriter.Rewrite("../testdata/DT_0.4.tar.gz")
+	s.Require().True(errors.As(err, &verr))
+	s.Require().Equal(archive.ViolationEntries, verr.Violation)
+
+	// Temporary files are cleaned up
+	files, _ := os.ReadDir(dir)
+	s.Require().Len(files, 0)
+}
+
+// stalledReader returns the first bytes of a package, then blocks until `release` is
+// closed, like an upstream that stops sending.
+type stalledReader struct {
+	r       io.Reader
+	release chan struct{}
+}
+
+func newStalledReader(data []byte, release chan struct{}) *stalledReader {
+	return &stalledReader{r: bytes.NewReader(data[:1024]), release: release}
+}
+
+func (s *stalledReader) Read(p []byte) (int, error) {
+	if n, err := s.r.Read(p); err != io.EOF {
+		return n, err
+	}
+	<-s.release
+	return 0, io.ErrUnexpectedEOF
+}
+
+func (s *RewriterSuite) TestArchiveRewriterContext() {
+	dir := s.T().TempDir()
+	readmeDir := s.T().TempDir()
+	fpg, err := utils.NewFilePathGetterFactory().GetFilePathGetter(1)
+	s.Require().Nil(err)
+	rewriter := NewRPackageRewriter(dir, readmeDir, dir, fpg, 256, 6, Options{})
+
+	tarball, err := os.ReadFile("../testdata/readmetest_0.2.0.tar.gz")
+	s.Require().Nil(err)
+	binary, err := os.ReadFile("../testdata/binaries/bindrcpp_0.2.2.zip")
+	s.Require().Nil(err)
+
+	// The upstream stalls until the end of the test, so the rewrites only return once their
+	// blocked reads are abandoned
+	release := make(chan struct{})
+	for name, fn := range map[string]func(ctx context.Context) error{
+		"RewriteStream": func(ctx context.Context) error {
+			_, err := rewriter.RewriteStreamContext(ctx, newStalledReader(tarball, release), io.Discard)
+			return err
+		},
+		"RewriteBinary": func(ctx context.Context) error {
+			_, err := rewriter.RewriteBinaryContext(ctx, newStalledReader(tarball, release), io.Discard)
+			return err
+		},
+		"RewriteBinaryZip": func(ctx context.Context) error {
+			_, err := rewriter.RewriteBinaryContext(ctx, newStalledReader(binary, release), io.Discard)
+			return err
+		},
+		"GetReadme": func(ctx context.Context) error {
+			_, err := rewriter.GetReadmeContext(ctx, newStalledReader(tarball, release))
+			return err
+		},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		start := time.Now()
+		err = fn(ctx)
+		cancel()
+		s.Require().ErrorIs(err, context.DeadlineExceeded, name)
+		s.Require().Less(time.Since(start), 5*time.Second, name)
+	}
+
+	// Canceled rewrites of files stop too
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = rewriter.RewriteContext(ctx, "../testdata/DT_0.4.tar.gz")
+	s.Require().ErrorIs(err, context.Canceled)
+
+	// Temporary files are cleaned up
+	files, _ := os.ReadDir(dir)
+	s.Require().Len(files, 0)
+	files, _ = os.ReadDir(readmeDir)
+	s.Require().Len(files, 0)
+
+	// No goroutines are left reading the packages once the upstream returns
+	close(release)
+	s.Require().Eventually(func() bool {
+		b := make([]byte, 1024*1024)
+		return !strings.Contains(string(b[:runtime.Stack(b, true)]), "created by github.com/rstudio/package-manager-rpackagerewriter/")
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,239 @@
+// Copyright (C) 2023 by Posit Software, PBC
+
+// Package server exposes an `rewriter.RPackageRewriter` over HTTP, so that services can
+// rewrite uploaded packages without embedding the library.
+//
+// Every endpoint takes the package as the body of a POST request:
+//
+//   - `POST /rewrite` streams back the rewritten package. Its checksums and sizes are sent
+//     in the `X-Original-Checksum`, `X-Original-Size`, `X-Rewritten-Checksum`,
+//     `X-Rewritten-Size` and `X-Rewritten-Format` trailers, since they are only known once
+//     the whole package has been written.
+//   - `POST /description` returns the `archive.RewriteResults` of the package as JSON.
+//   - `POST /readme` returns the README of the package as a JSON `ReadmeResponse`.
+//
+// Failed requests return a JSON `ErrorResponse`. Since `POST /rewrite` streams the package
+// as it is rewritten, it can fail after its status was sent; the response is then cut short
+// without trailers, so clients must check the trailers before using the package.
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/archive"
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/rewriter"
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/utils"
+)
+
+const (
+	// DefaultBufferSize is the buffer size of the rewriters when Options.BufferSize is zero.
+	DefaultBufferSize = 32 * 1024
+	// DefaultGzipLevel is the gzip level of the rewriters when Options.GzipLevel is zero.
+	DefaultGzipLevel = 6
+
+	TrailerOriginalChecksum  = "X-Original-Checksum"
+	TrailerOriginalSize      = "X-Original-Size"
+	TrailerRewrittenChecksum = "X-Rewritten-Checksum"
+	TrailerRewrittenSize     = "X-Rewritten-Size"
+	TrailerRewrittenFormat   = "X-Rewritten-Format"
+)
+
+// Options configures the handler returned by NewHandler.
+type Options struct {
+	// Rewriter configures how packages are rewritten.
+	Rewriter   rewriter.Options
+	BufferSize int
+	GzipLevel  int
+	// TempDir is the directory for extracted READMEs and spooled ZIP binaries. Defaults to
+	// the system temporary directory when empty.
+	TempDir string
+
+	// MaxRequestSize rejects packages larger than this many bytes with
+	// `413 Request Entity Too Large`. Zero means no limit.
+	MaxRequestSize int64
+	// MaxConcurrent is the number of requests handled at once. Other requests wait for a
+	// slot until they are canceled. Zero means no limit.
+	MaxConcurrent int
+}
+
+// ReadmeResponse is the body returned by `POST /readme`.
+type ReadmeResponse struct {
+	Readme         string
+	ReadmeMarkdown bool
+}
+
+// ErrorResponse is the body of failed requests.
+type ErrorResponse struct {
+	Error string
+}
+
+type handler struct {
+	opts  Options
+	slots chan struct{}
+	mux   *http.ServeMux
+}
+
+// NewHandler returns an HTTP handler that rewrites packages with `opts`.
+func NewHandler(opts Options) http.Handler {
+	if opts.BufferSize == 0 {
+		opts.BufferSize = DefaultBufferSize
+	}
+	if opts.GzipLevel == 0 {
+		opts.GzipLevel = DefaultGzipLevel
+	}
+	h := &handler{opts: opts, mux: http.NewServeMux()}
+	if opts.MaxConcurrent > 0 {
+		h.slots = make(chan struct{}, opts.MaxConcurrent)
+	}
+	h.mux.HandleFunc("POST /rewrite", h.limit(h.rewrite))
+	h.mux.HandleFunc("POST /description", h.limit(h.description))
+	h.mux.HandleFunc("POST /readme", h.limit(h.readme))
+	return h
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// limit applies the request size and concurrency limits to `fn`.
+func (h *handler) limit(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.opts.MaxRequestSize > 0 {
+			// Bodies of unknown length are cut off once they exceed the limit
+			if r.ContentLength > h.opts.MaxRequestSize {
+				writeError(w, http.StatusRequestEntityTooLarge, &http.MaxBytesError{Limit: h.opts.MaxRequestSize})
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, h.opts.MaxRequestSize)
+		}
+		if h.slots != nil {
+			select {
+			case h.slots <- struct{}{}:
+				defer func() {
+					<-h.slots
+				}()
+			case <-r.Context().Done():
+				writeError(w, http.StatusServiceUnavailable, r.Context().Err())
+				return
+			}
+		}
+		fn(w, r)
+	}
+}
+
+// newRewriter returns a rewriter that extracts READMEs to `readmeDir`.
+func (h *handler) newRewriter(readmeDir string) rewriter.RPackageRewriter {
+	opts := h.opts.Rewriter
+	if opts.TempDir == "" {
+		opts.TempDir = h.opts.TempDir
+	}
+	return rewriter.NewRPackageRewriter("", readmeDir, h.opts.TempDir, &utils.LocalSourceFilePathGetter{},
+		h.opts.BufferSize, h.opts.GzipLevel, opts)
+}
+
+func (h *handler) rewrite(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Trailer", TrailerOriginalChecksum+", "+TrailerOriginalSize+", "+
+		TrailerRewrittenChecksum+", "+TrailerRewrittenSize+", "+TrailerRewrittenFormat)
+	w.Header().Set("Content-Type", "application/octet-stream")
+
+	cw := &countingWriter{w: w}
+	results, err := h.newRewriter("").RewriteBinaryContext(r.Context(), r.Body, cw)
+	if err != nil {
+		if cw.n > 0 {
+			// The status was already sent, so the response can only be cut short
+			panic(http.ErrAbortHandler)
+		}
+		w.Header().Del("Trailer")
+		writeError(w, errorStatus(err), err)
+		return
+	}
+
+	w.Header().Set(TrailerOriginalChecksum, results.OriginalChecksum)
+	w.Header().Set(TrailerOriginalSize, strconv.FormatInt(results.OriginalSize, 10))
+	w.Header().Set(TrailerRewrittenChecksum, results.RewrittenChecksum)
+	w.Header().Set(TrailerRewrittenSize, strconv.FormatInt(results.RewrittenSize, 10))
+	w.Header().Set(TrailerRewrittenFormat, string(results.RewrittenFormat))
+}
+
+func (h *handler) description(w http.ResponseWriter, r *http.Request) {
+	results, err := h.newRewriter("").RewriteBinaryContext(r.Context(), r.Body, io.Discard)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+func (h *handler) readme(w http.ResponseWriter, r *http.Request) {
+	// Each request extracts its README to its own directory
+	dir, err := os.MkdirTemp(h.opts.TempDir, "readme")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("error creating temp directory: %s", err))
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	results, err := h.newRewriter(dir).GetReadmeContext(r.Context(), r.Body)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	if results.ExtractedReadmePath == "" {
+		writeError(w, http.StatusNotFound, errors.New("no README found in package"))
+		return
+	}
+	readme, err := os.ReadFile(results.ExtractedReadmePath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("error reading README: %s", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, ReadmeResponse{Readme: string(readme), ReadmeMarkdown: results.ReadmeMarkdown})
+}
+
+// errorStatus returns the HTTP status for a failed rewrite. Only packages that cannot be
+// rewritten are client errors; failures of the server, such as those of temporary files and
+// stores, are internal errors.
+func errorStatus(err error) int {
+	var maxBytesErr *http.MaxBytesError
+	var unrecognizedErr *archive.UnrecognizedFormatError
+	var unsupportedErr *archive.UnsupportedFormatError
+	var validationErr *archive.ValidationError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		return http.StatusRequestEntityTooLarge
+	case errors.As(err, &unrecognizedErr), errors.As(err, &unsupportedErr), errors.As(err, &validationErr),
+		errors.Is(err, rewriter.ErrNoDescription):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, ErrorResponse{Error: err.Error()})
+}
+
+// countingWriter counts the bytes written to the response.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
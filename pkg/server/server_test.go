@@ -0,0 +1,197 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/archive"
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/rewriter"
+	"github.com/rstudio/package-manager-rpackagerewriter/pkg/store"
+)
+
+func TestServerSuite(t *testing.T) {
+	suite.Run(t, &ServerSuite{})
+}
+
+type ServerSuite struct {
+	suite.Suite
+}
+
+// post sends the package `../testdata/<name>` to `path` of a server with `opts`.
+func (s *ServerSuite) post(opts Options, path, name string) *http.Response {
+	data, err := os.ReadFile(filepath.Join("../testdata", name))
+	s.Require().Nil(err)
+	opts.TempDir = s.T().TempDir()
+	srv := httptest.NewServer(NewHandler(opts))
+	s.T().Cleanup(srv.Close)
+	res, err := http.Post(srv.URL+path, "application/octet-stream", bytes.NewReader(data))
+	s.Require().Nil(err)
+	s.T().Cleanup(func() {
+		_ = res.Body.Close()
+	})
+	return res
+}
+
+// decodeError returns the error message of a failed response.
+func (s *ServerSuite) decodeError(res *http.Response) string {
+	s.Require().Equal("application/json", res.Header.Get("Content-Type"))
+	var body ErrorResponse
+	s.Require().Nil(json.NewDecoder(res.Body).Decode(&body))
+	return body.Error
+}
+
+func (s *ServerSuite) TestRewrite() {
+	for _, name := range []string{"DT_0.4.tar.gz", "binaries/bindrcpp_0.2.2.zip"} {
+		data, err := os.ReadFile(filepath.Join("../testdata", name))
+		s.Require().Nil(err)
+
+		res := s.post(Options{}, "/rewrite", name)
+		s.Require().Equal(http.StatusOK, res.StatusCode, name)
+		body, err := io.ReadAll(res.Body)
+		s.Require().Nil(err)
+
+		// Checksums and sizes are sent after the body
+		s.Require().Equal(fmt.Sprintf("%x", sha256.Sum256(data)), res.Trailer.Get(TrailerOriginalChecksum))
+		s.Require().Equal(strconv.Itoa(len(data)), res.Trailer.Get(TrailerOriginalSize))
+		s.Require().Equal(fmt.Sprintf("%x", sha256.Sum256(body)), res.Trailer.Get(TrailerRewrittenChecksum))
+		s.Require().Equal(strconv.Itoa(len(body)), res.Trailer.Get(TrailerRewrittenSize))
+		format, _, err := archive.DetectFormat(bytes.NewReader(body))
+		s.Require().Nil(err)
+		s.Require().Equal(string(format), res.Trailer.Get(TrailerRewrittenFormat))
+	}
+}
+
+func (s *ServerSuite) TestRewriteErrors() {
+	// Binaries require a DESCRIPTION, which is only known once the package was streamed, so
+	// the response is cut short without trailers
+	res := s.post(Options{}, "/rewrite", "binaries/bindrcpp_0.2.2-no-desc.tar.gz")
+	s.Require().Equal(http.StatusOK, res.StatusCode)
+	_, err := io.ReadAll(res.Body)
+	s.Require().ErrorIs(err, io.ErrUnexpectedEOF)
+	s.Require().Empty(res.Trailer.Get(TrailerRewrittenChecksum))
+
+	// Other requests fail before the package is streamed
+	res = s.post(Options{}, "/description", "binaries/bindrcpp_0.2.2-no-desc.tar.gz")
+	s.Require().Equal(http.StatusBadRequest, res.StatusCode)
+	s.Require().Contains(s.decodeError(res), "no DESCRIPTION file found in archive")
+
+	res = s.post(Options{MaxRequestSize: 1024}, "/rewrite", "DT_0.4.tar.gz")
+	s.Require().Equal(http.StatusRequestEntityTooLarge, res.StatusCode)
+	s.Require().Contains(s.decodeError(res), "request body too large")
+
+	// Bodies of unknown length are limited while they are read
+	data, err := os.ReadFile("../testdata/DT_0.4.tar.gz")
+	s.Require().Nil(err)
+	rec := httptest.NewRecorder()
+	NewHandler(Options{MaxRequestSize: 1024}).ServeHTTP(rec,
+		httptest.NewRequest(http.MethodPost, "/description", io.MultiReader(bytes.NewReader(data))))
+	s.Require().Equal(http.StatusRequestEntityTooLarge, rec.Code)
+	s.Require().Contains(s.decodeError(rec.Result()), "request body too large")
+
+	srv := httptest.NewServer(NewHandler(Options{}))
+	defer srv.Close()
+	res, err = http.Post(srv.URL+"/rewrite", "text/plain", bytes.NewReader([]byte("not a package")))
+	s.Require().Nil(err)
+	defer res.Body.Close()
+	s.Require().Equal(http.StatusBadRequest, res.StatusCode)
+	s.Require().Contains(s.decodeError(res), "unrecognized")
+
+	res, err = http.Get(srv.URL + "/rewrite")
+	s.Require().Nil(err)
+	defer res.Body.Close()
+	s.Require().Equal(http.StatusMethodNotAllowed, res.StatusCode)
+
+	// Failures of the server are not blamed on the package
+	spoolOpts := archive.RewriteOptions{SpoolMemoryLimit: 1, TempDir: filepath.Join(s.T().TempDir(), "missing")}
+	res = s.post(Options{Rewriter: rewriter.Options{RewriteOptions: spoolOpts}}, "/description", "binaries/bindrcpp_0.2.2.zip")
+	s.Require().Equal(http.StatusInternalServerError, res.StatusCode)
+	s.Require().Contains(s.decodeError(res), "error spooling stream")
+
+	res = s.post(Options{Rewriter: rewriter.Options{ReadmeStore: failingStore{}}}, "/readme", "DT_0.4.tar.gz")
+	s.Require().Equal(http.StatusInternalServerError, res.StatusCode)
+	s.Require().Contains(s.decodeError(res), "store is unavailable")
+}
+
+// failingStore is a store.Store that cannot create objects.
+type failingStore struct{}
+
+func (failingStore) Create(ctx context.Context) (store.Writer, error) {
+	return nil, errors.New("store is unavailable")
+}
+
+func (failingStore) Exists(ctx context.Context, key string) (bool, error) {
+	return false, errors.New("store is unavailable")
+}
+
+func (s *ServerSuite) TestDescription() {
+	res := s.post(Options{}, "/description", "DT_0.4.tar.gz")
+	s.Require().Equal(http.StatusOK, res.StatusCode)
+	s.Require().Equal("application/json", res.Header.Get("Content-Type"))
+	var results archive.RewriteResults
+	s.Require().Nil(json.NewDecoder(res.Body).Decode(&results))
+	name, _ := results.DescriptionFields.Get("Package")
+	s.Require().Equal("DT", name)
+	s.Require().NotEmpty(results.RewrittenChecksum)
+}
+
+func (s *ServerSuite) TestReadme() {
+	res := s.post(Options{}, "/readme", "readmetest_0.2.0.tar.gz")
+	s.Require().Equal(http.StatusOK, res.StatusCode)
+	var body ReadmeResponse
+	s.Require().Nil(json.NewDecoder(res.Body).Decode(&body))
+	s.Require().Equal(ReadmeResponse{Readme: "Hi, I'm the correct readme!", ReadmeMarkdown: true}, body)
+
+	res = s.post(Options{}, "/readme", "binaries/bindrcpp_0.2.2.zip")
+	s.Require().Equal(http.StatusNotFound, res.StatusCode)
+	s.Require().Equal("no README found in package", s.decodeError(res))
+}
+
+func (s *ServerSuite) TestMaxConcurrent() {
+	data, err := os.ReadFile("../testdata/DT_0.4.tar.gz")
+	s.Require().Nil(err)
+	h := NewHandler(Options{MaxConcurrent: 1, TempDir: s.T().TempDir()})
+
+	// The first request holds the only slot until its body is complete
+	pr, pw := io.Pipe()
+	first := make(chan int)
+	go func() {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/description", pr))
+		first <- rec.Code
+	}()
+	_, err = pw.Write(data[:1024])
+	s.Require().Nil(err)
+
+	second := make(chan int)
+	go func() {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/description", bytes.NewReader(data)))
+		second <- rec.Code
+	}()
+	select {
+	case <-second:
+		s.Fail("second request ran while the first held the only slot")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	_, err = pw.Write(data[1024:])
+	s.Require().Nil(err)
+	s.Require().Nil(pw.Close())
+	s.Require().Equal(http.StatusOK, <-first)
+	s.Require().Equal(http.StatusOK, <-second)
+}
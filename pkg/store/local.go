@@ -0,0 +1,274 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// rename is replaced by tests to simulate moves between devices.
+var rename = os.Rename
+
+// link is replaced by tests to simulate filesystems without hard links.
+var link = os.Link
+
+// LocalStore stores objects as files in a directory. Objects are written to temporary
+// files, synced to disk, and renamed to their key when committed. Temporary files on
+// another device than their key are copied next to it when they are prepared, so that
+// committing them is always a rename within a directory.
+type LocalStore struct {
+	Dir string
+	// TempDir is the directory of the temporary files. Defaults to Dir when empty.
+	TempDir string
+}
+
+// NewLocalStore returns a store for the directory `dir`.
+func NewLocalStore(dir string) *LocalStore {
+	return &LocalStore{Dir: dir}
+}
+
+// Path returns the path of the file for `key`.
+func (s *LocalStore) Path(key string) string {
+	return filepath.Join(s.Dir, filepath.FromSlash(key))
+}
+
+func (s *LocalStore) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := os.Stat(s.Path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("could not check for %s: %s", key, err)
+	}
+	return true, nil
+}
+
+func (s *LocalStore) Create(ctx context.Context) (Writer, error) {
+	dir := s.TempDir
+	if dir == "" {
+		dir = s.Dir
+	}
+	f, err := os.CreateTemp(dir, "")
+	if err != nil {
+		return nil, fmt.Errorf("could not create temp file in %s: %s", dir, err)
+	}
+	return &localWriter{store: s, f: f, staged: f.Name()}, nil
+}
+
+type localWriter struct {
+	store *LocalStore
+	f     *os.File
+	// staged is the file that is renamed to `path` on commit.
+	staged string
+	path   string
+	// backup is a link to the file replaced by the commit, if any.
+	backup    string
+	prepared  bool
+	committed bool
+	closed    bool
+}
+
+func (w *localWriter) Write(p []byte) (int, error) {
+	return w.f.Write(p)
+}
+
+func (w *localWriter) Prepare(ctx context.Context, key string) error {
+	w.path = w.store.Path(key)
+	if err := w.f.Sync(); err != nil {
+		return fmt.Errorf("error syncing file %s: %s", w.f.Name(), err)
+	}
+	if err := w.f.Close(); err != nil {
+		return fmt.Errorf("error closing file %s: %s", w.f.Name(), err)
+	}
+	dir := filepath.Dir(w.path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("error creating directory for %s: %s", w.path, err)
+	}
+	if dir != filepath.Dir(w.staged) {
+		staged, err := stage(w.staged, dir)
+		if err != nil {
+			return fmt.Errorf("error moving file %s to %s: %s", w.staged, dir, err)
+		}
+		w.staged = staged
+	}
+	w.prepared = true
+	return nil
+}
+
+func (w *localWriter) Commit(ctx context.Context) (string, error) {
+	if w.closed {
+		return "", errors.New("cannot commit a closed write")
+	} else if !w.prepared {
+		return "", errors.New("cannot commit a write that was not prepared")
+	}
+	dir := filepath.Dir(w.path)
+
+	// Keep the replaced file until the write is closed, so that the commit can be undone
+	if _, err := os.Lstat(w.path); err == nil {
+		backup, err := tempName(dir)
+		if err != nil {
+			return "", err
+		}
+		if err = keepFile(w.path, backup); err != nil {
+			_ = os.Remove(backup)
+			return "", fmt.Errorf("error keeping replaced file %s: %s", w.path, err)
+		}
+		w.backup = backup
+	}
+	if err := rename(w.staged, w.path); err != nil {
+		return "", fmt.Errorf("error moving file %s to %s: %s", w.staged, w.path, err)
+	}
+	w.committed = true
+	if err := syncDir(dir); err != nil {
+		return "", err
+	}
+	return w.path, nil
+}
+
+func (w *localWriter) Abort() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if !w.committed {
+		_ = w.f.Close()
+		for _, path := range []string{w.backup, w.staged, w.f.Name()} {
+			if path == "" {
+				continue
+			}
+			if err := removeIfExists(path); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Restore the replaced file, or remove the committed one
+	var err error
+	if w.backup != "" {
+		err = rename(w.backup, w.path)
+	} else {
+		err = removeIfExists(w.path)
+	}
+	if err != nil {
+		return fmt.Errorf("error restoring %s: %s", w.path, err)
+	}
+	return syncDir(filepath.Dir(w.path))
+}
+
+func (w *localWriter) Close() error {
+	if !w.committed {
+		return w.Abort()
+	}
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if w.backup != "" {
+		return removeIfExists(w.backup)
+	}
+	return nil
+}
+
+// stage moves the file at `path` to a new temporary file in `dir`, and returns its path.
+// Files on another device are copied and synced, since they cannot be renamed.
+func stage(path, dir string) (string, error) {
+	staged, err := tempName(dir)
+	if err != nil {
+		return "", err
+	}
+	err = rename(path, staged)
+	if err == nil {
+		return staged, nil
+	}
+	if errors.Is(err, syscall.EXDEV) {
+		if err = copyFile(path, staged); err == nil {
+			if err = os.Remove(path); err == nil {
+				return staged, nil
+			}
+		}
+	}
+	_ = os.Remove(staged)
+	return "", err
+}
+
+// keepFile keeps the file at `path` under the reserved name `backup`, as a hard link, or as
+// a synced copy on filesystems without hard links.
+func keepFile(path, backup string) error {
+	// Links cannot replace the reserved file
+	_ = os.Remove(backup)
+	if err := link(path, backup); err == nil {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(backup, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_ = f.Close()
+	return copyFile(path, backup)
+}
+
+// tempName reserves the name of a new temporary file in `dir`.
+func tempName(dir string) (string, error) {
+	f, err := os.CreateTemp(dir, "")
+	if err != nil {
+		return "", fmt.Errorf("could not create temp file in %s: %s", dir, err)
+	}
+	_ = f.Close()
+	return f.Name(), nil
+}
+
+// copyFile copies the file at `src` to `dst`, and syncs it.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func(in *os.File) {
+		_ = in.Close()
+	}(in)
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err = out.Sync(); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// syncDir syncs the directory `dir`, so that renames within it are durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("error opening directory %s: %s", dir, err)
+	}
+	defer func(d *os.File) {
+		_ = d.Close()
+	}(d)
+	if err = d.Sync(); err != nil {
+		return fmt.Errorf("error syncing directory %s: %s", dir, err)
+	}
+	return nil
+}
+
+func removeIfExists(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing temp file %s: %s", path, err)
+	}
+	return nil
+}
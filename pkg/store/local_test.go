@@ -0,0 +1,184 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package store
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+func TestLocalStoreSuite(t *testing.T) {
+	suite.Run(t, &LocalStoreSuite{})
+}
+
+type LocalStoreSuite struct {
+	suite.Suite
+}
+
+func (s *LocalStoreSuite) TearDownTest() {
+	rename = os.Rename
+	link = os.Link
+}
+
+// write writes `data` to a new object of `store`.
+func (s *LocalStoreSuite) write(store Store, data string) Writer {
+	w, err := store.Create(context.Background())
+	s.Require().Nil(err)
+	_, err = w.Write([]byte(data))
+	s.Require().Nil(err)
+	return w
+}
+
+// files returns the names of the files in `dir`.
+func (s *LocalStoreSuite) files(dir string) []string {
+	entries, err := os.ReadDir(dir)
+	s.Require().Nil(err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func (s *LocalStoreSuite) TestCommit() {
+	dir := s.T().TempDir()
+	store := NewLocalStore(dir)
+
+	path, err := Commit(context.Background(), s.write(store, "data"), "src/contrib/a.tar.gz")
+	s.Require().Nil(err)
+	s.Require().Equal(filepath.Join(dir, "src", "contrib", "a.tar.gz"), path)
+	s.Require().Equal(path, store.Path("src/contrib/a.tar.gz"))
+	data, err := os.ReadFile(path)
+	s.Require().Nil(err)
+	s.Require().Equal("data", string(data))
+	s.Require().Equal([]string{"src"}, s.files(dir))
+	s.Require().Equal([]string{"a.tar.gz"}, s.files(filepath.Join(dir, "src", "contrib")))
+	exists, err := store.Exists(context.Background(), "src/contrib/a.tar.gz")
+	s.Require().Nil(err)
+	s.Require().True(exists)
+	exists, err = store.Exists(context.Background(), "src/contrib/b.tar.gz")
+	s.Require().Nil(err)
+	s.Require().False(exists)
+
+	// Replaced files are discarded once the write is closed
+	_, err = Commit(context.Background(), s.write(store, "new"), "src/contrib/a.tar.gz")
+	s.Require().Nil(err)
+	data, err = os.ReadFile(path)
+	s.Require().Nil(err)
+	s.Require().Equal("new", string(data))
+	s.Require().Equal([]string{"a.tar.gz"}, s.files(filepath.Join(dir, "src", "contrib")))
+}
+
+func (s *LocalStoreSuite) TestAbort() {
+	dir := s.T().TempDir()
+	store := NewLocalStore(dir)
+
+	// Before a commit, the data is discarded
+	w := s.write(store, "data")
+	s.Require().Nil(w.Abort())
+	s.Require().Nil(w.Abort())
+	s.Require().Empty(s.files(dir))
+
+	w = s.write(store, "data")
+	s.Require().Nil(w.Prepare(context.Background(), "a.tar.gz"))
+	s.Require().Nil(w.Close())
+	s.Require().Empty(s.files(dir))
+
+	// After a commit, the replaced file is restored
+	path, err := Commit(context.Background(), s.write(store, "old"), "a.tar.gz")
+	s.Require().Nil(err)
+	w = s.write(store, "new")
+	s.Require().Nil(w.Prepare(context.Background(), "a.tar.gz"))
+	_, err = w.Commit(context.Background())
+	s.Require().Nil(err)
+	s.Require().Nil(w.Abort())
+	data, err := os.ReadFile(path)
+	s.Require().Nil(err)
+	s.Require().Equal("old", string(data))
+	s.Require().Equal([]string{"a.tar.gz"}, s.files(dir))
+
+	// or the committed file is removed
+	w = s.write(store, "new")
+	s.Require().Nil(w.Prepare(context.Background(), "b.tar.gz"))
+	_, err = w.Commit(context.Background())
+	s.Require().Nil(err)
+	s.Require().Nil(w.Abort())
+	s.Require().Equal([]string{"a.tar.gz"}, s.files(dir))
+
+	// Closed writes cannot be aborted
+	w = s.write(store, "new")
+	_, err = Commit(context.Background(), w, "b.tar.gz")
+	s.Require().Nil(err)
+	s.Require().Nil(w.Abort())
+	s.Require().Equal([]string{"a.tar.gz", "b.tar.gz"}, s.files(dir))
+
+	_, err = NewLocalStore(filepath.Join(dir, "missing")).Create(context.Background())
+	s.Require().ErrorContains(err, "could not create temp file")
+}
+
+func (s *LocalStoreSuite) TestNoHardLinks() {
+	link = func(oldname, newname string) error {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EPERM}
+	}
+	dir := s.T().TempDir()
+	store := NewLocalStore(dir)
+
+	// Existing keys are overwritten, keeping a copy of the replaced file
+	path, err := Commit(context.Background(), s.write(store, "old"), "a.tar.gz")
+	s.Require().Nil(err)
+	_, err = Commit(context.Background(), s.write(store, "new"), "a.tar.gz")
+	s.Require().Nil(err)
+	data, err := os.ReadFile(path)
+	s.Require().Nil(err)
+	s.Require().Equal("new", string(data))
+	s.Require().Equal([]string{"a.tar.gz"}, s.files(dir))
+
+	// and restoring it when the commit is undone
+	w := s.write(store, "newer")
+	s.Require().Nil(w.Prepare(context.Background(), "a.tar.gz"))
+	_, err = w.Commit(context.Background())
+	s.Require().Nil(err)
+	s.Require().Nil(w.Abort())
+	data, err = os.ReadFile(path)
+	s.Require().Nil(err)
+	s.Require().Equal("new", string(data))
+	s.Require().Equal([]string{"a.tar.gz"}, s.files(dir))
+}
+
+func (s *LocalStoreSuite) TestCrossDevice() {
+	dir := s.T().TempDir()
+	tempDir := s.T().TempDir()
+	store := &LocalStore{Dir: dir, TempDir: tempDir}
+
+	// Temp files that cannot be renamed are copied next to their key
+	var moves int
+	rename = func(from, to string) error {
+		if filepath.Dir(from) != filepath.Dir(to) {
+			moves++
+			return &os.LinkError{Op: "rename", Old: from, New: to, Err: syscall.EXDEV}
+		}
+		return os.Rename(from, to)
+	}
+	path, err := Commit(context.Background(), s.write(store, "data"), "a.tar.gz")
+	s.Require().Nil(err)
+	s.Require().Equal(1, moves)
+	data, err := os.ReadFile(path)
+	s.Require().Nil(err)
+	s.Require().Equal("data", string(data))
+	s.Require().Empty(s.files(tempDir))
+	s.Require().Equal([]string{"a.tar.gz"}, s.files(dir))
+
+	// Other errors fail the write
+	rename = func(from, to string) error {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: syscall.EACCES}
+	}
+	w := s.write(store, "new")
+	s.Require().ErrorContains(w.Prepare(context.Background(), "a.tar.gz"), "permission denied")
+	s.Require().Nil(w.Abort())
+	s.Require().Empty(s.files(tempDir))
+	s.Require().Equal([]string{"a.tar.gz"}, s.files(dir))
+}
@@ -0,0 +1,113 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// MemoryStore keeps objects in memory, mainly for tests. The location of a committed object
+// is its key.
+type MemoryStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+// NewMemoryStore returns an empty store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{objects: make(map[string][]byte)}
+}
+
+// Get returns the object committed under `key`.
+func (s *MemoryStore) Get(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[key]
+	return data, ok
+}
+
+// Keys returns the sorted keys of the committed objects.
+func (s *MemoryStore) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.objects))
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *MemoryStore) Exists(ctx context.Context, key string) (bool, error) {
+	_, ok := s.Get(key)
+	return ok, nil
+}
+
+func (s *MemoryStore) Create(ctx context.Context) (Writer, error) {
+	return &memoryWriter{store: s}, nil
+}
+
+type memoryWriter struct {
+	store *MemoryStore
+	buf   bytes.Buffer
+	key   string
+	// replaced is the object replaced by the commit, if `existed`.
+	replaced  []byte
+	existed   bool
+	prepared  bool
+	committed bool
+	closed    bool
+}
+
+func (w *memoryWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *memoryWriter) Prepare(ctx context.Context, key string) error {
+	w.key = key
+	w.prepared = true
+	return nil
+}
+
+func (w *memoryWriter) Commit(ctx context.Context) (string, error) {
+	if w.closed {
+		return "", errors.New("cannot commit a closed write")
+	} else if !w.prepared {
+		return "", errors.New("cannot commit a write that was not prepared")
+	}
+	w.store.mu.Lock()
+	defer w.store.mu.Unlock()
+	w.replaced, w.existed = w.store.objects[w.key]
+	w.store.objects[w.key] = w.buf.Bytes()
+	w.committed = true
+	return w.key, nil
+}
+
+func (w *memoryWriter) Abort() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if !w.committed {
+		return nil
+	}
+	w.store.mu.Lock()
+	defer w.store.mu.Unlock()
+	if w.existed {
+		w.store.objects[w.key] = w.replaced
+	} else {
+		delete(w.store.objects, w.key)
+	}
+	return nil
+}
+
+func (w *memoryWriter) Close() error {
+	if !w.committed {
+		return w.Abort()
+	}
+	w.closed = true
+	return nil
+}
@@ -0,0 +1,82 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package store
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+func TestMemoryStoreSuite(t *testing.T) {
+	suite.Run(t, &MemoryStoreSuite{})
+}
+
+type MemoryStoreSuite struct {
+	suite.Suite
+}
+
+// write writes `data` to a new object of `store`.
+func (s *MemoryStoreSuite) write(store Store, data string) Writer {
+	w, err := store.Create(context.Background())
+	s.Require().Nil(err)
+	_, err = w.Write([]byte(data))
+	s.Require().Nil(err)
+	return w
+}
+
+func (s *MemoryStoreSuite) TestStore() {
+	store := NewMemoryStore()
+
+	location, err := Commit(context.Background(), s.write(store, "b"), "b.tar.gz")
+	s.Require().Nil(err)
+	s.Require().Equal("b.tar.gz", location)
+	_, err = Commit(context.Background(), s.write(store, "a"), "a.tar.gz")
+	s.Require().Nil(err)
+
+	// Aborted objects are never visible
+	w := s.write(store, "c")
+	s.Require().Nil(w.Prepare(context.Background(), "c.tar.gz"))
+	s.Require().Nil(w.Abort())
+	_, err = w.Commit(context.Background())
+	s.Require().EqualError(err, "cannot commit a closed write")
+
+	s.Require().Equal([]string{"a.tar.gz", "b.tar.gz"}, store.Keys())
+	exists, err := store.Exists(context.Background(), "a.tar.gz")
+	s.Require().Nil(err)
+	s.Require().True(exists)
+	exists, err = store.Exists(context.Background(), "c.tar.gz")
+	s.Require().Nil(err)
+	s.Require().False(exists)
+	data, ok := store.Get("b.tar.gz")
+	s.Require().True(ok)
+	s.Require().Equal("b", string(data))
+}
+
+func (s *MemoryStoreSuite) TestAbort() {
+	store := NewMemoryStore()
+	_, err := Commit(context.Background(), s.write(store, ""), "a.tar.gz")
+	s.Require().Nil(err)
+
+	// Aborting a commit restores the replaced object, even when it is empty
+	w := s.write(store, "new")
+	s.Require().Nil(w.Prepare(context.Background(), "a.tar.gz"))
+	_, err = w.Commit(context.Background())
+	s.Require().Nil(err)
+	data, _ := store.Get("a.tar.gz")
+	s.Require().Equal("new", string(data))
+	s.Require().Nil(w.Abort())
+	data, ok := store.Get("a.tar.gz")
+	s.Require().True(ok)
+	s.Require().Empty(data)
+
+	w = s.write(store, "new")
+	s.Require().Nil(w.Prepare(context.Background(), "b.tar.gz"))
+	_, err = w.Commit(context.Background())
+	s.Require().Nil(err)
+	s.Require().Nil(w.Abort())
+	s.Require().Equal([]string{"a.tar.gz"}, store.Keys())
+
+	_, err = s.write(store, "new").Commit(context.Background())
+	s.Require().EqualError(err, "cannot commit a write that was not prepared")
+}
@@ -0,0 +1,93 @@
+// Copyright (C) 2023 by Posit Software, PBC
+
+// Package store provides the storage backends that rewritten packages and READMEs are
+// written to. Objects are written to a temporary location first, and only become visible
+// under their key once they are committed, since the key of a rewritten package depends on
+// its checksums.
+package store
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// Store creates objects under slash-separated keys, such as `012.tar.gz` or
+// `src/contrib/DT_0.4.tar.gz`.
+type Store interface {
+	// Create returns a writer for a new object whose key is not known yet.
+	Create(ctx context.Context) (Writer, error)
+	// Exists returns true if an object is committed under `key`.
+	Exists(ctx context.Context, key string) (bool, error)
+}
+
+// Writer writes a new object to a Store. Objects are committed in two phases, so that
+// several objects can be committed together with CommitAll:
+//
+//   - Prepare makes the written data durable next to `key`, without making it visible. It
+//     does all the work that may fail, such as syncing and moving data between devices.
+//   - Commit makes the prepared object visible under its key.
+//
+// Until Close is called, Abort undoes the write: it discards the data before Commit, and
+// restores the object replaced by Commit after it. Abort does nothing after Close, so it
+// can be deferred.
+type Writer interface {
+	io.Writer
+
+	// Prepare prepares the written data to be committed under `key`.
+	Prepare(ctx context.Context, key string) error
+	// Commit stores the prepared data under its key, replacing any existing object, and
+	// returns its location, such as the path of a file.
+	Commit(ctx context.Context) (string, error)
+	// Abort undoes the write.
+	Abort() error
+	// Close completes a committed write, and discards the object it replaced. It aborts
+	// writes that were not committed.
+	Close() error
+}
+
+// Commit commits the object written to `w` under `key`, and returns its location.
+func Commit(ctx context.Context, w Writer, key string) (string, error) {
+	locations, err := CommitAll(ctx, []Writer{w}, []string{key})
+	if err != nil {
+		return "", err
+	}
+	return locations[0], nil
+}
+
+// CommitAll commits the objects written to `writers` under the matching `keys`, and returns
+// their locations. Either all of the objects are stored, or none of them are and all of the
+// writers are aborted.
+func CommitAll(ctx context.Context, writers []Writer, keys []string) ([]string, error) {
+	if len(writers) != len(keys) {
+		return nil, errors.New("each writer needs a key")
+	}
+	for i, w := range writers {
+		if err := w.Prepare(ctx, keys[i]); err != nil {
+			abortAll(writers)
+			return nil, err
+		}
+	}
+	locations := make([]string, len(writers))
+	for i, w := range writers {
+		location, err := w.Commit(ctx)
+		if err != nil {
+			abortAll(writers)
+			return nil, err
+		}
+		locations[i] = location
+	}
+	// The objects are stored, so failures only leave the replaced objects behind
+	for _, w := range writers {
+		_ = w.Close()
+	}
+	return locations, nil
+}
+
+// abortAll aborts `writers` in reverse order, so that objects committed under the same key
+// are restored to their original state.
+func abortAll(writers []Writer) {
+	for i := len(writers) - 1; i >= 0; i-- {
+		_ = writers[i].Abort()
+	}
+}
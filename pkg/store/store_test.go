@@ -0,0 +1,74 @@
+// Copyright (C) 2023 by Posit Software, PBC
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+func TestStoreSuite(t *testing.T) {
+	suite.Run(t, &StoreSuite{})
+}
+
+type StoreSuite struct {
+	suite.Suite
+}
+
+// failingWriter fails the phase named by `fail`.
+type failingWriter struct {
+	Writer
+	fail string
+}
+
+func (w *failingWriter) Prepare(ctx context.Context, key string) error {
+	if w.fail == "prepare" {
+		return errors.New("prepare failed")
+	}
+	return w.Writer.Prepare(ctx, key)
+}
+
+func (w *failingWriter) Commit(ctx context.Context) (string, error) {
+	if w.fail == "commit" {
+		return "", errors.New("commit failed")
+	}
+	return w.Writer.Commit(ctx)
+}
+
+// writers returns writers for `data`, where the last one fails the phase `fail`.
+func (s *StoreSuite) writers(store Store, fail string, data ...string) []Writer {
+	var writers []Writer
+	for _, d := range data {
+		w, err := store.Create(context.Background())
+		s.Require().Nil(err)
+		_, err = w.Write([]byte(d))
+		s.Require().Nil(err)
+		writers = append(writers, w)
+	}
+	writers[len(writers)-1] = &failingWriter{Writer: writers[len(writers)-1], fail: fail}
+	return writers
+}
+
+func (s *StoreSuite) TestCommitAll() {
+	store := NewMemoryStore()
+	locations, err := CommitAll(context.Background(), s.writers(store, "", "a", "b"), []string{"a.tar.gz", "a.readme"})
+	s.Require().Nil(err)
+	s.Require().Equal([]string{"a.tar.gz", "a.readme"}, locations)
+
+	// Failures leave the store unchanged
+	for _, fail := range []string{"prepare", "commit"} {
+		_, err = CommitAll(context.Background(), s.writers(store, fail, "new", "new", "new"),
+			[]string{"a.tar.gz", "b.tar.gz", "a.readme"})
+		s.Require().EqualError(err, fail+" failed")
+		s.Require().Equal([]string{"a.readme", "a.tar.gz"}, store.Keys())
+		data, _ := store.Get("a.tar.gz")
+		s.Require().Equal("a", string(data))
+		data, _ = store.Get("a.readme")
+		s.Require().Equal("b", string(data))
+	}
+
+	_, err = CommitAll(context.Background(), s.writers(store, "", "a"), nil)
+	s.Require().EqualError(err, "each writer needs a key")
+}
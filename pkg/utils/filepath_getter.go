@@ -3,16 +3,17 @@ package utils
 
 import (
 	"fmt"
-	"path/filepath"
 
 	"github.com/rstudio/package-manager-rpackagerewriter/pkg/archive"
 	v1 "github.com/rstudio/package-manager-rpackagerewriter/pkg/utils/v1"
 	v2 "github.com/rstudio/package-manager-rpackagerewriter/pkg/utils/v2"
 )
 
+// FilePathGetter names rewritten packages and their READMEs. Names are slash-separated
+// `store.Store` keys, which are relative to the output directory of a local store.
 type FilePathGetter interface {
-	GetFilePath(outputDir string, arch *archive.Results) string
-	GetReadmePath(outputDir string, arch *archive.Results) string
+	GetFileKey(arch *archive.Results) string
+	GetReadmeKey(arch *archive.Results) string
 }
 
 type FilePathGetterFactory interface {
@@ -55,14 +56,14 @@ func (f *biocFilePathGetterFactory) GetFilePathGetter(schemaVersion int) (FilePa
 // LocalSourceFilePathGetter is used by local sources, which don't distinguish on schema versions
 type LocalSourceFilePathGetter struct{}
 
-func (g *LocalSourceFilePathGetter) GetFilePath(outputDir string, arch *archive.Results) string {
-	return filepath.Join(outputDir, arch.OriginalChecksum+".tar.gz")
+func (g *LocalSourceFilePathGetter) GetFileKey(arch *archive.Results) string {
+	return arch.OriginalChecksum + arch.RewrittenFormat.Extension()
 }
 
-func (g *LocalSourceFilePathGetter) GetReadmePath(outputDir string, arch *archive.Results) string {
+func (g *LocalSourceFilePathGetter) GetReadmeKey(arch *archive.Results) string {
 	ext := ".readme"
 	if arch.ReadmeMarkdown {
 		ext += ".md"
 	}
-	return filepath.Join(outputDir, arch.OriginalChecksum+ext)
+	return arch.OriginalChecksum + ext
 }
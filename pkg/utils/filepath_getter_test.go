@@ -41,13 +41,13 @@ func (s *FilePathGetterSuite) TestGetLocal() {
 		OriginalChecksum:  "012",
 		RewrittenChecksum: "123",
 	}
-	path := fpg.GetFilePath("test/test", arch)
-	s.Require().Equal("test/test/012.tar.gz", path)
-	readme := fpg.GetReadmePath("test/test", arch)
-	s.Require().Equal("test/test/012.readme", readme)
+	path := fpg.GetFileKey(arch)
+	s.Require().Equal("012.tar.gz", path)
+	readme := fpg.GetReadmeKey(arch)
+	s.Require().Equal("012.readme", readme)
 	arch.ReadmeMarkdown = true
-	readme = fpg.GetReadmePath("test/test", arch)
-	s.Require().Equal("test/test/012.readme.md", readme)
+	readme = fpg.GetReadmeKey(arch)
+	s.Require().Equal("012.readme.md", readme)
 }
 
 func (s *FilePathGetterSuite) TestGetBioc() {
@@ -72,3 +72,25 @@ func (s *FilePathGetterSuite) TestGetBioc() {
 	_, err = fpf.GetFilePathGetter(13)
 	s.Require().ErrorContains(err, "Invalid version 13 for GetFilePathGetter")
 }
+
+// Packages are named after the format they were written in, such as ZIP binaries or the xz
+// tarballs written with `OutputKeepInput`.
+func (s *FilePathGetterSuite) TestGetFileKeyFormats() {
+	for _, test := range []struct {
+		fpg      FilePathGetter
+		checksum string
+	}{
+		{&v1.V1FilePathGetter{}, "123"},
+		{&v2.V2V3FilePathGetter{}, "012"},
+		{&LocalSourceFilePathGetter{}, "012"},
+	} {
+		for format, ext := range map[archive.Format]string{
+			archive.FormatZip:  ".zip",
+			archive.FormatXz:   ".tar.xz",
+			archive.FormatGzip: ".tar.gz",
+		} {
+			arch := &archive.Results{OriginalChecksum: "012", RewrittenChecksum: "123", RewrittenFormat: format}
+			s.Require().Equal(test.checksum+ext, test.fpg.GetFileKey(arch), "%T %s", test.fpg, format)
+		}
+	}
+}
@@ -1,22 +1,18 @@
 // Copyright (C) 2023 by Posit Software, PBC
 package v2
 
-import (
-	"path/filepath"
-
-	"github.com/rstudio/package-manager-rpackagerewriter/pkg/archive"
-)
+import "github.com/rstudio/package-manager-rpackagerewriter/pkg/archive"
 
 type V2V3FilePathGetter struct{}
 
-func (g *V2V3FilePathGetter) GetFilePath(outputDir string, arch *archive.Results) string {
-	return filepath.Join(outputDir, arch.OriginalChecksum+".tar.gz")
+func (g *V2V3FilePathGetter) GetFileKey(arch *archive.Results) string {
+	return arch.OriginalChecksum + arch.RewrittenFormat.Extension()
 }
 
-func (g *V2V3FilePathGetter) GetReadmePath(outputDir string, arch *archive.Results) string {
+func (g *V2V3FilePathGetter) GetReadmeKey(arch *archive.Results) string {
 	ext := ".readme"
 	if arch.ReadmeMarkdown {
 		ext += ".md"
 	}
-	return filepath.Join(outputDir, arch.OriginalChecksum+ext)
+	return arch.OriginalChecksum + ext
 }
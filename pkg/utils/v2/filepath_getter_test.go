@@ -23,11 +23,11 @@ func (s *FilePathGetterSuite) TestGet() {
 		OriginalChecksum:  "012",
 		RewrittenChecksum: "123",
 	}
-	path := fpg.GetFilePath("test/test", arch)
-	s.Require().Equal("test/test/012.tar.gz", path)
-	readme := fpg.GetReadmePath("test/test", arch)
-	s.Require().Equal("test/test/012.readme", readme)
+	path := fpg.GetFileKey(arch)
+	s.Require().Equal("012.tar.gz", path)
+	readme := fpg.GetReadmeKey(arch)
+	s.Require().Equal("012.readme", readme)
 	arch.ReadmeMarkdown = true
-	readme = fpg.GetReadmePath("test/test", arch)
-	s.Require().Equal("test/test/012.readme.md", readme)
+	readme = fpg.GetReadmeKey(arch)
+	s.Require().Equal("012.readme.md", readme)
 }